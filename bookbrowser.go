@@ -6,17 +6,21 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	_ "github.com/sblinch/BookBrowser/formats/epub"
 	_ "github.com/sblinch/BookBrowser/formats/mobi"
 	_ "github.com/sblinch/BookBrowser/formats/pdf"
+	"github.com/sblinch/BookBrowser/indexer"
 	"github.com/sblinch/BookBrowser/server"
 	"github.com/sblinch/BookBrowser/util"
 	"github.com/sblinch/BookBrowser/util/sigusr"
@@ -38,10 +42,23 @@ func main() {
 		defdatadir = filepath.Join(workdir, "_temp")
 	}
 
-	bookdir := pflag.StringP("bookdir", "b", workdir, "the directory to load books from (must exist)")
+	bookdirs := pflag.StringArrayP("bookdir", "b", []string{workdir}, "a directory to load books from, optionally as LABEL=DIR (must exist; can be specified multiple times)")
 	datadir := pflag.StringP("datadir", "t", defdatadir, "the directory to store the database and cover thumbnails")
 	addr := pflag.StringP("addr", "a", ":8090", "the address to bind the server to ([IP]:PORT)")
 	nocovers := pflag.BoolP("nocovers", "n", false, "do not index covers")
+	watch := pflag.BoolP("watch", "w", false, "watch the book directory for changes and index them automatically")
+	converter := pflag.String("converter", "ebook-convert", "the Calibre ebook-convert command used to convert EPUBs to MOBI and AZW3")
+	cachesize := pflag.Int64("cachesize", 1024, "the maximum size in MB of the cache of converted books (0 for unlimited)")
+	pregenkepub := pflag.Bool("pregenkepub", false, "convert EPUBs to KEPUB while indexing, instead of on their first download")
+	auth := pflag.Bool("auth", false, "require users to sign in (an admin user is created on the first start)")
+	proxyheader := pflag.String("proxyheader", "", "trust this header (such as X-Forwarded-User) from --trustedproxy to identify users, creating them as needed (implies --auth)")
+	trustedproxies := pflag.StringArray("trustedproxy", nil, "the IP address or CIDR range of a reverse proxy trusted to set --proxyheader, X-Forwarded-Proto and X-Forwarded-Host (can be specified multiple times)")
+	baseurl := pflag.String("baseurl", "", "the URL that clients reach the server at (such as https://books.example.com), for links which must be absolute (default: taken from each request)")
+	embedmetadata := pflag.Bool("embedmetadata", false, "embed the indexed metadata (including edits) into downloaded EPUBs and their conversions, leaving the original files unchanged")
+	uploadpath := pflag.String("uploadpath", server.DefaultUploadPath, "the template for the pathnames of uploaded books within their library, using .Title, .Author, .Series, .SeriesIndex, .Publisher, .ISBN and .Year (the extension is added)")
+	allowwrite := pflag.Bool("allowwrite", false, "allow metadata to be written into books' files from the web interface and API without --auth (with it, admins always may)")
+	allowupload := pflag.Bool("allowupload", false, "allow books to be uploaded from the web interface and API without --auth (with it, admins always may)")
+	writemetadata := pflag.Bool("writemetadata", false, "index the books, write the indexed metadata (including edits) into EPUBs whose metadata differs, then exit")
 	help := pflag.BoolP("help", "h", false, "Show this help text")
 	sversion := pflag.Bool("version", false, "Show the version")
 	pflag.Parse()
@@ -65,10 +82,25 @@ func main() {
 
 	log.Printf("BookBrowser %s\n", curversion)
 
-	if _, err := os.Stat(*bookdir); err != nil {
-		if os.IsNotExist(err) {
-			log.Fatalf("Error: book directory %s does not exist\n", *bookdir)
+	libraries := make([]server.Library, len(*bookdirs))
+	labels := make(map[string]bool, len(*bookdirs))
+	for n, bookdir := range *bookdirs {
+		l := server.ParseLibrary(bookdir)
+		if labels[l.Label] {
+			log.Fatalf("Error: more than one book directory is labelled %s; specify them as LABEL=DIR with distinct labels\n", l.Label)
 		}
+		labels[l.Label] = true
+		if _, err := os.Stat(l.Path); err != nil {
+			if os.IsNotExist(err) {
+				log.Fatalf("Error: book directory %s does not exist\n", l.Path)
+			}
+		}
+
+		l.Path, err = filepath.Abs(l.Path)
+		if err != nil {
+			log.Fatalf("Error: could not resolve book directory %s: %v\n", l.Path, err)
+		}
+		libraries[n] = l
 	}
 
 	if fi, err := os.Stat(*datadir); err == nil || (fi != nil && fi.IsDir()) {
@@ -78,11 +110,6 @@ func main() {
 		}
 	}
 
-	*bookdir, err = filepath.Abs(*bookdir)
-	if err != nil {
-		log.Fatalf("Error: could not resolve book directory %s: %v\n", *bookdir, err)
-	}
-
 	if _, err := os.Stat(*datadir); os.IsNotExist(err) {
 		os.Mkdir(*datadir, os.ModePerm)
 	}
@@ -97,10 +124,19 @@ func main() {
 		log.Fatalf("Error: could not prepare SQLite database in %s: %v\n", *datadir, err)
 	}
 
+	// the watcher started by --watch, which is closed on shutdown
+	var watcherMu sync.Mutex
+	var watcher *indexer.Watcher
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
+		watcherMu.Lock()
+		if watcher != nil {
+			watcher.Close()
+		}
+		watcherMu.Unlock()
 		if removeDataDir {
 			log.Println("Removing temporary data directory")
 			os.RemoveAll(*datadir)
@@ -123,7 +159,65 @@ func main() {
 	}
 
 	log.Printf("Server")
-	s := server.NewServer(*addr, stor, *bookdir, *datadir, curversion, true, *nocovers)
+	s := server.NewServer(*addr, stor, libraries, *datadir, curversion, true, *nocovers)
+	s.Converted.MaxSize = *cachesize << 20
+	s.Indexer.PregenerateKepub = *pregenkepub
+	s.EmbedMetadata = *embedmetadata
+	s.AllowWrite = *allowwrite
+	s.AllowUpload = *allowupload
+	if err := s.SetUploadPath(*uploadpath); err != nil {
+		log.Fatalf("Error: invalid upload path template: %s\n", err)
+	}
+	if s.Converter, err = exec.LookPath(*converter); err != nil {
+		s.Converter = ""
+		log.Printf("MOBI and AZW3 conversion is unavailable: %v\n", err)
+	}
+	if *writemetadata {
+		if err := s.RefreshBookIndex(); err != nil {
+			log.Fatalf("Error indexing books: %s\n", err)
+		}
+		written, errs, err := s.Indexer.WriteAllMetadata()
+		for _, err := range errs {
+			log.Printf("Error: %s\n", err)
+		}
+		if err != nil {
+			log.Fatalf("Error writing metadata: %s\n", err)
+		}
+		log.Printf("Wrote metadata to %d books\n", written)
+		if removeDataDir {
+			os.RemoveAll(*datadir)
+		}
+		os.Exit(0)
+	}
+	if *auth || *proxyheader != "" {
+		if err := s.EnableAuth(); err != nil {
+			log.Fatalf("Error enabling authentication: %s\n", err)
+		}
+	}
+	if *proxyheader != "" {
+		if err := s.EnableProxyAuth(*proxyheader, *trustedproxies); err != nil {
+			log.Fatalf("Error enabling reverse proxy authentication: %s\n", err)
+		}
+	} else if len(*trustedproxies) > 0 {
+		if err := s.SetTrustedProxies(*trustedproxies); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+	}
+	if *baseurl != "" {
+		if u, err := url.Parse(*baseurl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Error: invalid base URL %s\n", *baseurl)
+		}
+		s.BaseURL = *baseurl
+	}
+	if *watch {
+		w, err := s.Indexer.Watch(2 * time.Second)
+		if err != nil {
+			log.Printf("Error: could not watch book directory for changes: %v\n", err)
+		}
+		watcherMu.Lock()
+		watcher = w
+		watcherMu.Unlock()
+	}
 	go func() {
 		s.RefreshBookIndex()
 		total, err := stor.Books.Count(storage.NewQuery())
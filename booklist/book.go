@@ -12,6 +12,8 @@ type Book struct {
 	FilePath string
 	FileSize int64
 	ModTime  time.Time
+	// KOReader's partial MD5 digest of the file, which identifies the book when syncing reading progress
+	PartialMD5 string
 
 	HasCover    bool
 	Title       string
@@ -28,6 +30,56 @@ type Book struct {
 	Author    *Author
 	Series    *Series
 	Publisher *Publisher
+
+	// everyone who contributed to the book (including Author), in the order they're listed in the book
+	Contributors []*Contributor
+
+	// subjects or genres, in the order they're listed in the book
+	Tags []*Tag
+}
+
+// AddContributor adds a contributor to the book, unless they're already listed in that role. The first author added
+// (or, if there are no authors, the first contributor) becomes the book's Author.
+func (b *Book) AddContributor(name, role string) {
+	name = strings.TrimSpace(name)
+	if name == "" || role == "" {
+		return
+	}
+	for _, c := range b.Contributors {
+		if c.Role == role && strings.EqualFold(c.Author.Name, name) {
+			return
+		}
+	}
+
+	c := &Contributor{Author: &Author{Name: name}, Role: role}
+	b.Contributors = append(b.Contributors, c)
+	if b.Author == nil || (role == RoleAuthor && !b.hasAuthor()) {
+		b.Author = c.Author
+	}
+}
+
+// AddTag adds a tag to the book, unless it already has a tag with the same name.
+func (b *Book) AddTag(name string) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return
+	}
+	for _, t := range b.Tags {
+		if strings.EqualFold(t.Name, name) {
+			return
+		}
+	}
+	b.Tags = append(b.Tags, &Tag{Name: name})
+}
+
+// hasAuthor reports whether the book's Author is one of its contributors in the author role.
+func (b *Book) hasAuthor() bool {
+	for _, c := range b.Contributors {
+		if c.Role == RoleAuthor && c.Author == b.Author {
+			return true
+		}
+	}
+	return false
 }
 
 func (b *Book) FileType() string {
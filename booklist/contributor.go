@@ -0,0 +1,40 @@
+package booklist
+
+import "strings"
+
+// Roles in which a person may contribute to a book.
+const (
+	RoleAuthor      = "author"
+	RoleEditor      = "editor"
+	RoleTranslator  = "translator"
+	RoleIllustrator = "illustrator"
+)
+
+// relatorRoles maps MARC relator codes (as used by opf:role and EPUB3 role refinements) to roles.
+var relatorRoles = map[string]string{
+	"aut": RoleAuthor,
+	"edt": RoleEditor,
+	"trl": RoleTranslator,
+	"ill": RoleIllustrator,
+}
+
+// Contributor is a person who contributed to a book in a particular role.
+type Contributor struct {
+	Author *Author
+	Role   string
+}
+
+// ParseRole converts a MARC relator code or role name into a role, or returns an empty string if the role is not
+// one of those supported.
+func ParseRole(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if role, ok := relatorRoles[s]; ok {
+		return role
+	}
+	for _, role := range relatorRoles {
+		if s == role {
+			return role
+		}
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package booklist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Book metadata fields which may be edited, overriding the metadata read from the book's file.
+const (
+	FieldTitle       = "title"
+	FieldAuthors     = "authors"
+	FieldSeries      = "series"
+	FieldSeriesIndex = "seriesindex"
+	FieldPublisher   = "publisher"
+	FieldDescription = "description"
+	FieldISBN        = "isbn"
+	FieldPublishDate = "publishdate"
+	FieldCover       = "cover"
+)
+
+// EditableFields lists the fields that may be overridden, in the order they're shown in the editor.
+var EditableFields = []string{FieldTitle, FieldAuthors, FieldSeries, FieldSeriesIndex, FieldPublisher, FieldDescription, FieldISBN, FieldPublishDate, FieldCover}
+
+// the format of overridden publish dates
+const publishDateFormat = "2006-01-02"
+
+// Override is a manual edit to one field of a book's metadata. Overrides are applied whenever the book is reindexed,
+// so that they take precedence over the metadata in the book's file.
+type Override struct {
+	BookID int
+	Field  string
+	// the field's value as returned by Book.FieldValue; for covers, the pathname of the cover image relative to the
+	// data directory
+	Value   string
+	UserID  int
+	Updated time.Time
+}
+
+// IsEditableField reports whether field is one of the EditableFields.
+func IsEditableField(field string) bool {
+	for _, f := range EditableFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Authors returns the names of the book's contributors in the author role, or of its Author if it has no
+// contributors.
+func (b *Book) Authors() []string {
+	names := []string{}
+	for _, c := range b.Contributors {
+		if c.Role == RoleAuthor && c.Author != nil {
+			names = append(names, c.Author.Name)
+		}
+	}
+	if len(b.Contributors) == 0 && b.Author != nil && b.Author.Name != "" {
+		names = append(names, b.Author.Name)
+	}
+	return names
+}
+
+// FieldValue returns the value of one of the book's editable fields as a string. Authors are separated by newlines.
+// Covers have no value.
+func (b *Book) FieldValue(field string) string {
+	switch field {
+	case FieldTitle:
+		return b.Title
+	case FieldAuthors:
+		return strings.Join(b.Authors(), "\n")
+	case FieldSeries:
+		if b.Series != nil {
+			return b.Series.Name
+		}
+	case FieldSeriesIndex:
+		if b.SeriesIndex != 0 {
+			return strconv.FormatFloat(b.SeriesIndex, 'f', -1, 64)
+		}
+	case FieldPublisher:
+		if b.Publisher != nil {
+			return b.Publisher.Name
+		}
+	case FieldDescription:
+		return b.Description
+	case FieldISBN:
+		return b.ISBN
+	case FieldPublishDate:
+		if !b.PublishDate.IsZero() {
+			return b.PublishDate.Format(publishDateFormat)
+		}
+	}
+	return ""
+}
+
+// SetField sets one of the book's editable fields from a string in the format returned by FieldValue, returning an
+// error if the value is invalid. Authors replace the book's existing authors, but not its other contributors; an
+// empty series or publisher removes the book from its series or publisher. Setting the cover only records that the
+// book has one, as cover images are stored separately.
+func (b *Book) SetField(field, value string) error {
+	value = strings.TrimSpace(strings.Replace(value, "\r\n", "\n", -1))
+	switch field {
+	case FieldTitle:
+		b.Title = value
+	case FieldAuthors:
+		b.setAuthors(strings.Split(value, "\n"))
+	case FieldSeries:
+		b.SeriesID = 0
+		b.Series = nil
+		if value != "" {
+			b.Series = &Series{Name: value}
+		}
+	case FieldSeriesIndex:
+		index := 0.0
+		if value != "" {
+			var err error
+			if index, err = strconv.ParseFloat(value, 64); err != nil || index < 0 {
+				return fmt.Errorf("invalid series index %q", value)
+			}
+		}
+		b.SeriesIndex = index
+	case FieldPublisher:
+		b.PublisherID = 0
+		b.Publisher = nil
+		if value != "" {
+			b.Publisher = &Publisher{Name: value}
+		}
+	case FieldDescription:
+		b.Description = value
+	case FieldISBN:
+		b.ISBN = value
+	case FieldPublishDate:
+		date := time.Time{}
+		if value != "" {
+			var err error
+			if date, err = time.Parse(publishDateFormat, value); err != nil {
+				return fmt.Errorf("invalid publish date %q; expected YYYY-MM-DD", value)
+			}
+		}
+		b.PublishDate = date
+	case FieldCover:
+		b.HasCover = true
+	default:
+		return fmt.Errorf("field %q cannot be edited", field)
+	}
+	return nil
+}
+
+// setAuthors replaces the book's authors, keeping its other contributors after them.
+func (b *Book) setAuthors(names []string) {
+	others := make([]*Contributor, 0, len(b.Contributors))
+	for _, c := range b.Contributors {
+		if c.Role != RoleAuthor {
+			others = append(others, c)
+		}
+	}
+
+	b.Contributors = nil
+	b.Author = nil
+	b.AuthorID = 0
+	for _, name := range names {
+		b.AddContributor(name, RoleAuthor)
+	}
+	for _, c := range others {
+		b.AddContributor(c.Author.Name, c.Role)
+	}
+}
+
+// ApplyOverrides sets the book's fields to the overridden values. Invalid values are ignored.
+func (b *Book) ApplyOverrides(overrides []*Override) {
+	for _, o := range overrides {
+		b.SetField(o.Field, o.Value)
+	}
+}
@@ -0,0 +1,44 @@
+package booklist
+
+import "time"
+
+// Position is how far a user has read through a book in one of the built-in readers.
+type Position struct {
+	BookID int
+	// an EPUB CFI or PDF page number, as reported by the reader
+	Position string
+	// how much of the book has been read, from 0 to 1
+	Percentage float64
+	Updated    time.Time
+	// the KOReader device the position was synced from, or empty if it was saved by one of the built-in readers
+	Device string
+}
+
+// SyncProgress is how far a user has read through a document in KOReader, as synced with its progress sync (kosync)
+// protocol.
+type SyncProgress struct {
+	// KOReader's digest of the document; see Book.PartialMD5
+	Document string
+	// an XPointer or page number, as reported by KOReader
+	Progress string
+	// how much of the document has been read, from 0 to 1
+	Percentage float64
+	Device     string
+	DeviceID   string
+	Updated    time.Time
+}
+
+// KoboReadingState is a user's reading state for a book as synced with their Kobo e-reader.
+type KoboReadingState struct {
+	BookID        int
+	Status        ReadStatus
+	StatusUpdated time.Time
+	// the Kobo's bookmark, which is a location such as a KEPUB span ID within a source file of the book
+	Location       string
+	LocationType   string
+	LocationSource string
+	// how much of the book has been read, from 0 to 1
+	Percentage float64
+	// when the bookmark was last updated, or zero if the Kobo hasn't reported one
+	Updated time.Time
+}
@@ -0,0 +1,63 @@
+package booklist
+
+// ReadStatus is how far a user has got with reading a book.
+type ReadStatus int
+
+const (
+	StatusNone ReadStatus = iota
+	StatusToRead
+	StatusReading
+	StatusFinished
+)
+
+// ReadStatuses lists the statuses a user can give a book, in the order they're usually shown.
+var ReadStatuses = []ReadStatus{StatusToRead, StatusReading, StatusFinished}
+
+var readStatusNames = map[ReadStatus]string{
+	StatusToRead:   "to-read",
+	StatusReading:  "reading",
+	StatusFinished: "finished",
+}
+
+var readStatusLabels = map[ReadStatus]string{
+	StatusToRead:   "To Read",
+	StatusReading:  "Reading",
+	StatusFinished: "Finished",
+}
+
+// String returns the status's name as used in URLs, or an empty string for StatusNone.
+func (s ReadStatus) String() string {
+	return readStatusNames[s]
+}
+
+// Label returns the status's name as shown to users.
+func (s ReadStatus) Label() string {
+	return readStatusLabels[s]
+}
+
+// ParseReadStatus returns the status with the given name, or StatusNone if the name is unknown.
+func ParseReadStatus(name string) ReadStatus {
+	for status, n := range readStatusNames {
+		if n == name {
+			return status
+		}
+	}
+	return StatusNone
+}
+
+// Shelf is a named collection of books kept by a user.
+type Shelf struct {
+	ID     int
+	UserID int
+	Name   string
+	// whether the shelf's books are synced to the user's Kobo e-reader
+	Kobo bool
+}
+
+// BookState is a user's own information about a book.
+type BookState struct {
+	Status    ReadStatus
+	Favourite bool
+	// the IDs of the user's shelves which the book is on
+	ShelfIDs map[int]bool
+}
@@ -0,0 +1,7 @@
+package booklist
+
+// Tag is a subject or genre that books are classified under.
+type Tag struct {
+	Name string
+	ID   int
+}
@@ -0,0 +1,62 @@
+package booklist
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is someone who may sign in to BookBrowser.
+type User struct {
+	ID       int
+	Username string
+	Admin    bool
+
+	// bcrypt hash of the user's password
+	PasswordHash string
+	// SHA-256 hash of the user's API token, or empty if the user has no token
+	TokenHash string
+	// bcrypt hash of the user's sync key (see SyncKey), or empty if it hasn't been set since the user last changed
+	// their password
+	SyncKeyHash string
+}
+
+// SyncKey returns the key KOReader sends in place of password when syncing reading progress, which is the hex-encoded
+// MD5 hash of the password.
+func SyncKey(password string) string {
+	sum := md5.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetPassword hashes and sets the user's password and sync key.
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return u.SetSyncKey(password)
+}
+
+// SetSyncKey hashes and sets the user's sync key from their password, for users whose password was set before sync
+// keys were introduced.
+func (u *User) SetSyncKey(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(SyncKey(password)), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.SyncKeyHash = string(hash)
+	return nil
+}
+
+// CheckPassword reports whether password is the user's password.
+func (u *User) CheckPassword(password string) bool {
+	return u.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// CheckSyncKey reports whether key is the user's sync key.
+func (u *User) CheckSyncKey(key string) bool {
+	return u.SyncKeyHash != "" && bcrypt.CompareHashAndPassword([]byte(u.SyncKeyHash), []byte(strings.ToLower(key))) == nil
+}
@@ -0,0 +1,186 @@
+package converter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache is an on-disk cache of converted books, keyed by the book's content hash and the format it was converted to.
+// Once the cache grows beyond MaxSize, the least recently used copies are removed.
+type Cache struct {
+	// the maximum total size of the cached copies in bytes, or 0 for no limit
+	MaxSize int64
+
+	dir string
+
+	mu       sync.Mutex
+	inflight map[string]*conversion
+}
+
+// A conversion is a book that's being converted, which other requests for the same copy wait for.
+type conversion struct {
+	done chan struct{}
+	err  error
+}
+
+// NewCache creates a cache of converted books in dir, which is created if needed.
+func NewCache(dir string) *Cache {
+	return &Cache{
+		dir:      dir,
+		inflight: make(map[string]*conversion),
+	}
+}
+
+// path returns the pathname of the cached copy of the book with the specified hash in the specified format.
+func (c *Cache) path(hash, format string) string {
+	return filepath.Join(c.dir, hash+"."+format)
+}
+
+// Open opens the cached copy of the book at src, which has the specified content hash, in the specified format. If
+// the book hasn't already been converted to that format, it's converted using convert.
+func (c *Cache) Open(src, hash, format string, convert Func) (*os.File, error) {
+	pathname := c.path(hash, format)
+
+	for {
+		c.mu.Lock()
+		// the copy is opened while locked so that it can't be evicted between checking for it and opening it
+		if f, err := os.Open(pathname); err == nil {
+			now := time.Now()
+			os.Chtimes(pathname, now, now)
+			c.mu.Unlock()
+			return f, nil
+		}
+
+		conv, exists := c.inflight[pathname]
+		if !exists {
+			conv = &conversion{done: make(chan struct{})}
+			c.inflight[pathname] = conv
+			c.mu.Unlock()
+
+			conv.err = c.convert(src, pathname, format, convert)
+
+			c.mu.Lock()
+			delete(c.inflight, pathname)
+			if conv.err == nil {
+				c.evict(pathname)
+			}
+			c.mu.Unlock()
+			close(conv.done)
+
+			if conv.err != nil {
+				return nil, conv.err
+			}
+			continue
+		}
+		c.mu.Unlock()
+
+		<-conv.done
+		if conv.err != nil {
+			return nil, conv.err
+		}
+	}
+}
+
+// convert converts src into pathname.
+func (c *Cache) convert(src, pathname, format string, convert Func) error {
+	if err := os.MkdirAll(c.dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// convert into a temporary directory so that an interrupted conversion is never mistaken for a cached copy
+	td, err := ioutil.TempDir(c.dir, "convert")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(td)
+	// some converters choose the output format from the extension, so give them the real one
+	tmp := filepath.Join(td, "book."+format)
+
+	if err = convert(src, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pathname)
+}
+
+// cachedFile is a cached copy found while scanning the cache.
+type cachedFile struct {
+	pathname string
+	size     int64
+	used     time.Time
+}
+
+// scan returns all of the cached copies.
+func (c *Cache) scan() []cachedFile {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil
+	}
+
+	files := make([]cachedFile, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, cachedFile{pathname: filepath.Join(c.dir, info.Name()), size: info.Size(), used: info.ModTime()})
+	}
+	return files
+}
+
+// evict removes the least recently used copies until the cache is no larger than MaxSize. The copy at keep is never
+// removed. The caller must hold c.mu.
+func (c *Cache) evict(keep string) {
+	if c.MaxSize <= 0 {
+		return
+	}
+
+	files := c.scan()
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	if total <= c.MaxSize {
+		return
+	}
+
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].used.Before(files[b].used)
+	})
+	for _, f := range files {
+		if total <= c.MaxSize {
+			break
+		}
+		if f.pathname == keep {
+			continue
+		}
+		if err := os.Remove(f.pathname); err == nil {
+			total -= f.size
+		}
+	}
+}
+
+// Prune removes the cached copies of books whose content hashes are not in hashes, such as books that have been
+// modified or removed.
+func (c *Cache) Prune(hashes map[string]struct{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range c.scan() {
+		name := filepath.Base(f.pathname)
+		hash := name
+		if n := strings.IndexByte(name, '.'); n >= 0 {
+			hash = name[:n]
+		}
+		if _, exists := hashes[hash]; exists {
+			continue
+		}
+		if err := os.Remove(f.pathname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
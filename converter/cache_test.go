@@ -0,0 +1,149 @@
+package converter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyFunc returns a Func which copies the book and counts the conversions.
+func copyFunc(count *int32) Func {
+	return func(src, dst string) error {
+		atomic.AddInt32(count, 1)
+		buf, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dst, buf, 0644)
+	}
+}
+
+func TestCacheOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "book.epub")
+	require.NoError(t, ioutil.WriteFile(src, []byte("book"), 0644))
+
+	c := NewCache(filepath.Join(dir, "converted"))
+	var count int32
+
+	// concurrent requests for the same copy only convert it once
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := c.Open(src, "abc", "mobi", copyFunc(&count))
+			if assert.NoError(t, err) {
+				buf, _ := ioutil.ReadAll(f)
+				f.Close()
+				assert.Equal(t, "book", string(buf))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), count)
+
+	_, err = c.Open(src, "abc", "azw3", copyFunc(&count))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), count)
+
+	require.NoError(t, c.Prune(map[string]struct{}{"def": {}}))
+	_, err = os.Stat(c.path("abc", "mobi"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCacheOpenConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "book.epub")
+	require.NoError(t, ioutil.WriteFile(src, []byte("book"), 0644))
+
+	c := NewCache(filepath.Join(dir, "converted"))
+	var count int32
+
+	// a slow conversion of one book doesn't hold up converting another, or the same book to another format
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := func(src, dst string) error {
+		close(started)
+		<-release
+		return copyFunc(&count)(src, dst)
+	}
+	errs := make(chan error)
+	go func() {
+		f, err := c.Open(src, "a", "mobi", slow)
+		if err == nil {
+			f.Close()
+		}
+		errs <- err
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() {
+		for _, key := range [][2]string{{"b", "mobi"}, {"a", "azw3"}} {
+			f, err := c.Open(src, key[0], key[1], copyFunc(&count))
+			if err != nil {
+				done <- err
+				return
+			}
+			f.Close()
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("conversions waited for an unrelated conversion")
+	}
+
+	close(release)
+	assert.NoError(t, <-errs)
+	assert.Equal(t, int32(3), count)
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "book.epub")
+	require.NoError(t, ioutil.WriteFile(src, []byte("0123456789"), 0644))
+
+	c := NewCache(filepath.Join(dir, "converted"))
+	c.MaxSize = 25
+	var count int32
+
+	for _, hash := range []string{"a", "b"} {
+		f, err := c.Open(src, hash, "mobi", copyFunc(&count))
+		require.NoError(t, err)
+		f.Close()
+	}
+	// make "a" the least recently used
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(c.path("a", "mobi"), old, old))
+
+	f, err := c.Open(src, "c", "mobi", copyFunc(&count))
+	require.NoError(t, err)
+	f.Close()
+
+	_, err = os.Stat(c.path("a", "mobi"))
+	assert.True(t, os.IsNotExist(err))
+	for _, hash := range []string{"b", "c"} {
+		_, err = os.Stat(c.path(hash, "mobi"))
+		assert.NoError(t, err)
+	}
+}
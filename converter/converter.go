@@ -0,0 +1,65 @@
+// Package converter converts books to other formats, and caches the converted copies on disk.
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+
+	"github.com/geek1011/kepubify/kepub"
+)
+
+// Func converts the book at src into a new file at dst.
+type Func func(src, dst string) error
+
+// KepubFormat is the cache format of Kobo EPUBs. It includes the kepubify version, so that books are reconverted
+// rather than served from the cache when kepubify is upgraded.
+var KepubFormat = "kepub-" + moduleVersion("github.com/geek1011/kepubify") + ".epub"
+
+// Kepub converts an EPUB into a Kobo EPUB.
+func Kepub(src, dst string) error {
+	return (&kepub.Converter{}).Convert(src, dst)
+}
+
+// EbookConvert returns a Func which converts books using command, which must be Calibre's ebook-convert or
+// compatible. The output format is chosen from dst's extension.
+func EbookConvert(command string) Func {
+	return func(src, dst string) error {
+		out, err := exec.Command(command, src, dst).CombinedOutput()
+		if err != nil {
+			// the last line of output is generally the most useful
+			out = bytes.TrimSpace(out)
+			if n := bytes.LastIndexByte(out, '\n'); n >= 0 {
+				out = out[n+1:]
+			}
+			return fmt.Errorf("%s: %v: %s", filepath.Base(command), err, out)
+		}
+		return nil
+	}
+}
+
+// moduleVersion returns the version of the specified module that was built into the binary, in a form suitable for
+// use in a filename.
+func moduleVersion(path string) string {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				version = dep.Version
+				if dep.Replace != nil {
+					version = dep.Replace.Version
+				}
+				break
+			}
+		}
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '.' {
+			return '_'
+		}
+		return r
+	}, version)
+}
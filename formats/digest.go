@@ -0,0 +1,37 @@
+package formats
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PartialMD5 returns KOReader's digest of a book file, which it uses to identify documents when syncing reading
+// progress. Rather than hashing the whole file, KOReader hashes up to 1KiB at each of the offsets 0 and 1KiB << 2n for
+// n from 0 to 10, stopping at the end of the file.
+func PartialMD5(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	buf := make([]byte, 1024)
+	for i := -1; i <= 10; i++ {
+		var offset int64
+		if i >= 0 {
+			offset = 1024 << uint(2*i)
+		}
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 {
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			break
+		}
+		h.Write(buf[:n])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,43 @@
+package formats
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartialMD5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	filename := filepath.Join(dir, "book.epub")
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+
+	// samples at 0, 1KiB, 4KiB and 16KiB, the last of which is cut short by the end of the file
+	var sampled []byte
+	for _, offset := range []int{0, 1024, 4096, 16384} {
+		end := offset + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		sampled = append(sampled, data[offset:end]...)
+	}
+
+	digest, err := PartialMD5(filename)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(sampled)), digest)
+
+	_, err = PartialMD5(filepath.Join(dir, "missing.epub"))
+	assert.Error(t, err)
+}
@@ -115,25 +115,9 @@ func load(filename string) (formats.BookInfo, error) {
 
 	zfs := zipfs.New(zr, "epub")
 
-	rsk, err := zfs.Open("/META-INF/container.xml")
+	rootfile, err := findRootfile(zfs)
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading container.xml")
-	}
-	defer rsk.Close()
-
-	container := etree.NewDocument()
-	_, err = container.ReadFrom(rsk)
-	if err != nil {
-		return nil, errors.Wrap(err, "error parsing container.xml")
-	}
-
-	rootfile := ""
-	for _, e := range container.FindElements("//rootfiles/rootfile[@full-path]") {
-		rootfile = e.SelectAttrValue("full-path", "")
-	}
-
-	if rootfile == "" {
-		return nil, errors.Wrap(err, "could not find rootfile in container.xml")
+		return nil, err
 	}
 
 	opfdir := filepath.Dir(rootfile)
@@ -156,10 +140,16 @@ func load(filename string) (formats.BookInfo, error) {
 		break
 	}
 	for _, el := range opf.FindElements("//creator") {
-		e.book.Author = &booklist.Author{
-			Name: el.Text(),
+		e.book.AddContributor(el.Text(), contributorRole(opf, el, booklist.RoleAuthor))
+	}
+	for _, el := range opf.FindElements("//contributor") {
+		e.book.AddContributor(el.Text(), contributorRole(opf, el, ""))
+	}
+	if e.book.Author == nil {
+		// none of the creators have a supported role, so fall back to the first creator
+		if el := opf.FindElement("//creator"); el != nil {
+			e.book.AddContributor(el.Text(), booklist.RoleAuthor)
 		}
-		break
 	}
 	for _, el := range opf.FindElements("//publisher") {
 		e.book.Publisher = &booklist.Publisher{
@@ -167,6 +157,9 @@ func load(filename string) (formats.BookInfo, error) {
 		}
 		break
 	}
+	for _, el := range opf.FindElements("//subject") {
+		e.book.AddTag(el.Text())
+	}
 	for _, el := range opf.FindElements("//description") {
 		e.book.Description = el.Text()
 		break
@@ -260,8 +253,29 @@ findISBN:
 	return e, nil
 }
 
+// contributorRole returns the role of a creator or contributor element, from either its opf:role attribute (EPUB2) or
+// a role refinement (EPUB3). Returns defaultRole if no role is specified, or an empty string if the role is not
+// supported.
+func contributorRole(opf *etree.Document, el *etree.Element, defaultRole string) string {
+	role := el.SelectAttrValue("opf:role", el.SelectAttrValue("role", ""))
+	if id := el.SelectAttrValue("id", ""); role == "" && id != "" {
+		for _, meta := range opf.FindElements("//meta[@refines='#" + id + "']") {
+			if meta.SelectAttrValue("property", "") == "role" {
+				role = meta.Text()
+				break
+			}
+		}
+	}
+
+	if role == "" {
+		return defaultRole
+	}
+	return booklist.ParseRole(role)
+}
+
 func init() {
 	formats.Register("epub", load)
+	formats.RegisterWriter("epub", Write)
 }
 
 func parsePublishDate(s string) time.Time {
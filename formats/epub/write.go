@@ -0,0 +1,545 @@
+package epub
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+
+	"github.com/beevik/etree"
+	"github.com/moraes/isbn"
+	"github.com/pkg/errors"
+	"golang.org/x/tools/godoc/vfs"
+	"golang.org/x/tools/godoc/vfs/zipfs"
+)
+
+// the ID and pathname (relative to the OPF) of a cover image added to an EPUB whose cover isn't a JPEG
+const (
+	writtenCoverID   = "bookbrowser-cover"
+	writtenCoverHref = "bookbrowser-cover.jpg"
+)
+
+// Write copies the EPUB at src to dst, replacing the metadata in its OPF with the book's title, authors, series,
+// publisher, description, ISBN and publish date. Contributors in other roles and any other metadata are kept, as is
+// the package's unique identifier. An unset publish date leaves the OPF's dates unchanged, since books whose dates
+// couldn't be parsed have none. If cover is not nil, the JPEG image read from it replaces the book's cover.
+//
+// dst is written to a temporary file which is then renamed into place, so that it is replaced atomically; src and dst
+// may be the same file.
+func Write(src, dst string, book *booklist.Book, cover io.Reader) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrap(err, "could not stat book")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".bookbrowser-*.epub")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(src, tmp, book, cover)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), fi.Mode()); err != nil {
+		return errors.Wrap(err, "could not set file mode")
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return errors.Wrap(err, "could not replace book")
+	}
+	return nil
+}
+
+// write writes a copy of the EPUB at src with its metadata replaced to w.
+func write(src string, w io.Writer, book *booklist.Book, cover io.Reader) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return errors.Wrap(err, "error opening epub as zip")
+	}
+	defer zr.Close()
+
+	rootfile, err := findRootfile(zipfs.New(zr, "epub"))
+	if err != nil {
+		return err
+	}
+
+	opf := etree.NewDocument()
+	var rootEntry *zip.File
+	for _, f := range zr.File {
+		if f.Name == rootfile {
+			rootEntry = f
+			break
+		}
+	}
+	if rootEntry == nil {
+		return errors.Errorf("could not find rootfile '%s'", rootfile)
+	}
+	rr, err := rootEntry.Open()
+	if err != nil {
+		return errors.Wrap(err, "error reading rootfile")
+	}
+	_, err = opf.ReadFrom(rr)
+	rr.Close()
+	if err != nil {
+		return errors.Wrap(err, "error parsing rootfile")
+	}
+
+	coverpath, err := setMetadata(opf, book, path.Dir(rootfile), cover != nil)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	coverWritten := false
+	for _, f := range zr.File {
+		switch f.Name {
+		case rootfile:
+			fw, err := zw.CreateHeader(copyHeader(f))
+			if err == nil {
+				_, err = opf.WriteTo(fw)
+			}
+			if err != nil {
+				return errors.Wrap(err, "error writing rootfile")
+			}
+		case coverpath:
+			if err := writeCover(zw, copyHeader(f), cover); err != nil {
+				return err
+			}
+			coverWritten = true
+		default:
+			if err := copyZipFile(zw, f); err != nil {
+				return errors.Wrapf(err, "error copying '%s'", f.Name)
+			}
+		}
+	}
+	if coverpath != "" && !coverWritten {
+		hdr := &zip.FileHeader{Name: coverpath, Method: zip.Deflate}
+		hdr.SetModTime(time.Now())
+		if err := writeCover(zw, hdr, cover); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// findRootfile returns the pathname of the OPF package document listed in an EPUB's container.xml.
+func findRootfile(zfs vfs.FileSystem) (string, error) {
+	rsk, err := zfs.Open("/META-INF/container.xml")
+	if err != nil {
+		return "", errors.Wrap(err, "error reading container.xml")
+	}
+	defer rsk.Close()
+
+	container := etree.NewDocument()
+	if _, err = container.ReadFrom(rsk); err != nil {
+		return "", errors.Wrap(err, "error parsing container.xml")
+	}
+
+	rootfile := ""
+	for _, e := range container.FindElements("//rootfiles/rootfile[@full-path]") {
+		rootfile = e.SelectAttrValue("full-path", "")
+	}
+	if rootfile == "" {
+		return "", errors.New("could not find rootfile in container.xml")
+	}
+	return rootfile, nil
+}
+
+// copyHeader returns a copy of a zip entry's header for writing a new entry with the same name, compression method
+// and modification time.
+func copyHeader(f *zip.File) *zip.FileHeader {
+	hdr := f.FileHeader
+	hdr.CompressedSize, hdr.CompressedSize64 = 0, 0
+	hdr.UncompressedSize, hdr.UncompressedSize64 = 0, 0
+	hdr.CRC32 = 0
+	return &hdr
+}
+
+// copyZipFile copies an entry from one zip file to another. Entries are copied in their original order with their
+// original compression method, which keeps the EPUB's uncompressed mimetype entry first.
+func copyZipFile(zw *zip.Writer, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fw, err := zw.CreateHeader(copyHeader(f))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// writeCover writes the cover image read from cover as a zip entry.
+func writeCover(zw *zip.Writer, hdr *zip.FileHeader, cover io.Reader) error {
+	fw, err := zw.CreateHeader(hdr)
+	if err == nil {
+		_, err = io.Copy(fw, cover)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error writing cover")
+	}
+	return nil
+}
+
+// opfWriter updates the metadata of an OPF package document.
+type opfWriter struct {
+	opf      *etree.Document
+	metadata *etree.Element
+	// whether the package is EPUB3, which records roles and series with refinements rather than attributes
+	epub3 bool
+	// the namespace prefix of the Dublin Core elements
+	dc string
+	// the ID of the package's unique identifier, which is never changed
+	uniqueID string
+}
+
+// setMetadata replaces the OPF's metadata with the book's, and returns the pathname of the cover image within the
+// EPUB (relative to its root) if cover is set.
+func setMetadata(opf *etree.Document, book *booklist.Book, opfdir string, cover bool) (string, error) {
+	pkg := opf.FindElement("//package")
+	metadata := opf.FindElement("//metadata")
+	if pkg == nil || metadata == nil {
+		return "", errors.New("could not find metadata in rootfile")
+	}
+
+	o := &opfWriter{
+		opf:      opf,
+		metadata: metadata,
+		epub3:    strings.HasPrefix(pkg.SelectAttrValue("version", ""), "3"),
+		dc:       "dc",
+		uniqueID: pkg.SelectAttrValue("unique-identifier", ""),
+	}
+	if title := metadata.SelectElement("title"); title != nil {
+		o.dc = title.Space
+	}
+
+	if title := metadata.SelectElement("title"); title == nil || title.Text() != book.Title {
+		// Calibre's title sort would no longer match the title
+		o.removeMeta("name", "calibre:title_sort")
+	}
+	if book.Title != "" {
+		o.setElement("title", book.Title)
+	}
+	o.setAuthors(book)
+	publisher := ""
+	if book.Publisher != nil {
+		publisher = book.Publisher.Name
+	}
+	o.setElement("publisher", publisher)
+	o.setElement("description", book.Description)
+	o.setISBN(book.ISBN)
+	o.setPublishDate(book.PublishDate)
+	o.setSeries(book)
+	o.setModified()
+
+	if !cover {
+		return "", nil
+	}
+	href, err := o.setCover(pkg)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(opfdir, href), nil
+}
+
+// createElement creates a Dublin Core element in the metadata, before ex if it is not nil.
+func (o *opfWriter) createElement(tag string, ex *etree.Element) *etree.Element {
+	if o.dc != "" {
+		tag = o.dc + ":" + tag
+	}
+	el := etree.NewElement(tag)
+	if ex != nil {
+		o.metadata.InsertChild(ex, el)
+	} else {
+		o.metadata.AddChild(el)
+	}
+	return el
+}
+
+// createMeta creates a meta element in the metadata.
+func (o *opfWriter) createMeta(attrs ...string) *etree.Element {
+	el := o.metadata.CreateElement("meta")
+	for n := 0; n+1 < len(attrs); n += 2 {
+		el.CreateAttr(attrs[n], attrs[n+1])
+	}
+	return el
+}
+
+// metas returns the meta elements whose attr attribute has the specified value.
+func (o *opfWriter) metas(attr, value string) []*etree.Element {
+	found := []*etree.Element{}
+	for _, el := range o.metadata.SelectElements("meta") {
+		if el.SelectAttrValue(attr, "") == value {
+			found = append(found, el)
+		}
+	}
+	return found
+}
+
+// removeMeta removes the meta elements whose attr attribute has the specified value.
+func (o *opfWriter) removeMeta(attr, value string) {
+	for _, el := range o.metas(attr, value) {
+		o.metadata.RemoveChild(el)
+	}
+}
+
+// remove removes an element along with any refinements of it.
+func (o *opfWriter) remove(el *etree.Element) {
+	if id := el.SelectAttrValue("id", ""); id != "" {
+		o.removeMeta("refines", "#"+id)
+	}
+	o.metadata.RemoveChild(el)
+}
+
+// setElement sets the text of the first Dublin Core element with the specified tag, creating it if necessary, or
+// removes all of them if value is empty.
+func (o *opfWriter) setElement(tag, value string) {
+	els := o.metadata.SelectElements(tag)
+	if value == "" {
+		for _, el := range els {
+			o.remove(el)
+		}
+		return
+	}
+	if len(els) == 0 {
+		els = append(els, o.createElement(tag, nil))
+	}
+	els[0].SetText(value)
+}
+
+// setAuthors replaces the creators in the author role with the book's authors, listed before any other creators and
+// contributors.
+func (o *opfWriter) setAuthors(book *booklist.Book) {
+	for _, el := range o.metadata.SelectElements("creator") {
+		if contributorRole(o.opf, el, booklist.RoleAuthor) == booklist.RoleAuthor {
+			o.remove(el)
+		}
+	}
+
+	var ex *etree.Element
+	for _, el := range o.metadata.ChildElements() {
+		if el.Tag == "creator" || el.Tag == "contributor" {
+			ex = el
+			break
+		}
+	}
+
+	authors := []*booklist.Author{}
+	for _, c := range book.Contributors {
+		if c.Role == booklist.RoleAuthor && c.Author != nil {
+			authors = append(authors, c.Author)
+		}
+	}
+	if len(book.Contributors) == 0 && book.Author != nil && book.Author.Name != "" {
+		authors = append(authors, book.Author)
+	}
+
+	for n, author := range authors {
+		el := o.createElement("creator", ex)
+		el.SetText(author.Name)
+		if o.epub3 {
+			id := fmt.Sprintf("bookbrowser-creator%d", n+1)
+			el.CreateAttr("id", id)
+			o.createMeta("refines", "#"+id, "property", "role", "scheme", "marc:relators").SetText("aut")
+			if author.SortName != "" {
+				o.createMeta("refines", "#"+id, "property", "file-as").SetText(author.SortName)
+			}
+		} else {
+			el.CreateAttr("opf:role", "aut")
+			if author.SortName != "" {
+				el.CreateAttr("opf:file-as", author.SortName)
+			}
+		}
+	}
+}
+
+// isISBN reports whether an identifier is an ISBN.
+func isISBN(el *etree.Element) bool {
+	if strings.EqualFold(el.SelectAttrValue("opf:scheme", el.SelectAttrValue("scheme", "")), "isbn") {
+		return true
+	}
+	val := strings.TrimPrefix(el.Text(), "urn:isbn:")
+	return len(val) >= 10 && isbn.Validate(val)
+}
+
+// setISBN replaces the ISBN identifiers with the book's ISBN. The package's unique identifier is left unchanged, even
+// if it's an ISBN.
+func (o *opfWriter) setISBN(value string) {
+	var first *etree.Element
+	for _, el := range o.metadata.SelectElements("identifier") {
+		if el.SelectAttrValue("id", "") == o.uniqueID || !isISBN(el) {
+			continue
+		}
+		if first == nil && value != "" {
+			first = el
+		} else {
+			o.remove(el)
+		}
+	}
+	if value == "" {
+		return
+	}
+
+	if first == nil {
+		first = o.createElement("identifier", nil)
+		if !o.epub3 {
+			first.CreateAttr("opf:scheme", "ISBN")
+		}
+	}
+	if o.epub3 || strings.HasPrefix(first.Text(), "urn:isbn:") {
+		value = "urn:isbn:" + value
+	}
+	first.SetText(value)
+}
+
+// setPublishDate sets the publication date, which is found in the same way as when the EPUB is loaded. Books whose
+// dates couldn't be parsed have no publish date, so an unset date leaves the OPF unchanged.
+func (o *opfWriter) setPublishDate(date time.Time) {
+	if date.IsZero() {
+		return
+	}
+
+	var found *etree.Element
+	for _, el := range o.metadata.SelectElements("date") {
+		event := el.SelectAttrValue("opf:event", "")
+		if event == "original-publication" || event == "published" || event == "publication" {
+			found = el
+			break
+		} else if event == "" && found == nil {
+			found = el
+		}
+	}
+	if found == nil {
+		found = o.createElement("date", nil)
+	}
+	found.SetText(date.Format("2006-01-02"))
+}
+
+// setSeries replaces the series in both Calibre's metadata and EPUB3 collections.
+func (o *opfWriter) setSeries(book *booklist.Book) {
+	o.removeMeta("name", "calibre:series")
+	o.removeMeta("name", "calibre:series_index")
+	for _, el := range o.metas("property", "belongs-to-collection") {
+		ctype := ""
+		if id := el.SelectAttrValue("id", ""); id != "" {
+			for _, ref := range o.metas("refines", "#"+id) {
+				if ref.SelectAttrValue("property", "") == "collection-type" {
+					ctype = strings.TrimSpace(ref.Text())
+				}
+			}
+		}
+		// other collections, such as sets, aren't series
+		if ctype == "" || ctype == "series" {
+			o.remove(el)
+		}
+	}
+
+	if book.Series == nil || book.Series.Name == "" {
+		return
+	}
+	index := strconv.FormatFloat(book.SeriesIndex, 'f', -1, 64)
+
+	o.createMeta("name", "calibre:series", "content", book.Series.Name)
+	o.createMeta("name", "calibre:series_index", "content", index)
+
+	o.createMeta("property", "belongs-to-collection", "id", "bookbrowser-series").SetText(book.Series.Name)
+	o.createMeta("refines", "#bookbrowser-series", "property", "collection-type").SetText("series")
+	if book.SeriesIndex != 0 {
+		o.createMeta("refines", "#bookbrowser-series", "property", "group-position").SetText(index)
+	}
+}
+
+// setModified updates the EPUB3 modification date.
+func (o *opfWriter) setModified() {
+	for _, el := range o.metas("property", "dcterms:modified") {
+		el.SetText(time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	}
+}
+
+// setCover returns the pathname (relative to the OPF) of the cover image to replace. If the existing cover is a JPEG,
+// it is replaced in place, so that any cover page still shows it; otherwise a new JPEG cover image is added to the
+// manifest.
+func (o *opfWriter) setCover(pkg *etree.Element) (string, error) {
+	manifest := pkg.SelectElement("manifest")
+	if manifest == nil {
+		return "", errors.New("could not find manifest in rootfile")
+	}
+
+	var item *etree.Element
+	coverMeta := o.metas("name", "cover")
+	if len(coverMeta) > 0 {
+		if id := coverMeta[0].SelectAttrValue("content", ""); id != "" {
+			item = manifest.FindElement("item[@id='" + id + "']")
+		}
+	}
+	if item == nil {
+		for _, el := range manifest.SelectElements("item") {
+			if strings.Contains(" "+el.SelectAttrValue("properties", "")+" ", " cover-image ") {
+				item = el
+				break
+			}
+		}
+	}
+
+	if item != nil && item.SelectAttrValue("media-type", "") == "image/jpeg" && item.SelectAttrValue("href", "") != "" {
+		// EPUB3 covers may only be identified by the cover-image property, which many readers don't recognize
+		if id := item.SelectAttrValue("id", ""); len(coverMeta) == 0 && id != "" {
+			o.createMeta("name", "cover", "content", id)
+		}
+		return item.SelectAttrValue("href", ""), nil
+	}
+
+	if item != nil {
+		if props := strings.Fields(item.SelectAttrValue("properties", "")); len(props) > 0 {
+			kept := []string{}
+			for _, p := range props {
+				if p != "cover-image" {
+					kept = append(kept, p)
+				}
+			}
+			if len(kept) > 0 {
+				item.CreateAttr("properties", strings.Join(kept, " "))
+			} else {
+				item.RemoveAttr("properties")
+			}
+		}
+	}
+	if el := manifest.FindElement("item[@id='" + writtenCoverID + "']"); el != nil {
+		manifest.RemoveChild(el)
+	}
+
+	item = manifest.CreateElement("item")
+	item.CreateAttr("id", writtenCoverID)
+	item.CreateAttr("href", writtenCoverHref)
+	item.CreateAttr("media-type", "image/jpeg")
+	if o.epub3 {
+		item.CreateAttr("properties", "cover-image")
+	}
+
+	if len(coverMeta) > 0 {
+		coverMeta[0].CreateAttr("content", writtenCoverID)
+	} else {
+		o.createMeta("name", "cover", "content", writtenCoverID)
+	}
+	return writtenCoverHref, nil
+}
@@ -0,0 +1,187 @@
+package epub
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEPUB2OPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>teh book</dc:title>
+    <dc:creator opf:role="aut">doe, jane</dc:creator>
+    <dc:creator opf:role="ill">Ian Illustrator</dc:creator>
+    <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+    <dc:date>2010</dc:date>
+    <meta name="calibre:series" content="Wrong Series"/>
+    <meta name="calibre:series_index" content="9"/>
+    <meta name="cover" content="cover-image"/>
+  </metadata>
+  <manifest>
+    <item id="cover-image" href="images/cover.png" media-type="image/png"/>
+    <item id="text" href="text.html" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="text"/></spine>
+</package>`
+
+const testEPUB3OPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>teh book</dc:title>
+    <dc:creator id="c1">doe, jane</dc:creator>
+    <meta refines="#c1" property="role" scheme="marc:relators">aut</meta>
+    <dc:contributor id="c2">Ian Illustrator</dc:contributor>
+    <meta refines="#c2" property="role" scheme="marc:relators">ill</meta>
+    <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+    <dc:identifier>urn:isbn:9780306406157</dc:identifier>
+    <meta property="belongs-to-collection" id="s1">Wrong Series</meta>
+    <meta refines="#s1" property="collection-type">series</meta>
+    <meta refines="#s1" property="group-position">9</meta>
+    <meta property="dcterms:modified">2000-01-01T00:00:00Z</meta>
+  </metadata>
+  <manifest>
+    <item id="cover" href="cover.jpg" media-type="image/jpeg" properties="cover-image"/>
+    <item id="text" href="text.html" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="text"/></spine>
+</package>`
+
+// writeTestEPUB creates an EPUB containing the specified OPF and a cover image.
+func writeTestEPUB(t *testing.T, filename, opf, cover string) {
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	require.NoError(t, err)
+	w.Write([]byte("application/epub+zip"))
+
+	files := map[string]string{
+		"META-INF/container.xml": `<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`,
+		"OEBPS/content.opf":      opf,
+		"OEBPS/" + cover:         "original cover",
+		"OEBPS/text.html":        "<html><body>Text</body></html>",
+	}
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(content))
+	}
+	require.NoError(t, zw.Close())
+}
+
+// readZipFile returns the contents of an entry in a zip file.
+func readZipFile(t *testing.T, filename, name string) string {
+	zr, err := zip.OpenReader(filename)
+	require.NoError(t, err)
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name == name {
+			r, err := f.Open()
+			require.NoError(t, err)
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			return string(b)
+		}
+	}
+	return ""
+}
+
+func testBook() *booklist.Book {
+	b := &booklist.Book{
+		Title:       "The Book",
+		Series:      &booklist.Series{Name: "Right Series"},
+		SeriesIndex: 2.5,
+		Publisher:   &booklist.Publisher{Name: "Publisher"},
+		Description: "A book.",
+		ISBN:        "9780140449136",
+		PublishDate: time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC),
+	}
+	b.AddContributor("Jane Doe", booklist.RoleAuthor)
+	b.Author.SortName = "Doe, Jane"
+	b.AddContributor("John Roe", booklist.RoleAuthor)
+	return b
+}
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-epub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name  string
+		opf   string
+		cover string
+		// where the new cover is written
+		newCover string
+	}{
+		{"epub2", testEPUB2OPF, "images/cover.png", "OEBPS/bookbrowser-cover.jpg"},
+		{"epub3", testEPUB3OPF, "cover.jpg", "OEBPS/cover.jpg"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := filepath.Join(dir, tc.name+".epub")
+			dst := filepath.Join(dir, tc.name+"-copy.epub")
+			writeTestEPUB(t, src, tc.opf, tc.cover)
+
+			require.NoError(t, Write(src, dst, testBook(), strings.NewReader("new cover")))
+			require.NoError(t, Write(src, src, testBook(), nil))
+
+			bi, err := load(dst)
+			require.NoError(t, err)
+			b := bi.Book()
+			assert.Equal(t, "The Book", b.Title)
+			assert.Equal(t, []string{"Jane Doe", "John Roe"}, b.Authors())
+			require.Len(t, b.Contributors, 3)
+			assert.Equal(t, booklist.RoleAuthor, b.Contributors[0].Role)
+			require.NotNil(t, b.Series)
+			assert.Equal(t, "Right Series", b.Series.Name)
+			assert.Equal(t, 2.5, b.SeriesIndex)
+			assert.Equal(t, "Publisher", b.Publisher.Name)
+			assert.Equal(t, "A book.", b.Description)
+			assert.Equal(t, "9780140449136", b.ISBN)
+			assert.Equal(t, "2001-02-03", b.PublishDate.Format("2006-01-02"))
+
+			assert.True(t, bi.HasCover())
+			cr, err := bi.GetCover()
+			require.NoError(t, err)
+			cover, err := ioutil.ReadAll(cr)
+			cr.Close()
+			require.NoError(t, err)
+			assert.Equal(t, "new cover", string(cover))
+			assert.Equal(t, "new cover", readZipFile(t, dst, tc.newCover))
+
+			// the package's unique identifier and the mimetype entry are unchanged
+			opf := readZipFile(t, dst, "OEBPS/content.opf")
+			assert.Contains(t, opf, "urn:uuid:1234")
+			assert.NotContains(t, opf, "Wrong Series")
+			zr, err := zip.OpenReader(dst)
+			require.NoError(t, err)
+			assert.Equal(t, "mimetype", zr.File[0].Name)
+			assert.Equal(t, zip.Store, zr.File[0].Method)
+			zr.Close()
+
+			// the book was replaced in place without its cover
+			bi, err = load(src)
+			require.NoError(t, err)
+			assert.Equal(t, "The Book", bi.Book().Title)
+			assert.Equal(t, "original cover", readZipFile(t, src, "OEBPS/"+tc.cover))
+		})
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, fi := range files {
+		assert.False(t, strings.HasPrefix(fi.Name(), ".bookbrowser-"), "temporary file %s should be removed", fi.Name())
+	}
+}
@@ -1,15 +1,21 @@
 package formats
 
 import (
-	"path/filepath"
-	"strings"
-	"github.com/sblinch/BookBrowser/booklist"
 	"github.com/pkg/errors"
+	"github.com/sblinch/BookBrowser/booklist"
 	"io"
+	"path/filepath"
+	"strings"
 )
 
 var formats = map[string]func(filename string) (BookInfo, error){}
 
+// WriteFunc copies the book at src to dst with its metadata replaced by book's, and its cover replaced by the image
+// read from cover if it is not nil. src and dst may be the same file.
+type WriteFunc func(src, dst string, book *booklist.Book, cover io.Reader) error
+
+var writers = map[string]WriteFunc{}
+
 type BookInfo interface {
 	Book() *booklist.Book
 	HasCover() bool
@@ -33,6 +39,31 @@ func Load(filename string) (BookInfo, error) {
 	return load(filename)
 }
 
+// RegisterWriter registers a function which writes metadata into books of the specified format.
+func RegisterWriter(ext string, write WriteFunc) {
+	ext = strings.ToLower(ext)
+	if _, ok := writers[ext]; ok {
+		panic("attempted to register existing writer " + ext)
+	}
+	writers[ext] = write
+}
+
+// CanWrite reports whether metadata can be written into the specified book.
+func CanWrite(filename string) bool {
+	_, ok := writers[strings.ToLower(strings.Replace(filepath.Ext(filename), ".", "", 1))]
+	return ok
+}
+
+// Write copies the book at src to dst with its metadata replaced by book's; see WriteFunc.
+func Write(src, dst string, book *booklist.Book, cover io.Reader) error {
+	ext := strings.Replace(filepath.Ext(src), ".", "", 1)
+	write, ok := writers[strings.ToLower(ext)]
+	if !ok {
+		return errors.Errorf("could not write format %s", ext)
+	}
+	return write(src, dst, book, cover)
+}
+
 func GetExts() []string {
 	exts := []string{}
 	for ext := range formats {
@@ -55,7 +55,7 @@ func (e *mobi) GetCover() (i io.ReadCloser, err error) {
 		return nil, errors.Wrap(err, "unable to see to cover offset")
 	}
 
-	ltd := &limitedReaderCloser{io.LimitedReader{f, e.coverlength}}
+	ltd := &limitedReaderCloser{io.LimitedReader{R: f, N: e.coverlength}}
 	return ltd, nil
 }
 
@@ -105,15 +105,16 @@ func load(filename string) (bi formats.BookInfo, ferr error) {
 
 	m.book.Title = r.BestTitle()
 
-	authors := r.Authors()
-	if len(authors) > 0 {
-		m.book.Author = &booklist.Author{
-			Name: authors[0],
-		}
+	for _, author := range r.Authors() {
+		m.book.AddContributor(author, booklist.RoleAuthor)
 	}
 
 	m.book.Description = r.Description()
 
+	for _, subject := range r.Subjects() {
+		m.book.AddTag(subject)
+	}
+
 	publisher := r.Publisher()
 	if len(publisher) > 0 {
 		m.book.Publisher = &booklist.Publisher{
@@ -1,6 +1,10 @@
 package formatters
 
-import "github.com/sblinch/BookBrowser/booklist"
+import (
+	"strings"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
 
 type StringFormatter func(name string, book *booklist.Book) string
 
@@ -13,15 +17,43 @@ func Apply(b *booklist.Book) {
 		b.Title = title
 	}
 
-	if b.Author != nil {
-		name := b.Author.Name
+	// the primary author is normally also one of the contributors, so each author is only formatted once
+	formatted := make(map[*booklist.Author]bool, len(b.Contributors)+1)
+	formatAuthor := func(a *booklist.Author) {
+		if a == nil || formatted[a] {
+			return
+		}
+		formatted[a] = true
+		name := a.Name
 		for _, n := range EnabledAuthorNameFormatters {
 			if formatter, exists := AuthorNameFormatters[n]; exists {
 				name = formatter(name, b)
 			}
 		}
-		b.Author.Name = name
+		a.Name = name
+	}
+	formatAuthor(b.Author)
+
+	// contributors whose names only differed in their formatting (eg: "Herbert, Frank" and "Frank Herbert") are now
+	// duplicates
+	contributors := b.Contributors[:0]
+	for _, c := range b.Contributors {
+		formatAuthor(c.Author)
+		duplicate := false
+		for _, prev := range contributors {
+			if prev.Role == c.Role && strings.EqualFold(prev.Author.Name, c.Author.Name) {
+				duplicate = true
+				if b.Author == c.Author {
+					b.Author = prev.Author
+				}
+				break
+			}
+		}
+		if !duplicate {
+			contributors = append(contributors, c)
+		}
 	}
+	b.Contributors = contributors
 }
 
 func ApplyFilename(filename string, b *booklist.Book) {
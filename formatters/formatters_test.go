@@ -0,0 +1,29 @@
+package formatters
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+func TestApply(t *testing.T) {
+	b := &booklist.Book{Title: "dune"}
+	b.AddContributor("herbert, frank", booklist.RoleAuthor)
+	b.AddContributor("Frank Herbert", booklist.RoleAuthor)
+	b.AddContributor("Anderson, Kevin J.", booklist.RoleAuthor)
+	b.AddContributor("smith, jane", booklist.RoleTranslator)
+	Apply(b)
+
+	names := []string{}
+	for _, c := range b.Contributors {
+		names = append(names, c.Role+":"+c.Author.Name)
+	}
+	expected := "author:Frank Herbert, author:Kevin J. Anderson, translator:Jane Smith"
+	if res := strings.Join(names, ", "); res != expected {
+		t.Fatalf("expected: %s\n     saw: %s", expected, res)
+	}
+	if b.Author != b.Contributors[0].Author {
+		t.Fatalf("expected the primary author to be the first contributor, saw %s", b.Author.Name)
+	}
+}
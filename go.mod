@@ -8,6 +8,7 @@ require (
 	github.com/beevik/etree v1.0.1-0.20171015221209-af219c0c7ea1
 	github.com/davecgh/go-spew v1.1.1-0.20171005155431-ecdeabc65495 // indirect
 	github.com/eknkc/amber v0.0.0-20171010120322-cdade1c07385 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/geek1011/kepubify v2.3.2-0.20190207015944-d08efa025c00+incompatible
 	github.com/gobuffalo/packr v1.13.1
 	github.com/julienschmidt/httprouter v1.1.1-0.20170430222011-975b5c4c7c21
@@ -21,6 +22,6 @@ require (
 	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.2.2
 	github.com/unrolled/render v0.0.0-20171006150303-32bf1ea2a39e
-	golang.org/x/net v0.0.0-20180811021610-c39426892332 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/tools v0.0.0-20171010174739-e4b401d06e5e
 )
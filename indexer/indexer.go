@@ -2,9 +2,12 @@ package indexer
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"crypto/sha1"
 	"sync/atomic"
 	"sync"
@@ -12,6 +15,7 @@ import (
 	"time"
 
 	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/converter"
 	"github.com/sblinch/BookBrowser/formats"
 	"github.com/sblinch/BookBrowser/storage"
 	"github.com/sblinch/BookBrowser/formatters"
@@ -26,6 +30,12 @@ import (
 type Indexer struct {
 	Verbose  bool
 	Progress float64
+
+	// converted copies of books; copies of books that are modified or removed are pruned after indexing
+	Converted *converter.Cache
+	// whether to convert EPUBs to KEPUB while indexing them, rather than on the first download
+	PregenerateKepub bool
+
 	storage  *storage.Storage
 	datapath *string
 	paths    []string
@@ -57,6 +67,9 @@ func New(paths []string, storage *storage.Storage, datapath *string, exts []stri
 	return &Indexer{paths: paths, storage: storage, datapath: cp, exts: exts}, nil
 }
 
+// ErrIndexingActive is returned when indexing is requested while another indexing operation is in progress.
+var ErrIndexingActive = errors.New("indexing is already in progress")
+
 // Store this many books in memory before writing a batch to the database for improved performance
 const insertTransactionSize = 64
 
@@ -70,7 +83,7 @@ func (i *Indexer) Refresh() ([]error, error) {
 	errs := []error{}
 
 	if !atomic.CompareAndSwapUint32(&i.indexingActive, 0, 1) {
-		return errs, errors.New("indexing is already in progress")
+		return errs, ErrIndexingActive
 	}
 	defer atomic.StoreUint32(&i.indexingActive, 0)
 
@@ -88,13 +101,23 @@ func (i *Indexer) Refresh() ([]error, error) {
 	}
 
 	filenames := []string{}
+	// paths which could not be fully scanned; books beneath these paths are never pruned, as their files may only be
+	// temporarily unavailable (eg: an unmounted network share)
+	unscanned := []string{}
 	for _, path := range i.paths {
+		if !util.DirExists(path) {
+			unscanned = append(unscanned, path)
+			errs = append(errs, errors.Errorf("book directory '%s' does not exist", path))
+			if i.Verbose {
+				log.Printf("Error: %v", errs[len(errs)-1])
+			}
+			continue
+		}
 		for _, ext := range i.exts {
 			l, err := zglob.Glob(filepath.Join(path, "**", fmt.Sprintf("*.%s", ext)))
-			if l != nil {
-				filenames = append(filenames, l...)
-			}
+			filenames = appendBookFiles(filenames, l)
 			if err != nil {
+				unscanned = append(unscanned, path)
 				errs = append(errs, errors.Wrapf(err, "error scanning '%s' for type '%s'", path, ext))
 				if i.Verbose {
 					log.Printf("Error: %v", errs[len(errs)-1])
@@ -107,6 +130,172 @@ func (i *Indexer) Refresh() ([]error, error) {
 		i.Progress = 0
 	}()
 
+	found := make(map[string]struct{}, len(filenames))
+	for _, filepath := range filenames {
+		found[fmt.Sprintf("%x", sha1.Sum([]byte(filepath)))] = struct{}{}
+	}
+
+	// books on file whose files have disappeared; these may turn up again under a new name, in which case they are
+	// updated in place, otherwise they are pruned once indexing is complete
+	missing := i.findMissing(seen, found, unscanned)
+
+	startTime := time.Now()
+
+	errs = append(errs, i.index(filenames, seen, missing)...)
+
+	if err := i.prune(missing.remaining()); err != nil {
+		errs = append(errs, errors.Wrap(err, "error pruning missing books"))
+		if i.Verbose {
+			log.Printf("Error: %v", errs[len(errs)-1])
+		}
+	}
+
+	if err := i.pruneConverted(); err != nil {
+		errs = append(errs, errors.Wrap(err, "error pruning converted books"))
+		if i.Verbose {
+			log.Printf("Error: %v", errs[len(errs)-1])
+		}
+	}
+
+	endTime := time.Now()
+
+	if i.Verbose {
+		log.Printf("Completed indexing in %v", endTime.Sub(startTime))
+	}
+
+	return errs, nil
+}
+
+// IndexPaths incrementally updates the index database for the specified files or directories, without rescanning
+// the rest of the library. Files which exist are indexed if they are new or have changed; paths which no longer exist
+// have their books (or, for directories, the books beneath them) removed from the index, unless they are found to
+// have been moved to one of the other specified paths.
+func (i *Indexer) IndexPaths(paths []string) ([]error, error) {
+	errs := []error{}
+
+	if !atomic.CompareAndSwapUint32(&i.indexingActive, 0, 1) {
+		return errs, ErrIndexingActive
+	}
+	defer atomic.StoreUint32(&i.indexingActive, 0)
+
+	defer func() {
+		i.Progress = 0
+	}()
+
+	seen, err := i.storage.Books.GetSeen()
+	if err != nil {
+		return errs, err
+	}
+
+	filenames := []string{}
+	gone := []string{}
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			gone = append(gone, path)
+			continue
+		} else if err != nil {
+			errs = append(errs, errors.Wrapf(err, "cannot stat file '%s'", path))
+			continue
+		}
+
+		if stat.IsDir() {
+			for _, ext := range i.exts {
+				l, err := zglob.Glob(filepath.Join(path, "**", fmt.Sprintf("*.%s", ext)))
+				filenames = appendBookFiles(filenames, l)
+				if err != nil {
+					errs = append(errs, errors.Wrapf(err, "error scanning '%s' for type '%s'", path, ext))
+				}
+			}
+		} else if i.isBookFile(path) {
+			filenames = append(filenames, path)
+		}
+	}
+
+	missing := &movedBooks{byHash: make(map[string][]storage.BookSeen)}
+	for _, book := range seen {
+		for _, path := range gone {
+			if book.FilePath == path || strings.HasPrefix(book.FilePath, path+string(os.PathSeparator)) {
+				if _, err := os.Stat(book.FilePath); os.IsNotExist(err) {
+					missing.byHash[book.Hash] = append(missing.byHash[book.Hash], book)
+				}
+				break
+			}
+		}
+	}
+
+	errs = append(errs, i.index(filenames, seen, missing)...)
+
+	if err := i.prune(missing.remaining()); err != nil {
+		errs = append(errs, errors.Wrap(err, "error pruning missing books"))
+		if i.Verbose {
+			log.Printf("Error: %v", errs[len(errs)-1])
+		}
+	}
+
+	if err := i.pruneConverted(); err != nil {
+		errs = append(errs, errors.Wrap(err, "error pruning converted books"))
+		if i.Verbose {
+			log.Printf("Error: %v", errs[len(errs)-1])
+		}
+	}
+
+	return errs, nil
+}
+
+// uniqueStrings returns the distinct values in l, in their original order.
+func uniqueStrings(l []string) []string {
+	found := make(map[string]struct{}, len(l))
+	u := make([]string, 0, len(l))
+	for _, s := range l {
+		if _, ok := found[s]; !ok {
+			found[s] = struct{}{}
+			u = append(u, s)
+		}
+	}
+	return u
+}
+
+// isHiddenFile reports whether the specified file's name begins with a dot, as do the temporary files that books are
+// written to before being renamed into place; these are never indexed.
+func isHiddenFile(filename string) bool {
+	return strings.HasPrefix(filepath.Base(filename), ".")
+}
+
+// appendBookFiles appends the files in l which aren't hidden to filenames.
+func appendBookFiles(filenames, l []string) []string {
+	for _, filename := range l {
+		if !isHiddenFile(filename) {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// isBookFile reports whether the specified file has one of the extensions being indexed and isn't hidden.
+func (i *Indexer) isBookFile(filename string) bool {
+	if isHiddenFile(filename) {
+		return false
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	for _, e := range i.exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// index reads each of the specified files and saves them to the index database, skipping any that have not changed
+// since they were last indexed. seen is the list of books on file before indexing began, and missing holds the books
+// whose files have disappeared, which are matched against the files being indexed to detect moved books.
+func (i *Indexer) index(filenames []string, seen map[string]storage.BookSeen, missing *movedBooks) []error {
+	errs := []error{}
+
+	// the same file may be listed more than once (eg: beneath overlapping book directories, or both directly and
+	// through a newly-created directory), and must only be indexed once
+	filenames = uniqueStrings(filenames)
+
 	indexChan := make(chan string, 8)
 	errorChan := make(chan error, 8)
 	errorsDone := make(chan struct{})
@@ -143,6 +332,15 @@ func (i *Indexer) Refresh() ([]error, error) {
 					}
 					continue
 				} else {
+					i.identify(book, seen, missing)
+					if _, err := i.applyOverrides(book); err != nil {
+						err = errors.Wrapf(err, "error applying overrides to '%s'", filepath)
+						errorChan <- err
+						if i.Verbose {
+							log.Printf("--> Error: %v", err)
+						}
+					}
+					i.pregenerate(book)
 					newBooks = append(newBooks, book)
 					if len(newBooks) == cap(newBooks) {
 						if err := i.storage.Books.Save(newBooks...); err != nil {
@@ -161,8 +359,6 @@ func (i *Indexer) Refresh() ([]error, error) {
 		}()
 	}
 
-	startTime := time.Now()
-
 	for fi, filepath := range filenames {
 		stat, err := os.Stat(filepath)
 		if err != nil {
@@ -190,13 +386,182 @@ func (i *Indexer) Refresh() ([]error, error) {
 	close(errorChan)
 	<-errorsDone
 
-	endTime := time.Now()
+	return errs
+}
+
+// movedBooks holds books on file whose files could not be found during a refresh, keyed by content hash, so that
+// they can be matched against newly-found files with identical content.
+type movedBooks struct {
+	sync.Mutex
+	byHash map[string][]storage.BookSeen
+}
+
+// claim removes and returns a missing book with the specified content hash, if there is one.
+func (m *movedBooks) claim(hash string) (storage.BookSeen, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	books := m.byHash[hash]
+	if len(books) == 0 {
+		return storage.BookSeen{}, false
+	}
+	book := books[0]
+	if len(books) == 1 {
+		delete(m.byHash, hash)
+	} else {
+		m.byHash[hash] = books[1:]
+	}
+	return book, true
+}
+
+// remaining returns all missing books that have not been claimed.
+func (m *movedBooks) remaining() []storage.BookSeen {
+	m.Lock()
+	defer m.Unlock()
+
+	r := []storage.BookSeen{}
+	for _, books := range m.byHash {
+		r = append(r, books...)
+	}
+	return r
+}
+
+// findMissing returns the books whose files no longer exist. seen is the list of books on file before indexing
+// began, and found contains the filename hashes of all files found while scanning. Books beneath any of the
+// unscanned paths are never considered missing.
+func (i *Indexer) findMissing(seen map[string]storage.BookSeen, found map[string]struct{}, unscanned []string) *movedBooks {
+	missing := &movedBooks{byHash: make(map[string][]storage.BookSeen)}
+
+nextBook:
+	for filenameHash, book := range seen {
+		if _, exists := found[filenameHash]; exists {
+			continue
+		}
+		for _, path := range unscanned {
+			if strings.HasPrefix(book.FilePath, path+string(os.PathSeparator)) {
+				continue nextBook
+			}
+		}
+		if _, err := os.Stat(book.FilePath); !os.IsNotExist(err) {
+			continue
+		}
+
+		missing.byHash[book.Hash] = append(missing.byHash[book.Hash], book)
+	}
+
+	return missing
+}
+
+// identify matches a newly-read book against the books already on file, so that saving it updates the existing
+// record (keeping its ID, import date and anything else attached to it) rather than creating a new one. A book is
+// matched by its pathname if the file was modified in place, or by its content hash if the file was moved or
+// renamed.
+func (i *Indexer) identify(book *booklist.Book, seen map[string]storage.BookSeen, missing *movedBooks) {
+	if existing, exists := seen[fmt.Sprintf("%x", sha1.Sum([]byte(book.FilePath)))]; exists {
+		book.ID = existing.ID
+		book.ImportDate = time.Unix(existing.ImportDate, 0)
+		return
+	}
+
+	if existing, exists := missing.claim(book.Hash); exists {
+		if i.Verbose {
+			log.Printf("Detected %s moved to %s", existing.FilePath, book.FilePath)
+		}
+		book.ID = existing.ID
+		book.ImportDate = time.Unix(existing.ImportDate, 0)
+		return
+	}
+
+	book.ImportDate = time.Now()
+}
+
+// prune removes missing books from the index, along with any cover images that are no longer used by another book.
+func (i *Indexer) prune(missing []storage.BookSeen) error {
+	if len(missing) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(missing))
+	for k, book := range missing {
+		if i.Verbose {
+			log.Printf("Removing missing book %s", book.FilePath)
+		}
+		ids[k] = book.ID
+	}
+
+	if err := i.storage.Books.Delete(ids...); err != nil {
+		return err
+	}
+
+	for _, book := range missing {
+		i.removeCovers(book.Hash)
+		i.removeCoverOverride(book.ID)
+	}
 
 	if i.Verbose {
-		log.Printf("Completed indexing in %v", endTime.Sub(startTime))
+		log.Printf("Removed %d missing books from the index", len(ids))
 	}
 
-	return errs, nil
+	return nil
+}
+
+// coverPaths returns the pathnames of the cover image and thumbnail for the book with the specified hash.
+func (i *Indexer) coverPaths(hash string) (coverpath, thumbpath string) {
+	imageRoot := filepath.Join(*i.datapath, hash[0:2])
+	coverpath = filepath.Join(imageRoot, fmt.Sprintf("%s.jpg", hash[2:]))
+	thumbpath = filepath.Join(imageRoot, fmt.Sprintf("%s_thumb.jpg", hash[2:]))
+	return
+}
+
+// removeCovers deletes the cover image and thumbnail for the book with the specified hash, unless they are still
+// in use by another book with identical content.
+func (i *Indexer) removeCovers(hash string) {
+	if i.datapath == nil || len(hash) < 3 {
+		return
+	}
+	if inUse, err := i.storage.Books.HashExists(hash); err != nil || inUse {
+		return
+	}
+
+	coverpath, thumbpath := i.coverPaths(hash)
+	for _, pathname := range []string{coverpath, thumbpath} {
+		if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) && i.Verbose {
+			log.Printf("Error removing cover image %s: %v", pathname, err)
+		}
+	}
+}
+
+// pruneConverted removes cached converted copies of books which have since been modified or removed.
+func (i *Indexer) pruneConverted() error {
+	if i.Converted == nil {
+		return nil
+	}
+
+	seen, err := i.storage.Books.GetSeen()
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]struct{}, len(seen))
+	for _, book := range seen {
+		hashes[book.Hash] = struct{}{}
+	}
+	return i.Converted.Prune(hashes)
+}
+
+// pregenerate converts a newly-indexed book to the formats that are cached ahead of time.
+func (i *Indexer) pregenerate(book *booklist.Book) {
+	if !i.PregenerateKepub || i.Converted == nil || book.FileType() != "epub" {
+		return
+	}
+
+	f, err := i.Converted.Open(book.FilePath, book.Hash, converter.KepubFormat, converter.Kepub)
+	if err != nil {
+		if i.Verbose {
+			log.Printf("Error converting %s to KEPUB: %v", book.FilePath, err)
+		}
+		return
+	}
+	f.Close()
 }
 
 // getBook loads the metadata for an ebook and prepares its cover images.
@@ -207,18 +572,13 @@ func (i *Indexer) getBook(filename string) (*booklist.Book, error) {
 	}
 
 	b := bi.Book()
+	if b.PartialMD5, err = formats.PartialMD5(filename); err != nil {
+		return nil, errors.Wrap(err, "could not digest book")
+	}
 	formatters.Apply(b)
 	b.HasCover = false
 	if i.datapath != nil && bi.HasCover() {
-		imageRoot := filepath.Join(*i.datapath, b.Hash[0:2])
-		if !util.DirExists(imageRoot) {
-			err := os.Mkdir(imageRoot, 0755)
-			if err != nil && !os.IsNotExist(err) {
-				return nil, errors.Wrap(err, "error creating image directory")
-			}
-		}
-		coverpath := filepath.Join(imageRoot, fmt.Sprintf("%s.jpg", b.Hash[2:]))
-		thumbpath := filepath.Join(imageRoot, fmt.Sprintf("%s_thumb.jpg", b.Hash[2:]))
+		coverpath, thumbpath := i.coverPaths(b.Hash)
 
 		_, err := os.Stat(coverpath)
 		_, errt := os.Stat(thumbpath)
@@ -229,32 +589,173 @@ func (i *Indexer) getBook(filename string) (*booklist.Book, error) {
 			}
 			defer r.Close()
 
-			f, err := os.Create(coverpath)
-			if err != nil {
-				return nil, errors.Wrap(err, "could not create cover file")
+			if err := i.writeCovers(b.Hash, r); err != nil {
+				return nil, err
 			}
-			defer f.Close()
+		}
 
-			e := images.Encoder(r)
-			if err = e.EncodeCover(f); err != nil {
-				os.Remove(coverpath)
-				return nil, errors.Wrap(err, "could not write cover file")
-			}
+		b.HasCover = true
+	}
 
-			tf, err := os.Create(thumbpath)
-			if err != nil {
-				os.Remove(thumbpath)
-				return nil, errors.Wrap(err, "could not create cover thumbnail file")
-			}
-			defer tf.Close()
+	return b, nil
+}
 
-			if e.EncodeThumbnail(tf, 400, 400); err != nil {
-				return nil, errors.Wrap(err, "could not write thumbnail file")
+// writeCovers encodes the image read from r as the cover image and thumbnail for the book with the specified hash.
+func (i *Indexer) writeCovers(hash string, r io.Reader) error {
+	imageRoot := filepath.Join(*i.datapath, hash[0:2])
+	if !util.DirExists(imageRoot) {
+		err := os.Mkdir(imageRoot, 0755)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "error creating image directory")
+		}
+	}
+	coverpath, thumbpath := i.coverPaths(hash)
+
+	f, err := os.Create(coverpath)
+	if err != nil {
+		return errors.Wrap(err, "could not create cover file")
+	}
+	defer f.Close()
+
+	e := images.Encoder(r)
+	if err = e.EncodeCover(f); err != nil {
+		os.Remove(coverpath)
+		return errors.Wrap(err, "could not write cover file")
+	}
+
+	tf, err := os.Create(thumbpath)
+	if err != nil {
+		return errors.Wrap(err, "could not create cover thumbnail file")
+	}
+	defer tf.Close()
+
+	if err = e.EncodeThumbnail(tf, 400, 400); err != nil {
+		os.Remove(thumbpath)
+		return errors.Wrap(err, "could not write thumbnail file")
+	}
+	return nil
+}
+
+// coverOverridePath returns the pathname of the cover image uploaded for a book, relative to the data directory.
+func coverOverridePath(bookID int) string {
+	return filepath.Join("overrides", fmt.Sprintf("%d.jpg", bookID))
+}
+
+// removeCoverOverride deletes the cover image uploaded for a book, if there is one.
+func (i *Indexer) removeCoverOverride(bookID int) {
+	if i.datapath == nil {
+		return
+	}
+	pathname := filepath.Join(*i.datapath, coverOverridePath(bookID))
+	if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) && i.Verbose {
+		log.Printf("Error removing cover image %s: %v", pathname, err)
+	}
+}
+
+// SetCover saves an image as a book's cover, replacing the cover from its file, and returns the pathname to record in
+// the book's cover override so that the image is restored whenever the book is reindexed.
+func (i *Indexer) SetCover(book *booklist.Book, r io.Reader) (string, error) {
+	if i.datapath == nil {
+		return "", errors.New("covers are not stored")
+	}
+
+	dir := filepath.Join(*i.datapath, "overrides")
+	if !util.DirExists(dir) {
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return "", errors.Wrap(err, "error creating cover override directory")
+		}
+	}
+
+	value := coverOverridePath(book.ID)
+	pathname := filepath.Join(*i.datapath, value)
+	// encode to a temporary file so that an invalid image doesn't replace a cover that was already set
+	f, err := ioutil.TempFile(dir, ".cover-*.jpg")
+	if err != nil {
+		return "", errors.Wrap(err, "could not create cover file")
+	}
+	defer os.Remove(f.Name())
+	err = images.Encoder(r).EncodeCover(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		return "", errors.Wrap(cerr, "could not write cover file")
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "could not read cover image")
+	}
+	if err := os.Rename(f.Name(), pathname); err != nil {
+		return "", errors.Wrap(err, "could not replace cover file")
+	}
+
+	if err := i.restoreCover(book, value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// restoreCover replaces a book's cover images with the image recorded in its cover override.
+func (i *Indexer) restoreCover(book *booklist.Book, value string) error {
+	if i.datapath == nil {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(*i.datapath, value))
+	if err != nil {
+		return errors.Wrap(err, "could not open cover override")
+	}
+	defer f.Close()
+
+	if err := i.writeCovers(book.Hash, f); err != nil {
+		return err
+	}
+	book.HasCover = true
+	return nil
+}
+
+// applyOverrides applies the manual edits to a book's metadata after its file is re-read, so that they aren't lost
+// when it is reindexed, and reports whether its cover was overridden. New books have no overrides.
+func (i *Indexer) applyOverrides(book *booklist.Book) (cover bool, err error) {
+	if book.ID == 0 {
+		return false, nil
+	}
+
+	overrides, err := i.storage.Overrides.ByBook(book.ID)
+	if err != nil {
+		return false, err
+	}
+	book.ApplyOverrides(overrides)
+	for _, o := range overrides {
+		if o.Field == booklist.FieldCover {
+			if err := i.restoreCover(book, o.Value); err != nil {
+				return false, err
 			}
+			cover = true
 		}
+	}
+	return cover, nil
+}
 
-		b.HasCover = true
+// Reindex re-reads a book's file and cover image and saves it with its overrides applied. It is used to restore the
+// metadata from the book's file after overrides are removed; if the cover override was removed, the uploaded image is
+// deleted.
+func (i *Indexer) Reindex(book *booklist.Book) error {
+	if i.datapath != nil && len(book.Hash) > 2 {
+		coverpath, thumbpath := i.coverPaths(book.Hash)
+		os.Remove(coverpath)
+		os.Remove(thumbpath)
 	}
 
-	return b, nil
+	b, err := i.getBook(book.FilePath)
+	if err != nil {
+		return errors.Wrapf(err, "error reading book '%s'", book.FilePath)
+	}
+	b.ID = book.ID
+	b.ImportDate = book.ImportDate
+
+	if cover, err := i.applyOverrides(b); err != nil {
+		return err
+	} else if !cover {
+		i.removeCoverOverride(b.ID)
+	}
+
+	*book = *b
+	return i.storage.Overrides.Edit(book)
 }
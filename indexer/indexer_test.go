@@ -0,0 +1,293 @@
+package indexer
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/converter"
+	"github.com/sblinch/BookBrowser/formats"
+	_ "github.com/sblinch/BookBrowser/formats/epub"
+	"github.com/sblinch/BookBrowser/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestEPUB creates a minimal EPUB with the specified title.
+func writeTestEPUB(t *testing.T, filename, title string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	files := []struct{ name, content string }{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"content.opf", `<?xml version="1.0"?><package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf"><dc:title>` + title + `</dc:title><dc:creator opf:role="aut">Jane Doe</dc:creator><dc:identifier id="id">x</dc:identifier></metadata><manifest><item id="c" href="c.xhtml" media-type="application/xhtml+xml"/></manifest><spine><itemref idref="c"/></spine></package>`},
+		{"c.xhtml", "<html><body>" + title + "</body></html>"},
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		require.NoError(t, err)
+		w.Write([]byte(file.content))
+	}
+	require.NoError(t, zw.Close())
+}
+
+// newTestIndexer creates an indexer for an empty library in a temporary directory, which is removed by cleanup.
+func newTestIndexer(t *testing.T) (i *Indexer, s *storage.Storage, library string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "bookbrowser-indexer")
+	require.NoError(t, err)
+
+	library = filepath.Join(dir, "books")
+	data := filepath.Join(dir, "data")
+	require.NoError(t, os.Mkdir(library, 0755))
+	require.NoError(t, os.Mkdir(data, 0755))
+
+	s, err = storage.New(filepath.Join(data, "test.db"))
+	require.NoError(t, err)
+	i, err = New([]string{library}, s, &data, []string{"epub"})
+	require.NoError(t, err)
+
+	return i, s, library, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// booksByPath returns the indexed books, keyed by pathname relative to the library.
+func booksByPath(t *testing.T, s *storage.Storage, library string) map[string]storage.BookSeen {
+	seen, err := s.Books.GetSeen()
+	require.NoError(t, err)
+	books := make(map[string]storage.BookSeen, len(seen))
+	for _, b := range seen {
+		rel, err := filepath.Rel(library, b.FilePath)
+		require.NoError(t, err)
+		books[rel] = b
+	}
+	return books
+}
+
+func TestRefresh(t *testing.T) {
+	i, s, library, cleanup := newTestIndexer(t)
+	defer cleanup()
+
+	writeTestEPUB(t, filepath.Join(library, "one.epub"), "One")
+	writeTestEPUB(t, filepath.Join(library, "two.epub"), "Two")
+	writeTestEPUB(t, filepath.Join(library, "three.epub"), "Three")
+	// temporary files that books are being written to are hidden, and aren't indexed
+	writeTestEPUB(t, filepath.Join(library, ".bookbrowser-123.epub"), "Partial")
+	errs, err := i.Refresh()
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	before := booksByPath(t, s, library)
+	require.Len(t, before, 3)
+
+	// moving a book keeps its record
+	require.NoError(t, os.MkdirAll(filepath.Join(library, "moved"), 0755))
+	require.NoError(t, os.Rename(filepath.Join(library, "one.epub"), filepath.Join(library, "moved", "one.epub")))
+	// modifying a book in place updates its record
+	writeTestEPUB(t, filepath.Join(library, "two.epub"), "Two, Revised")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(library, "two.epub"), later, later))
+	// deleting a book removes its record
+	require.NoError(t, os.Remove(filepath.Join(library, "three.epub")))
+
+	errs, err = i.Refresh()
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	after := booksByPath(t, s, library)
+	require.Len(t, after, 2)
+
+	moved, ok := after[filepath.Join("moved", "one.epub")]
+	require.True(t, ok)
+	assert.Equal(t, before["one.epub"].ID, moved.ID)
+	assert.Equal(t, before["one.epub"].ImportDate, moved.ImportDate)
+
+	modified, ok := after["two.epub"]
+	require.True(t, ok)
+	assert.Equal(t, before["two.epub"].ID, modified.ID)
+	assert.NotEqual(t, before["two.epub"].Hash, modified.Hash)
+	bl, err := s.Books.Query(storage.NewQuery().In("id", []int{modified.ID}))
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	assert.Equal(t, "Two, Revised", bl[0].Title)
+}
+
+func TestIndexPaths(t *testing.T) {
+	i, s, library, cleanup := newTestIndexer(t)
+	defer cleanup()
+
+	writeTestEPUB(t, filepath.Join(library, "a", "one.epub"), "One")
+	writeTestEPUB(t, filepath.Join(library, "b", "two.epub"), "Two")
+	_, err := i.Refresh()
+	require.NoError(t, err)
+	before := booksByPath(t, s, library)
+	require.Len(t, before, 2)
+
+	// a directory that was renamed is reported as the old path disappearing and the new one appearing
+	require.NoError(t, os.Rename(filepath.Join(library, "a"), filepath.Join(library, "c")))
+	require.NoError(t, os.RemoveAll(filepath.Join(library, "b")))
+	errs, err := i.IndexPaths([]string{filepath.Join(library, "a"), filepath.Join(library, "b"), filepath.Join(library, "c")})
+	require.NoError(t, err)
+	require.Empty(t, errs)
+
+	after := booksByPath(t, s, library)
+	require.Len(t, after, 1)
+	moved, ok := after[filepath.Join("c", "one.epub")]
+	require.True(t, ok)
+	assert.Equal(t, before[filepath.Join("a", "one.epub")].ID, moved.ID)
+}
+
+func TestWatcherFlush(t *testing.T) {
+	i, s, library, cleanup := newTestIndexer(t)
+	defer cleanup()
+
+	w := &Watcher{indexer: i, pending: make(map[string]struct{})}
+	pathname := filepath.Join(library, "one.epub")
+	writeTestEPUB(t, pathname, "One")
+	w.queue(pathname)
+
+	// while other indexing is in progress, the changed paths are kept for the next attempt
+	i.indexingActive = 1
+	assert.False(t, w.flush())
+	assert.Contains(t, w.pending, pathname)
+	assert.Empty(t, booksByPath(t, s, library))
+
+	i.indexingActive = 0
+	assert.True(t, w.flush())
+	assert.Empty(t, w.pending)
+	assert.Contains(t, booksByPath(t, s, library), "one.epub")
+}
+
+func TestWriteMetadata(t *testing.T) {
+	i, s, library, cleanup := newTestIndexer(t)
+	defer cleanup()
+
+	writeTestEPUB(t, filepath.Join(library, "one.epub"), "One")
+	_, err := i.Refresh()
+	require.NoError(t, err)
+	bl, err := s.Books.QueryDeps(storage.NewQuery())
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	bl[0].Title = "One, Revised"
+
+	// the file isn't replaced while other indexing is in progress
+	i.indexingActive = 1
+	assert.Equal(t, ErrIndexingActive, i.WriteMetadata(bl[0]))
+	i.indexingActive = 0
+
+	require.NoError(t, i.WriteMetadata(bl[0]))
+	assert.Equal(t, "One, Revised", bl[0].Title)
+	files, err := ioutil.ReadDir(library)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "one.epub", files[0].Name())
+	assert.False(t, i.isBookFile(filepath.Join(library, ".bookbrowser-123.epub")))
+}
+
+func TestSetCover(t *testing.T) {
+	i, s, library, cleanup := newTestIndexer(t)
+	defer cleanup()
+
+	writeTestEPUB(t, filepath.Join(library, "one.epub"), "One")
+	_, err := i.Refresh()
+	require.NoError(t, err)
+	bl, err := s.Books.QueryDeps(storage.NewQuery())
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 60, 90)), nil))
+	value, err := i.SetCover(bl[0], &buf)
+	require.NoError(t, err)
+	pathname := filepath.Join(*i.datapath, value)
+	cover, err := ioutil.ReadFile(pathname)
+	require.NoError(t, err)
+	require.NotEmpty(t, cover)
+
+	// an invalid image leaves the existing cover in place
+	_, err = i.SetCover(bl[0], strings.NewReader("not an image"))
+	assert.Error(t, err)
+	after, err := ioutil.ReadFile(pathname)
+	require.NoError(t, err)
+	assert.Equal(t, cover, after)
+	files, err := ioutil.ReadDir(filepath.Dir(pathname))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestEmbedMetadata(t *testing.T) {
+	i, s, library, cleanup := newTestIndexer(t)
+	defer cleanup()
+
+	writeTestEPUB(t, filepath.Join(library, "one.epub"), "One")
+	_, err := i.Refresh()
+	require.NoError(t, err)
+	load := func() *booklist.Book {
+		bl, err := s.Books.QueryDeps(storage.NewQuery())
+		require.NoError(t, err)
+		require.Len(t, bl, 1)
+		return bl[0]
+	}
+
+	// download returns the revision of the book's embedded metadata, and the title and cover of the cached copy
+	cache := converter.NewCache(filepath.Join(*i.datapath, "converted"))
+	download := func(b *booklist.Book) (revision, title string, cover []byte) {
+		revision, embed, err := i.EmbedMetadata(b)
+		require.NoError(t, err)
+		f, err := cache.Open(b.FilePath, b.Hash, "meta-"+revision+".epub", embed)
+		require.NoError(t, err)
+		defer f.Close()
+		bi, err := formats.Load(f.Name())
+		require.NoError(t, err)
+		if bi.HasCover() {
+			r, err := bi.GetCover()
+			require.NoError(t, err)
+			defer r.Close()
+			cover, err = ioutil.ReadAll(r)
+			require.NoError(t, err)
+		}
+		return revision, bi.Book().Title, cover
+	}
+
+	original, title, _ := download(load())
+	assert.Equal(t, "One", title)
+	again, _, _ := download(load())
+	assert.Equal(t, original, again)
+
+	// an edit changes the revision, so a new copy is made rather than serving the cached one
+	b := load()
+	require.NoError(t, b.SetField(booklist.FieldTitle, "One, Edited"))
+	require.NoError(t, s.Overrides.Edit(b, &booklist.Override{Field: booklist.FieldTitle, Value: "One, Edited", UserID: 1}))
+	edited, title, _ := download(load())
+	assert.NotEqual(t, original, edited)
+	assert.Equal(t, "One, Edited", title)
+
+	// so does each new cover, even when they're replaced within the same second
+	setCover := func(width int) {
+		var buf bytes.Buffer
+		require.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, 90)), nil))
+		b := load()
+		value, err := i.SetCover(b, &buf)
+		require.NoError(t, err)
+		require.NoError(t, s.Overrides.Edit(b, &booklist.Override{Field: booklist.FieldCover, Value: value, UserID: 1}))
+	}
+	setCover(60)
+	first, _, firstCover := download(load())
+	setCover(61)
+	second, _, secondCover := download(load())
+	assert.NotEqual(t, edited, first)
+	assert.NotEqual(t, first, second)
+	assert.NotEmpty(t, firstCover)
+	assert.False(t, bytes.Equal(firstCover, secondCover), "the new cover is embedded")
+}
@@ -0,0 +1,189 @@
+package indexer
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// A Watcher monitors an Indexer's paths for changes (using inotify on Linux) and incrementally indexes the files
+// that were created, modified, moved or deleted.
+type Watcher struct {
+	indexer  *Indexer
+	watcher  *fsnotify.Watcher
+	debounce time.Duration
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Watch starts watching the indexer's paths for changes. Changes are collected until no further changes have
+// occurred for the debounce interval (so that, for example, a large copy is indexed once it completes rather than
+// file-by-file), then only the affected paths are indexed.
+func (i *Indexer) Watch(debounce time.Duration) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating filesystem watcher")
+	}
+
+	w := &Watcher{
+		indexer:  i,
+		watcher:  fw,
+		debounce: debounce,
+		pending:  make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, path := range i.paths {
+		if err := w.addTree(path); err != nil {
+			fw.Close()
+			return nil, err
+		}
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Close stops watching for changes.
+func (w *Watcher) Close() error {
+	close(w.done)
+	err := w.watcher.Close()
+	w.wg.Wait()
+	return err
+}
+
+// addTree watches a directory and all of its subdirectories; fsnotify does not watch directories recursively.
+func (w *Watcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return errors.Wrapf(err, "error watching '%s'", path)
+			}
+			// subdirectories may disappear while they're being walked
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := w.watcher.Add(path); err != nil {
+			return errors.Wrapf(err, "error watching '%s'", path)
+		}
+		return nil
+	})
+}
+
+// run collects filesystem events and indexes the affected paths once the debounce interval has passed without any
+// further events.
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.handleEvent(event) {
+				timer.Reset(w.debounce)
+			}
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching book directories: %v", err)
+
+		case <-timer.C:
+			if !w.flush() {
+				// indexing was already in progress (eg: a full refresh), so try again later
+				timer.Reset(w.debounce)
+			}
+		}
+	}
+}
+
+// handleEvent records the path affected by a filesystem event, and reports whether it needs to be indexed.
+func (w *Watcher) handleEvent(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			// a directory was created or moved into the library; watch it, and index anything already inside it
+			if err := w.addTree(event.Name); err != nil {
+				log.Printf("Error: %v", err)
+			}
+			w.queue(event.Name)
+			return true
+		}
+	}
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// the path may have been a file or a directory, so let IndexPaths work out which books were affected
+		w.queue(event.Name)
+		return true
+	}
+
+	if event.Op&(fsnotify.Create|fsnotify.Write) != 0 && w.indexer.isBookFile(event.Name) {
+		w.queue(event.Name)
+		return true
+	}
+
+	return false
+}
+
+func (w *Watcher) queue(path string) {
+	w.mu.Lock()
+	w.pending[path] = struct{}{}
+	w.mu.Unlock()
+}
+
+// flush indexes all pending paths, and reports whether indexing was able to start.
+func (w *Watcher) flush() bool {
+	w.mu.Lock()
+	paths := make([]string, 0, len(w.pending))
+	for path := range w.pending {
+		paths = append(paths, path)
+	}
+	w.pending = make(map[string]struct{})
+	w.mu.Unlock()
+
+	if len(paths) == 0 {
+		return true
+	}
+
+	if w.indexer.Verbose {
+		log.Printf("Indexing %d changed paths", len(paths))
+	}
+
+	errs, err := w.indexer.IndexPaths(paths)
+	if err == ErrIndexingActive {
+		for _, path := range paths {
+			w.queue(path)
+		}
+		return false
+	} else if err != nil {
+		log.Printf("Error indexing changed paths: %v", err)
+		return true
+	}
+
+	if len(errs) != 0 && w.indexer.Verbose {
+		log.Printf("Incremental indexing finished with %v errors", len(errs))
+	}
+	return true
+}
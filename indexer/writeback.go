@@ -0,0 +1,228 @@
+package indexer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/converter"
+	"github.com/sblinch/BookBrowser/formats"
+	"github.com/sblinch/BookBrowser/storage"
+
+	"github.com/pkg/errors"
+)
+
+// Write metadata into this many books between each query for the next batch of books
+const writeBatchSize = 100
+
+// WriteMetadata writes a book's metadata from the index, including any edits, into its file so that other readers and
+// applications see it too; if its cover was replaced, the new cover is also written. The book is then reindexed, since
+// its file (and so its hash) has changed. book must have been queried along with its dependencies.
+//
+// ErrIndexingActive is returned if indexing is in progress, since the book could otherwise be indexed while its file is
+// being replaced.
+func (i *Indexer) WriteMetadata(book *booklist.Book) error {
+	if !atomic.CompareAndSwapUint32(&i.indexingActive, 0, 1) {
+		return ErrIndexingActive
+	}
+	defer atomic.StoreUint32(&i.indexingActive, 0)
+
+	return i.writeMetadata(book)
+}
+
+// writeMetadata implements WriteMetadata; the caller must have set indexingActive.
+func (i *Indexer) writeMetadata(book *booklist.Book) error {
+	if !formats.CanWrite(book.FilePath) {
+		return errors.Errorf("cannot write metadata into %s files", book.FileType())
+	}
+
+	cover, err := i.openCoverOverride(book)
+	if err != nil {
+		return err
+	}
+	if cover != nil {
+		defer cover.Close()
+	}
+
+	if err := formats.Write(book.FilePath, book.FilePath, book, cover); err != nil {
+		return errors.Wrapf(err, "error writing metadata to '%s'", book.FilePath)
+	}
+	if err := i.Reindex(book); err != nil {
+		return err
+	}
+	if err := i.pruneConverted(); err != nil && i.Verbose {
+		log.Printf("Error pruning converted books: %v", err)
+	}
+	return nil
+}
+
+// WriteAllMetadata writes the metadata from the index into each book whose file's metadata differs from it, as for
+// WriteMetadata, and returns the number of books written. Books in formats which cannot be written are skipped.
+func (i *Indexer) WriteAllMetadata() (int, []error, error) {
+	if !atomic.CompareAndSwapUint32(&i.indexingActive, 0, 1) {
+		return 0, nil, ErrIndexingActive
+	}
+	defer atomic.StoreUint32(&i.indexingActive, 0)
+
+	written := 0
+	errs := []error{}
+	for skip := 0; ; skip += writeBatchSize {
+		books, err := i.storage.Books.QueryDeps(storage.NewQuery().SortedBy("id", true).Skip(skip).Take(writeBatchSize))
+		if err != nil {
+			return written, errs, err
+		}
+
+		for _, book := range books {
+			if !formats.CanWrite(book.FilePath) {
+				continue
+			}
+
+			differs, err := i.metadataDiffers(book)
+			if err == nil && differs {
+				if i.Verbose {
+					log.Printf("Writing metadata to %s", book.FilePath)
+				}
+				if err = i.writeMetadata(book); err == nil {
+					written++
+				}
+			}
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "error writing metadata to '%s'", book.FilePath))
+			}
+		}
+
+		if len(books) < writeBatchSize {
+			break
+		}
+	}
+
+	return written, errs, nil
+}
+
+// EmbedMetadata returns a converter.Func which copies a book with its metadata from the index embedded in it, as
+// WriteMetadata writes it, without modifying the book's file. It also returns the revision of that metadata, which
+// changes whenever the metadata does, so that copies can be cached along with the book's hash. book must have been
+// queried along with its dependencies.
+func (i *Indexer) EmbedMetadata(book *booklist.Book) (string, converter.Func, error) {
+	if !formats.CanWrite(book.FilePath) {
+		return "", nil, errors.Errorf("cannot write metadata into %s files", book.FileType())
+	}
+
+	overrides, err := i.storage.Overrides.ByBook(book.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := sha1.New()
+	for _, field := range booklist.EditableFields {
+		if field != booklist.FieldCover {
+			fmt.Fprintf(h, "%s=%q\n", field, book.FieldValue(field))
+		}
+	}
+	coverpath := ""
+	for _, o := range overrides {
+		if o.Field == booklist.FieldCover && i.datapath != nil {
+			// the override's time is only stored to the second, so the image itself identifies the cover
+			coverpath = filepath.Join(*i.datapath, o.Value)
+			f, err := os.Open(coverpath)
+			if err != nil {
+				return "", nil, errors.Wrap(err, "could not open cover override")
+			}
+			fmt.Fprintf(h, "%s=", o.Field)
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return "", nil, errors.Wrap(err, "could not read cover override")
+			}
+		}
+	}
+	revision := fmt.Sprintf("%x", h.Sum(nil))[:16]
+
+	b := *book
+	return revision, func(src, dst string) error {
+		var cover io.Reader
+		if coverpath != "" {
+			f, err := os.Open(coverpath)
+			if err != nil {
+				return errors.Wrap(err, "could not open cover override")
+			}
+			defer f.Close()
+			cover = f
+		}
+		return formats.Write(src, dst, &b, cover)
+	}, nil
+}
+
+// openCoverOverride opens the image that replaced a book's cover, or returns nil if its cover wasn't replaced.
+func (i *Indexer) openCoverOverride(book *booklist.Book) (io.ReadCloser, error) {
+	if i.datapath == nil {
+		return nil, nil
+	}
+
+	overrides, err := i.storage.Overrides.ByBook(book.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		if o.Field == booklist.FieldCover {
+			f, err := os.Open(filepath.Join(*i.datapath, o.Value))
+			if err != nil {
+				return nil, errors.Wrap(err, "could not open cover override")
+			}
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// metadataDiffers reports whether the metadata in a book's file differs from the index, which is the case when the
+// book was edited or its metadata was cleaned up by the formatters, or whether its cover was replaced by an image that
+// isn't yet in the file.
+func (i *Indexer) metadataDiffers(book *booklist.Book) (bool, error) {
+	bi, err := formats.Load(book.FilePath)
+	if err != nil {
+		return false, errors.Wrap(err, "error loading book")
+	}
+
+	b := bi.Book()
+	for _, field := range booklist.EditableFields {
+		switch {
+		case field == booklist.FieldCover:
+			continue
+		case field == booklist.FieldPublishDate && book.PublishDate.IsZero():
+			// an unset date isn't written, so that dates which couldn't be parsed are kept
+			continue
+		}
+		if strings.TrimSpace(b.FieldValue(field)) != strings.TrimSpace(book.FieldValue(field)) {
+			return true, nil
+		}
+	}
+
+	cover, err := i.openCoverOverride(book)
+	if err != nil || cover == nil {
+		return false, err
+	}
+	defer cover.Close()
+	want, err := ioutil.ReadAll(cover)
+	if err != nil {
+		return false, errors.Wrap(err, "could not read cover override")
+	}
+	if !bi.HasCover() {
+		return true, nil
+	}
+	r, err := bi.GetCover()
+	if err != nil {
+		return true, nil
+	}
+	defer r.Close()
+	have, err := ioutil.ReadAll(r)
+	return err != nil || !bytes.Equal(have, want), nil
+}
@@ -104,6 +104,9 @@ App.prototype.doBook = function (url, opts) {
     console.log("doBook", url, opts);
     this.doReset();
 
+    // positions are synced with the BookBrowser server when reading a book downloaded from it
+    if (typeof BookBrowserPosition !== "undefined") this.state.bookID = BookBrowserPosition.bookID(url);
+
     try {
         this.state.book = ePub(url, opts);
         this.qs(".book").innerHTML = "";
@@ -556,16 +559,32 @@ App.prototype.onRenditionRelocatedUpdateIndicators = function (event) {
 
 App.prototype.onRenditionRelocatedSavePos = function (event) {
     localStorage.setItem(`${this.state.book.key()}:pos`, event.start.cfi);
+    if (this.state.bookID && this.state.restoredPos) {
+        let percentage = this.state.book.locations.length() > 0 ? this.state.book.locations.percentageFromCfi(event.start.cfi) : 0;
+        BookBrowserPosition.save(this.state.bookID, event.start.cfi, percentage);
+    }
 };
 
 App.prototype.onRenditionStartedRestorePos = function (event) {
+    let stored = null;
     try {
-        let stored = localStorage.getItem(`${this.state.book.key()}:pos`);
+        stored = localStorage.getItem(`${this.state.book.key()}:pos`);
         console.log("storedPos", stored);
         if (stored) this.state.rendition.display(stored);
     } catch (err) {
         this.fatal("error restoring position", err);
     }
+
+    if (!this.state.bookID) return;
+    // the position saved on the server may be from another device, so it takes precedence over the local one
+    BookBrowserPosition.load(this.state.bookID).then(pos => {
+        console.log("serverPos", pos);
+        if (pos && pos.position && pos.position != stored) return this.state.rendition.display(pos.position);
+    }).catch(err => {
+        console.warn("error loading position from server", err);
+    }).then(() => {
+        this.state.restoredPos = true;
+    });
 };
 
 App.prototype.checkDictionary = function () {
@@ -0,0 +1,31 @@
+// Restores and saves the page being read through the BookBrowser server (see ../../position.js).
+document.addEventListener("DOMContentLoaded", function () {
+    "use strict";
+
+    var id = BookBrowserPosition.bookID(decodeURIComponent(location.search));
+    if (!id) return;
+
+    var app = window.PDFViewerApplication;
+    var wait = window.setInterval(function () {
+        if (!app.initialized || !app.eventBus) return;
+        window.clearInterval(wait);
+
+        // don't save the first page while the saved position is still being loaded
+        var restored = false;
+        app.eventBus.on("pagesinit", function () {
+            BookBrowserPosition.load(id).then(function (pos) {
+                var page = pos ? parseInt(pos.position, 10) : 0;
+                if (page > 0 && page <= app.pagesCount) app.page = page;
+            }).catch(function (err) {
+                console.warn("error loading position", err);
+            }).then(function () {
+                restored = true;
+            });
+        });
+
+        app.eventBus.on("pagechanging", function (evt) {
+            if (!restored || !app.pagesCount) return;
+            BookBrowserPosition.save(id, evt.pageNumber.toString(), evt.pageNumber / app.pagesCount);
+        });
+    }, 50);
+}, true);
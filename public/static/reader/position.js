@@ -0,0 +1,54 @@
+// Synchronizes the built-in readers' position in a book with the BookBrowser server, so that reading can continue
+// on another device.
+var BookBrowserPosition = (function () {
+    "use strict";
+
+    var saveTimer = null;
+
+    function endpoint(id) {
+        return "/api/v1/books/" + id + "/position";
+    }
+
+    return {
+        // bookID returns the ID of the book being read from its download URL, or null if it isn't a BookBrowser
+        // download.
+        bookID: function (url) {
+            var m = /\/download\/(\d+)\./.exec(url || "");
+            return m ? m[1] : null;
+        },
+
+        // load resolves to the position saved on the server ({position, percentage, updated}), or null if there
+        // isn't one.
+        load: function (id) {
+            return fetch(endpoint(id), {
+                credentials: "same-origin"
+            }).then(function (resp) {
+                if (resp.status == 404) return null;
+                if (resp.status != 200) throw new Error("response status: " + resp.status.toString() + " " + resp.statusText);
+                return resp.json();
+            });
+        },
+
+        // save saves the position to the server. Saves are delayed slightly so that turning several pages quickly
+        // only saves the last one.
+        save: function (id, position, percentage) {
+            if (saveTimer) window.clearTimeout(saveTimer);
+            saveTimer = window.setTimeout(function () {
+                saveTimer = null;
+                fetch(endpoint(id), {
+                    method: "PUT",
+                    credentials: "same-origin",
+                    headers: {
+                        "Content-Type": "application/json"
+                    },
+                    body: JSON.stringify({
+                        position: position,
+                        percentage: percentage || 0
+                    })
+                }).catch(function (err) {
+                    console.warn("error saving position", err);
+                });
+            }, 2000);
+        }
+    };
+})();
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// The JSON API deliberately exposes its own representations of the booklist models rather than the models
+// themselves, so that internal fields (such as the book's path on the server) are never leaked to clients and the
+// models can change without breaking API consumers.
+
+type apiAuthor struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	SortName string `json:"sort_name,omitempty"`
+}
+
+type apiContributor struct {
+	apiAuthor
+	Role string `json:"role"`
+}
+
+type apiSeries struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Index *float64 `json:"index,omitempty"`
+}
+
+type apiPublisher struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiBookLinks struct {
+	Download  string `json:"download"`
+	Kepub     string `json:"kepub,omitempty"`
+	Cover     string `json:"cover,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	HTML      string `json:"html"`
+}
+
+type apiBook struct {
+	ID           int               `json:"id"`
+	Title        string            `json:"title"`
+	Author       *apiAuthor        `json:"author,omitempty"`
+	Contributors []*apiContributor `json:"contributors,omitempty"`
+	Series       *apiSeries        `json:"series,omitempty"`
+	Publisher    *apiPublisher     `json:"publisher,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	ISBN         string            `json:"isbn,omitempty"`
+	PublishDate  *time.Time        `json:"publish_date,omitempty"`
+	ImportDate   *time.Time        `json:"import_date,omitempty"`
+	ModTime      *time.Time        `json:"modified,omitempty"`
+	FileType     string            `json:"file_type"`
+	FileSize     int64             `json:"file_size"`
+	Hash         string            `json:"hash"`
+	HasCover     bool              `json:"has_cover"`
+	Links        apiBookLinks      `json:"links"`
+}
+
+type apiList struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// apiTime returns nil for unset times so that they are omitted from the JSON output.
+func apiTime(t time.Time) *time.Time {
+	if t.IsZero() || t.Unix() <= 0 {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func newAPIAuthor(a *booklist.Author) *apiAuthor {
+	return &apiAuthor{ID: a.ID, Name: a.Name, SortName: a.SortName}
+}
+
+func newAPISeries(s *booklist.Series) *apiSeries {
+	return &apiSeries{ID: s.ID, Name: s.Name}
+}
+
+// newAPIBook converts a book to its API representation; the book should have been loaded with QueryDeps.
+func newAPIBook(b *booklist.Book) *apiBook {
+	ab := &apiBook{
+		ID:          b.ID,
+		Title:       b.Title,
+		Description: b.Description,
+		ISBN:        b.ISBN,
+		PublishDate: apiTime(b.PublishDate),
+		ImportDate:  apiTime(b.ImportDate),
+		ModTime:     apiTime(b.ModTime),
+		FileType:    b.FileType(),
+		FileSize:    b.FileSize,
+		Hash:        b.Hash,
+		HasCover:    b.HasCover,
+		Links: apiBookLinks{
+			Download: fmt.Sprintf("/download/%d.%s", b.ID, b.FileType()),
+			HTML:     fmt.Sprintf("/books/%d", b.ID),
+		},
+	}
+
+	if b.AuthorID != 0 && b.Author != nil {
+		ab.Author = newAPIAuthor(b.Author)
+	}
+	for _, c := range b.Contributors {
+		ab.Contributors = append(ab.Contributors, &apiContributor{apiAuthor: *newAPIAuthor(c.Author), Role: c.Role})
+	}
+	for _, t := range b.Tags {
+		ab.Tags = append(ab.Tags, t.Name)
+	}
+	if b.SeriesID != 0 && b.Series != nil {
+		ab.Series = newAPISeries(b.Series)
+		index := b.SeriesIndex
+		ab.Series.Index = &index
+	}
+	if b.PublisherID != 0 && b.Publisher != nil {
+		ab.Publisher = &apiPublisher{ID: b.Publisher.ID, Name: b.Publisher.Name}
+	}
+
+	if b.FileType() == "epub" {
+		ab.Links.Kepub = fmt.Sprintf("/download/%d.kepub.epub", b.ID)
+	}
+	if b.HasCover {
+		ab.Links.Cover = "/covers/" + b.Hash + ".jpg"
+		ab.Links.Thumbnail = "/covers/" + b.Hash + "_thumb.jpg"
+	}
+
+	return ab
+}
+
+func newAPIBooks(bl []*booklist.Book) []*apiBook {
+	r := make([]*apiBook, len(bl))
+	for k, b := range bl {
+		r[k] = newAPIBook(b)
+	}
+	return r
+}
+
+func newAPIAuthors(al []*booklist.Author) []*apiAuthor {
+	r := make([]*apiAuthor, len(al))
+	for k, a := range al {
+		r[k] = newAPIAuthor(a)
+	}
+	return r
+}
+
+func newAPISeriesList(sl []*booklist.Series) []*apiSeries {
+	r := make([]*apiSeries, len(sl))
+	for k, s := range sl {
+		r[k] = newAPISeries(s)
+	}
+	return r
+}
+
+func newAPIList(p *Pagination, items interface{}) *apiList {
+	return &apiList{
+		Total:  p.ItemTotal,
+		Offset: p.ItemOffset,
+		Limit:  p.ItemLimit,
+		Items:  items,
+	}
+}
+
+// apiError responds with a JSON error message; server errors are logged rather than being shown to the client.
+func (s *Server) apiError(w http.ResponseWriter, status int, err error) {
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Printf("API error: %v", err)
+		message = "Error handling request"
+	}
+	s.render.JSON(w, status, &apiErrorResponse{Error: message})
+}
+
+// apiSort parses the request's sort parameter as parseUserSort does. If the sort key isn't one of the columns accepted
+// by sortable, it responds with an error and ok is false.
+func (s *Server) apiSort(w http.ResponseWriter, r *http.Request, defaultKey string, defaultAscending bool, sortable func(string) bool) (key string, ascending bool, ok bool) {
+	key, ascending = parseUserSort(r.URL.Query().Get("sort"), defaultKey, defaultAscending)
+	if !sortable(key) {
+		s.apiError(w, http.StatusBadRequest, fmt.Errorf("cannot sort by %q", key))
+		return "", false, false
+	}
+	return key, ascending, true
+}
+
+// apiBookList responds with a page of books matching query.
+func (s *Server) apiBookList(w http.ResponseWriter, r *http.Request, query *storage.Query) {
+	if !s.apiFilterLibrary(w, r, query) {
+		return
+	}
+
+	total, err := s.storage.Books.Count(query)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, fmt.Errorf("count-books: %v", err))
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+	bl, err := s.storage.Books.QueryDeps(query)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, fmt.Errorf("query-books: %v", err))
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIList(pagination, newAPIBooks(bl)))
+}
+
+func (s *Server) handleAPIBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "importdate", false, s.storage.Books.Sortable)
+	if !ok {
+		return
+	}
+	s.apiBookList(w, r, storage.NewQuery().SortedBy(userSortKey, userSortAsc))
+}
+
+func (s *Server) handleAPIBook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().Filtered("id", p.ByName("id"), true))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(bl) == 0 {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIBook(bl[0]))
+}
+
+func (s *Server) handleAPIAuthors(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "sortname", true, s.storage.Authors.Sortable)
+	if !ok {
+		return
+	}
+	s.apiAuthorList(w, r, storage.NewQuery().SortedBy(userSortKey, userSortAsc))
+}
+
+// apiAuthorList responds with a page of authors matching query.
+func (s *Server) apiAuthorList(w http.ResponseWriter, r *http.Request, query *storage.Query) {
+	total, err := s.storage.Authors.Count(query)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	al, err := s.storage.Authors.Query(query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIList(pagination, newAPIAuthors(al)))
+}
+
+func (s *Server) handleAPIAuthor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	authors, err := s.storage.Authors.Query(storage.NewQuery().Filtered("id", p.ByName("id"), true))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(authors) == 0 {
+		s.apiError(w, http.StatusNotFound, errors.New("author not found"))
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIAuthor(authors[0]))
+}
+
+func (s *Server) handleAPIAuthorBooks(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	aid, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		s.apiError(w, http.StatusNotFound, errors.New("author not found"))
+		return
+	}
+
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "title", true, s.storage.Books.Sortable)
+	if !ok {
+		return
+	}
+
+	query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+	if !s.apiFilterLibrary(w, r, query) {
+		return
+	}
+	total, err := s.storage.Books.CountByContributor(aid, query)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	bl, err := s.storage.Books.QueryByContributor(aid, query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIList(pagination, newAPIBooks(bl)))
+}
+
+func (s *Server) handleAPISeriess(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "name", true, s.storage.Series.Sortable)
+	if !ok {
+		return
+	}
+	s.apiSeriesList(w, r, storage.NewQuery().SortedBy(userSortKey, userSortAsc))
+}
+
+// apiSeriesList responds with a page of series matching query.
+func (s *Server) apiSeriesList(w http.ResponseWriter, r *http.Request, query *storage.Query) {
+	total, err := s.storage.Series.Count(query)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	sl, err := s.storage.Series.Query(query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIList(pagination, newAPISeriesList(sl)))
+}
+
+func (s *Server) handleAPISeries(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	seriess, err := s.storage.Series.Query(storage.NewQuery().Filtered("id", p.ByName("id"), true))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(seriess) == 0 {
+		s.apiError(w, http.StatusNotFound, errors.New("series not found"))
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPISeries(seriess[0]))
+}
+
+func (s *Server) handleAPISeriesBooks(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "seriesindex", true, s.storage.Books.Sortable)
+	if !ok {
+		return
+	}
+	s.apiBookList(w, r, storage.NewQuery().Filtered("seriesid", p.ByName("id"), true).SortedBy(userSortKey, userSortAsc))
+}
+
+func (s *Server) handleAPISearchBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query().Get("q")
+	if len(q) == 0 {
+		s.apiError(w, http.StatusBadRequest, errors.New("missing search query"))
+		return
+	}
+
+	relevance := s.storage.Books.KeywordRelevance()
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, s.keywordSortKey(), true, func(column string) bool {
+		return (column == "relevance" && relevance) || s.storage.Books.Sortable(column)
+	})
+	if !ok {
+		return
+	}
+
+	query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+	if !s.apiFilterLibrary(w, r, query) {
+		return
+	}
+	total, err := s.storage.Books.CountKeyword(q, query)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	bl, err := s.storage.Books.QueryKeyword(q, query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, newAPIList(pagination, newAPIBooks(bl)))
+}
+
+func (s *Server) handleAPISearchAuthors(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query().Get("q")
+	if len(q) == 0 {
+		s.apiError(w, http.StatusBadRequest, errors.New("missing search query"))
+		return
+	}
+
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "name", true, s.storage.Authors.Sortable)
+	if !ok {
+		return
+	}
+	s.apiAuthorList(w, r, storage.NewQuery().Filtered("name", q, false).SortedBy(userSortKey, userSortAsc))
+}
+
+func (s *Server) handleAPISearchSeries(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query().Get("q")
+	if len(q) == 0 {
+		s.apiError(w, http.StatusBadRequest, errors.New("missing search query"))
+		return
+	}
+
+	userSortKey, userSortAsc, ok := s.apiSort(w, r, "name", true, s.storage.Series.Sortable)
+	if !ok {
+		return
+	}
+	s.apiSeriesList(w, r, storage.NewQuery().Filtered("name", q, false).SortedBy(userSortKey, userSortAsc))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apiBookPage is a page of books as returned by the API.
+type apiBookPage struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Items  []*apiBook `json:"items"`
+}
+
+// getAPI requests path from the API, checks the response's status and decodes it into v.
+func getAPI(t *testing.T, s *Server, path string, status int, v interface{}) {
+	w := get(s, path, nil)
+	require.Equal(t, status, w.Code, "for %s: %s", path, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+}
+
+// titles returns the titles of the books on a page.
+func (p *apiBookPage) titles() []string {
+	titles := make([]string, len(p.Items))
+	for n, b := range p.Items {
+		titles[n] = b.Title
+	}
+	return titles
+}
+
+func TestAPIBooks(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	books := addTestBooks(t, s, stor, "Beta", "Alpha", "Gamma")
+
+	var page apiBookPage
+	getAPI(t, s, "/api/v1/books?sort=title-asc", http.StatusOK, &page)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, []string{"Alpha", "Beta", "Gamma"}, page.titles())
+
+	// pages are selected with offset and limit
+	page = apiBookPage{}
+	getAPI(t, s, "/api/v1/books?sort=title-desc&offset=1&limit=1", http.StatusOK, &page)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 1, page.Offset)
+	assert.Equal(t, 1, page.Limit)
+	assert.Equal(t, []string{"Beta"}, page.titles())
+	page = apiBookPage{}
+	getAPI(t, s, "/api/v1/books?sort=title-asc&offset=2&limit=2", http.StatusOK, &page)
+	assert.Equal(t, []string{"Gamma"}, page.titles())
+
+	// sort keys are checked rather than passed to the database
+	for _, path := range []string{"/api/v1/books?sort=bogus-asc", "/api/v1/books?sort=title%20DESC-asc", "/api/v1/search/books?q=a&sort=bogus-asc", "/api/v1/authors?sort=bogus-asc"} {
+		var e apiErrorResponse
+		getAPI(t, s, path, http.StatusBadRequest, &e)
+		assert.Contains(t, e.Error, "cannot sort by", "for %s", path)
+	}
+
+	var b apiBook
+	getAPI(t, s, fmt.Sprintf("/api/v1/books/%d", books[0].ID), http.StatusOK, &b)
+	assert.Equal(t, "Beta", b.Title)
+	require.NotNil(t, b.Author)
+	assert.Equal(t, "Jane Doe", b.Author.Name)
+	assert.Equal(t, "epub", b.FileType)
+	assert.Equal(t, fmt.Sprintf("/download/%d.epub", books[0].ID), b.Links.Download)
+	w := get(s, fmt.Sprintf("/api/v1/books/%d", books[0].ID), nil)
+	assert.NotContains(t, w.Body.String(), s.Libraries[0].Path, "the book's location on the server isn't exposed")
+
+	var e apiErrorResponse
+	getAPI(t, s, "/api/v1/books/9999", http.StatusNotFound, &e)
+	assert.Equal(t, "book not found", e.Error)
+
+	page = apiBookPage{}
+	getAPI(t, s, "/api/v1/search/books?q=gamma", http.StatusOK, &page)
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, []string{"Gamma"}, page.titles())
+	getAPI(t, s, "/api/v1/search/books", http.StatusBadRequest, &e)
+
+	var authors struct {
+		Total int          `json:"total"`
+		Items []*apiAuthor `json:"items"`
+	}
+	getAPI(t, s, "/api/v1/authors", http.StatusOK, &authors)
+	require.Equal(t, 1, authors.Total)
+	assert.Equal(t, "Jane Doe", authors.Items[0].Name)
+	page = apiBookPage{}
+	getAPI(t, s, fmt.Sprintf("/api/v1/authors/%d/books?sort=title-asc&limit=2", authors.Items[0].ID), http.StatusOK, &page)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, []string{"Alpha", "Beta"}, page.titles())
+}
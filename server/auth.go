@@ -0,0 +1,426 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+const (
+	sessionCookie   = "bookbrowser_session"
+	sessionLifetime = 30 * 24 * time.Hour
+)
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// currentUser returns the user who made the request, or nil if authentication is disabled.
+func currentUser(r *http.Request) *booklist.User {
+	user, _ := r.Context().Value(userContextKey).(*booklist.User)
+	return user
+}
+
+// EnableAuth requires users to sign in before using BookBrowser. If there are no users yet, an admin user is created
+// with a random password, which is logged.
+func (s *Server) EnableAuth() error {
+	total, err := s.storage.Users.Count(storage.NewQuery())
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		password, err := randomPassword()
+		if err != nil {
+			return err
+		}
+		admin := &booklist.User{Username: "admin", Admin: true}
+		if err := admin.SetPassword(password); err != nil {
+			return err
+		}
+		if err := s.storage.Users.Save(admin); err != nil {
+			return err
+		}
+		log.Printf("Created user \"admin\" with password \"%s\"; please change it after signing in", password)
+	}
+
+	s.auth = true
+
+	s.router.GET("/login", s.handleLogin)
+	s.router.POST("/login", s.handleLoginPost)
+	s.router.POST("/logout", s.handleLogout)
+
+	s.router.GET("/account", s.handleAccount)
+	s.router.POST("/account/password", s.handleAccountPassword)
+	s.router.POST("/account/token", s.handleAccountToken)
+
+	s.router.GET("/admin/users", s.requireAdmin(s.handleUsers))
+	s.router.POST("/admin/users", s.requireAdmin(s.handleUsersCreate))
+	s.router.POST("/admin/users/:id/delete", s.requireAdmin(s.handleUsersDelete))
+
+	return nil
+}
+
+// EnableProxyAuth trusts an authenticating reverse proxy (such as oauth2-proxy or Authelia) to identify users by the
+// username in header. The header is only trusted in requests from the proxies, which are given as IP addresses or
+// CIDR ranges as for SetTrustedProxies; users are created the first time the proxy identifies them. EnableAuth must
+// also be called.
+func (s *Server) EnableProxyAuth(header string, proxies []string) error {
+	if len(proxies) == 0 {
+		return fmt.Errorf("no trusted proxies specified")
+	}
+	if err := s.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+
+	s.proxyHeader = http.CanonicalHeaderKey(header)
+	return nil
+}
+
+// SetTrustedProxies sets the reverse proxies, given as IP addresses or CIDR ranges, whose X-Forwarded-Proto and
+// X-Forwarded-Host headers are trusted when building absolute URLs (see baseURL), along with the proxy
+// authentication header if it's enabled. These headers are ignored in requests from anywhere else.
+func (s *Server) SetTrustedProxies(proxies []string) error {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s: %v", proxy, err)
+		}
+		nets = append(nets, ipnet)
+	}
+
+	s.trustedProxies = nets
+	return nil
+}
+
+// isTrustedProxy returns true if the request was made directly by one of the trusted proxies.
+func (s *Server) isTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range s.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyUser returns the user named in the proxy header, creating them if they don't exist yet. Users created this way
+// have no password, so they can only sign in through the proxy or with an API token.
+func (s *Server) proxyUser(username string) (*booklist.User, error) {
+	user, err := s.storage.Users.ByUsername(username)
+	if user != nil || err != nil {
+		return user, err
+	}
+
+	user = &booklist.User{Username: username}
+	if err := s.storage.Users.Save(user); err != nil {
+		// another request may have created the user at the same time
+		if user, _ := s.storage.Users.ByUsername(username); user != nil {
+			return user, nil
+		}
+		return nil, err
+	}
+	log.Printf("Created user \"%s\" for reverse proxy authentication", username)
+	return user, nil
+}
+
+// isPublicPath returns true if path may be requested without signing in. Kobo e-readers can't sign in, so the Kobo API
+// checks the API token in its path itself.
+func isPublicPath(path string) bool {
+	return path == "/login" || path == kosyncPrefix+"/users/create" || strings.HasPrefix(path, "/static/") ||
+		strings.HasPrefix(path, koboPrefix)
+}
+
+// isClientPath returns true if path is normally requested by an e-reader app or API client rather than a browser, and
+// so should ask for HTTP authentication instead of redirecting to the login page.
+func isClientPath(path string) bool {
+	for _, prefix := range []string{"/opds", "/api/", "/download/", "/covers/", "/opensearch.xml"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate wraps next, identifying the user making each request from a trusted proxy's header (see
+// EnableProxyAuth), their session cookie, HTTP Basic credentials (with either their password or API token), an API
+// bearer token, or KOReader's sync credentials. Requests from unidentified users are rejected, except for the login
+// page, KOReader's registration and static files.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.identify(r)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		} else if !isPublicPath(r.URL.Path) {
+			if strings.HasPrefix(r.URL.Path, kosyncPrefix+"/") {
+				s.kosyncError(w, kosyncUnauthorized)
+			} else if isClientPath(r.URL.Path) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="BookBrowser", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identify returns the user making the request, or nil if the request has no valid credentials.
+func (s *Server) identify(r *http.Request) (*booklist.User, error) {
+	if s.proxyHeader != "" && s.isTrustedProxy(r) {
+		if username := strings.TrimSpace(r.Header.Get(s.proxyHeader)); username != "" {
+			return s.proxyUser(username)
+		}
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		user, err := s.storage.Users.BySession(c.Value)
+		if user != nil || err != nil {
+			return user, err
+		}
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		return s.checkCredentials(username, password)
+	}
+
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return s.storage.Users.ByToken(strings.TrimSpace(auth[7:]))
+	}
+
+	if username, key := r.Header.Get("X-Auth-User"), r.Header.Get("X-Auth-Key"); username != "" && key != "" {
+		return s.checkSyncKey(username, key)
+	}
+
+	return nil, nil
+}
+
+// checkCredentials returns the user with the given username if password is either their password or their API token,
+// or nil otherwise.
+func (s *Server) checkCredentials(username, password string) (*booklist.User, error) {
+	user, err := s.storage.Users.ByUsername(username)
+	if user == nil || err != nil {
+		return nil, err
+	}
+
+	if s.credentials.verified(user, password, user.PasswordHash) {
+		return user, nil
+	}
+	if user.CheckPassword(password) {
+		s.credentials.add(user, password, user.PasswordHash)
+		s.upgradeSyncKey(user, password)
+		return user, nil
+	}
+
+	token, err := s.storage.Users.ByToken(password)
+	if token != nil && token.ID == user.ID {
+		return user, nil
+	}
+	return nil, err
+}
+
+// checkSyncKey returns the user with the given username if key is their sync key (which KOReader sends in place of
+// their password), or nil otherwise.
+func (s *Server) checkSyncKey(username, key string) (*booklist.User, error) {
+	user, err := s.storage.Users.ByUsername(username)
+	if user == nil || err != nil {
+		return nil, err
+	}
+
+	if s.credentials.verified(user, key, user.SyncKeyHash) {
+		return user, nil
+	}
+	if user.CheckSyncKey(key) {
+		s.credentials.add(user, key, user.SyncKeyHash)
+		return user, nil
+	}
+	return nil, nil
+}
+
+// upgradeSyncKey sets the sync key of a user whose password was set before sync keys were introduced, now that their
+// password is known, so that they can sync their progress from KOReader.
+func (s *Server) upgradeSyncKey(user *booklist.User, password string) {
+	if user.SyncKeyHash != "" {
+		return
+	}
+	err := user.SetSyncKey(password)
+	if err == nil {
+		err = s.storage.Users.Save(user)
+	}
+	if err != nil {
+		log.Printf("Error setting sync key for user \"%s\": %v", user.Username, err)
+	}
+}
+
+// credentialCache remembers passwords which have recently been verified, since e-reader apps send their credentials
+// with every request and checking a bcrypt hash each time would make browsing noticeably slower.
+type credentialCache struct {
+	mu sync.Mutex
+	// hashed username and password (or sync key) => the hash it was verified against
+	entries map[string]string
+}
+
+func newCredentialCache() *credentialCache {
+	return &credentialCache{entries: make(map[string]string)}
+}
+
+func credentialKey(user *booklist.User, password string) string {
+	sum := sha256.Sum256([]byte(user.Username + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// verified returns true if password was previously verified for user against hash, and the user hasn't changed their
+// password since.
+func (c *credentialCache) verified(user *booklist.User, password, hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	verifiedHash, ok := c.entries[credentialKey(user, password)]
+	return ok && hash != "" && verifiedHash == hash
+}
+
+func (c *credentialCache) add(user *booklist.User, password, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[credentialKey(user, password)] = hash
+}
+
+// requireAdmin wraps handle so that it may only be used by admins.
+func (s *Server) requireAdmin(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if user := currentUser(r); user == nil || !user.Admin {
+			s.renderHTML(w, r, http.StatusForbidden, "notfound", map[string]interface{}{
+				"CurVersion":       s.version,
+				"PageTitle":        "Forbidden",
+				"ShowBar":          false,
+				"ShowSearch":       false,
+				"ShowViewSelector": false,
+				"Title":            "Forbidden",
+				"Message":          "Only admins may manage users.",
+			})
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// randomPassword generates a password for a new user.
+func randomPassword() (string, error) {
+	buf := make([]byte, 9)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// safeRedirect returns next if it is a path on this server, or / otherwise, so that the login page can't be used to
+// redirect users elsewhere.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if currentUser(r) != nil {
+		http.Redirect(w, r, safeRedirect(r.URL.Query().Get("next")), http.StatusSeeOther)
+		return
+	}
+	s.renderLogin(w, r, http.StatusOK, "")
+}
+
+func (s *Server) renderLogin(w http.ResponseWriter, r *http.Request, status int, message string) {
+	s.renderHTML(w, r, status, "login", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Sign In",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowViewSelector": false,
+		"Title":            "Sign In",
+		"Next":             r.FormValue("next"),
+		"Error":            message,
+	})
+}
+
+func (s *Server) handleLoginPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := s.storage.Users.ByUsername(r.PostFormValue("username"))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if user == nil || !user.CheckPassword(r.PostFormValue("password")) {
+		s.renderLogin(w, r, http.StatusUnauthorized, "Incorrect username or password.")
+		return
+	}
+	s.upgradeSyncKey(user, r.PostFormValue("password"))
+
+	token, err := s.storage.Users.NewSession(user, sessionLifetime)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	// SameSite prevents other sites from submitting forms (such as the account and admin forms) with the cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionLifetime),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusSeeOther)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := s.storage.Users.DeleteSession(c.Value); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
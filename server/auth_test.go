@@ -0,0 +1,187 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer creates a server for an empty library in a temporary directory, which is removed by cleanup.
+func newTestServer(t *testing.T) (s *Server, stor *storage.Storage, cleanup func()) {
+	dir, err := ioutil.TempDir("", "bookbrowser-server")
+	require.NoError(t, err)
+
+	library := filepath.Join(dir, "books")
+	data := filepath.Join(dir, "data")
+	require.NoError(t, os.Mkdir(library, 0755))
+	require.NoError(t, os.Mkdir(data, 0755))
+
+	stor, err = storage.New(filepath.Join(data, "test.db"))
+	require.NoError(t, err)
+	s = NewServer("127.0.0.1:0", stor, []Library{{Label: "books", Path: library}}, data, "test", false, true)
+
+	return s, stor, func() {
+		stor.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// whoami responds with the username of the user identified by authenticate.
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if user := currentUser(r); user != nil {
+		io.WriteString(w, user.Username)
+	}
+})
+
+func TestAuthenticate(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	require.NoError(t, s.EnableAuth())
+
+	reader := &booklist.User{Username: "reader"}
+	require.NoError(t, reader.SetPassword("secret"))
+	require.NoError(t, stor.Users.Save(reader))
+	token, err := stor.Users.NewToken(reader)
+	require.NoError(t, err)
+	session, err := stor.Users.NewSession(reader, time.Hour)
+	require.NoError(t, err)
+
+	handler := s.authenticate(whoami)
+	tests := []struct {
+		name     string
+		path     string
+		setup    func(r *http.Request)
+		status   int
+		user     string
+		location string
+	}{
+		{name: "session cookie", path: "/books", setup: func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+		}, status: http.StatusOK, user: "reader"},
+		{name: "unknown session", path: "/books", setup: func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "bogus"})
+		}, status: http.StatusSeeOther, location: "/login?next=%2Fbooks"},
+		{name: "basic password", path: "/opds", setup: func(r *http.Request) {
+			r.SetBasicAuth("reader", "secret")
+		}, status: http.StatusOK, user: "reader"},
+		{name: "basic username is case-insensitive", path: "/opds", setup: func(r *http.Request) {
+			r.SetBasicAuth("Reader", "secret")
+		}, status: http.StatusOK, user: "reader"},
+		{name: "basic token", path: "/opds", setup: func(r *http.Request) {
+			r.SetBasicAuth("reader", token)
+		}, status: http.StatusOK, user: "reader"},
+		{name: "basic token for another user", path: "/opds", setup: func(r *http.Request) {
+			r.SetBasicAuth("admin", token)
+		}, status: http.StatusUnauthorized},
+		{name: "basic wrong password", path: "/opds", setup: func(r *http.Request) {
+			r.SetBasicAuth("reader", "wrong")
+		}, status: http.StatusUnauthorized},
+		{name: "bearer token", path: "/api/v1/books", setup: func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}, status: http.StatusOK, user: "reader"},
+		{name: "bearer wrong token", path: "/api/v1/books", setup: func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer wrong")
+		}, status: http.StatusUnauthorized},
+
+		// browsers are sent to the login page, while clients are asked for credentials
+		{name: "page redirects", path: "/books/1?x=y", status: http.StatusSeeOther, location: "/login?next=%2Fbooks%2F1%3Fx%3Dy"},
+		{name: "opds asks", path: "/opds/books", status: http.StatusUnauthorized},
+		{name: "api asks", path: "/api/v1/books", status: http.StatusUnauthorized},
+		{name: "download asks", path: "/download/1.epub", status: http.StatusUnauthorized},
+		{name: "cover asks", path: "/covers/abc.jpg", status: http.StatusUnauthorized},
+
+		// pages that are needed to sign in, and APIs which check credentials themselves
+		{name: "login is public", path: "/login", status: http.StatusOK},
+		{name: "static is public", path: "/static/style.css", status: http.StatusOK},
+		{name: "kosync registration is public", path: kosyncPrefix + "/users/create", status: http.StatusOK},
+		{name: "kobo is public", path: koboPrefix + "token/v1/initialization", status: http.StatusOK},
+		{name: "kosync is not public", path: kosyncPrefix + "/users/auth", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.setup != nil {
+				test.setup(r)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, test.status, w.Code)
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.user, w.Body.String())
+			}
+			if test.location != "" {
+				assert.Equal(t, test.location, w.Header().Get("Location"))
+			}
+			if test.status == http.StatusUnauthorized && isClientPath(test.path) {
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+			}
+		})
+	}
+}
+
+func TestAuthenticateProxy(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	require.NoError(t, s.EnableAuth())
+	require.NoError(t, s.EnableProxyAuth("X-Forwarded-User", []string{"10.0.0.0/8", "::1"}))
+
+	handler := s.authenticate(whoami)
+	request := func(remoteAddr, username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/books", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-User", username)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// requests from a trusted proxy identify the user, who is created the first time
+	w := request("10.1.2.3:4567", "proxied")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "proxied", w.Body.String())
+	w = request("[::1]:4567", "proxied")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "proxied", w.Body.String())
+	user, err := stor.Users.ByUsername("proxied")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+
+	// the header is ignored in requests from anywhere else
+	for _, remoteAddr := range []string{"192.168.1.1:4567", "[::2]:4567", "11.0.0.1:4567", "bogus"} {
+		w = request(remoteAddr, "admin")
+		assert.Equal(t, http.StatusSeeOther, w.Code, "from %s", remoteAddr)
+		assert.Equal(t, "/login?next=%2Fbooks", w.Header().Get("Location"), "from %s", remoteAddr)
+	}
+	w = request("192.168.1.1:4567", "intruder")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	user, err = stor.Users.ByUsername("intruder")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := map[string]string{
+		"":                         "/",
+		"/books/1":                 "/books/1",
+		"/search?q=dune":           "/search?q=dune",
+		"//evil.example.com":       "/",
+		"/\\evil.example.com":      "/",
+		"https://evil.example.com": "/",
+		"evil.example.com":         "/",
+	}
+	for next, expected := range tests {
+		assert.Equal(t, expected, safeRedirect(next), "for %q", next)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"log"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/converter"
+	"github.com/sblinch/BookBrowser/formats"
+)
+
+// convertFormats lists the formats that EPUBs can be converted to using the Converter.
+var convertFormats = map[string]bool{
+	"mobi": true,
+	"azw3": true,
+}
+
+// canConvert reports whether the book can be converted to the given format.
+func (s *Server) canConvert(b *booklist.Book, format string) bool {
+	return s.Converter != "" && convertFormats[format] && b.FileType() == "epub"
+}
+
+// embedMetadata adapts the conversion of a book to the given cache format so that the book's metadata from the index
+// is embedded in it first, when EmbedMetadata is enabled and metadata can be written into the book. convert may be nil
+// for a copy of the book in its own format. It returns the cache format and conversion to use instead, along with the
+// revision of the embedded metadata, which is empty if none is embedded.
+func (s *Server) embedMetadata(b *booklist.Book, format string, convert converter.Func) (string, converter.Func, string, error) {
+	if !s.EmbedMetadata || !formats.CanWrite(b.FilePath) {
+		return format, convert, "", nil
+	}
+
+	revision, embed, err := s.Indexer.EmbedMetadata(b)
+	if err != nil {
+		return "", nil, "", err
+	}
+	embedded := "meta-" + revision + "." + b.FileType()
+	if convert == nil {
+		return embedded, embed, revision, nil
+	}
+
+	// convert the cached copy with the embedded metadata, rather than the book itself
+	return "meta-" + revision + "." + format, func(src, dst string) error {
+		f, err := s.Converted.Open(src, b.Hash, embedded, embed)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return convert(f.Name(), dst)
+	}, revision, nil
+}
+
+// recordDigest records KOReader's digest of a downloaded copy of a book with its metadata embedded, which differs from
+// that of the book's file, so that progress synced from KOReader in the copy is shown for the book. Errors are only
+// logged, since they don't prevent the download.
+func (s *Server) recordDigest(b *booklist.Book, filename string) {
+	digest, err := formats.PartialMD5(filename)
+	if err == nil && digest != b.PartialMD5 {
+		err = s.storage.KOSync.AddDigest(b.ID, digest)
+	}
+	if err != nil {
+		log.Printf("Error recording the digest of %s: %v", filename, err)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// the cookie and form field holding the token which forms that change books must be submitted with
+	csrfCookie = "bookbrowser_csrf"
+	csrfField  = "csrf"
+	// the header which API POST requests that change books must be sent with
+	csrfHeader = "X-Requested-With"
+)
+
+// csrfToken returns the token which forms must be submitted with, setting the cookie holding it if the browser doesn't
+// have one yet. Another site can submit a form to the server, but can neither read the cookie nor set it, so it can't
+// submit the matching token; this protects forms which are usable without signing in, when there's no session
+// cookie for SameSite to protect.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	token := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// validCSRF reports whether a form was submitted with the token from the browser's cookie. The form must already have
+// been parsed if it is multipart.
+func validCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostFormValue(csrfField))) == 1
+}
+
+// checkCSRF reports whether a form was submitted with a valid token (see validCSRF), and responds with an error if it
+// wasn't.
+func (s *Server) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if validCSRF(r) {
+		return true
+	}
+	s.renderForbidden(w, r, "This form has expired. Go back, reload the page and try again.")
+	return false
+}
+
+// requireCSRFHeader wraps an API handle so that requests must be sent with csrfHeader. Another site can make a browser
+// POST a form or an empty body to the API, but it can only add a custom header after a CORS preflight, which the server
+// never allows; this protects POST endpoints which are usable without signing in.
+func (s *Server) requireCSRFHeader(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r.Header.Get(csrfHeader) == "" {
+			s.apiError(w, http.StatusForbidden, fmt.Errorf("the %s header is required", csrfHeader))
+			return
+		}
+		handle(w, r, p)
+	}
+}
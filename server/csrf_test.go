@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRF(t *testing.T) {
+	// a token is issued once, and then reused
+	w := httptest.NewRecorder()
+	token := csrfToken(w, httptest.NewRequest(http.MethodGet, "/books/1/edit", nil))
+	assert.Len(t, token, 32)
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, csrfCookie, cookies[0].Name)
+		assert.Equal(t, token, cookies[0].Value)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/books/1/edit", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	w = httptest.NewRecorder()
+	assert.Equal(t, token, csrfToken(w, r))
+	assert.Empty(t, w.Result().Cookies())
+
+	post := func(cookie, field string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/books/1/write", strings.NewReader(url.Values{csrfField: {field}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+		}
+		return r
+	}
+	assert.True(t, validCSRF(post(token, token)))
+	assert.False(t, validCSRF(post(token, "")))
+	assert.False(t, validCSRF(post(token, "forged")))
+	assert.False(t, validCSRF(post("", token)))
+	assert.False(t, validCSRF(post("", "")))
+}
+
+func TestRequireWriter(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	status := func(handle httprouter.Handle) int {
+		w := httptest.NewRecorder()
+		handle(w, httptest.NewRequest(http.MethodPost, "/books/1/write", nil), nil)
+		return w.Code
+	}
+
+	// without authentication, books' files may only be written if that was allowed
+	assert.Equal(t, http.StatusForbidden, status(s.requireWriter(ok)))
+	assert.Equal(t, http.StatusForbidden, status(s.requireAPIWriter(ok)))
+	assert.Equal(t, http.StatusOK, status(s.requireEditor(ok)))
+
+	s.AllowWrite = true
+	assert.Equal(t, http.StatusOK, status(s.requireWriter(ok)))
+	assert.Equal(t, http.StatusOK, status(s.requireAPIWriter(ok)))
+}
+
+func TestRequireUploader(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	status := func(handle httprouter.Handle) int {
+		w := httptest.NewRecorder()
+		handle(w, httptest.NewRequest(http.MethodPost, "/upload", nil), nil)
+		return w.Code
+	}
+
+	// without authentication, books may only be uploaded if that was allowed
+	assert.Equal(t, http.StatusForbidden, status(s.requireUploader(ok)))
+	assert.Equal(t, http.StatusForbidden, status(s.requireAPIUploader(ok)))
+
+	s.AllowUpload = true
+	assert.Equal(t, http.StatusOK, status(s.requireUploader(ok)))
+	assert.Equal(t, http.StatusOK, status(s.requireAPIUploader(ok)))
+}
+
+func TestRequireCSRFHeader(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	handle := s.requireCSRFHeader(ok)
+
+	// a form another site submits can't include the header
+	w := httptest.NewRecorder()
+	handle(w, httptest.NewRequest(http.MethodPost, "/api/v1/books/1/write", nil), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/books/1/write", nil)
+	r.Header.Set(csrfHeader, "XMLHttpRequest")
+	w = httptest.NewRecorder()
+	handle(w, r, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
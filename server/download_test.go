@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// get requests path from the server with the specified headers.
+func get(s *Server, path string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestDownload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test converter is a shell script")
+	}
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	b := addTestBooks(t, s, stor, "Dragon Tales")[0]
+
+	// a stand-in for ebook-convert which copies the book
+	s.Converter = filepath.Join(s.DataDir, "convert.sh")
+	require.NoError(t, ioutil.WriteFile(s.Converter, []byte("#!/bin/sh\ncp \"$1\" \"$2\"\n"), 0755))
+
+	paths := map[string]string{
+		"original":  fmt.Sprintf("/download/%d.epub", b.ID),
+		"kepub":     fmt.Sprintf("/download/%d.kepub.epub", b.ID),
+		"converted": fmt.Sprintf("/download/%d.azw3", b.ID),
+	}
+	for name, path := range paths {
+		t.Run(name, func(t *testing.T) {
+			w := get(s, path, nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			content := w.Body.Bytes()
+			require.True(t, len(content) > 20)
+			tag := w.Header().Get("ETag")
+			require.NotEmpty(t, tag)
+			assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+
+			// a copy the client already has is still current
+			w = get(s, path, map[string]string{"If-None-Match": tag})
+			assert.Equal(t, http.StatusNotModified, w.Code)
+			assert.Empty(t, w.Body.Bytes())
+
+			w = get(s, path, map[string]string{"Range": "bytes=10-19"})
+			assert.Equal(t, http.StatusPartialContent, w.Code)
+			assert.Equal(t, content[10:20], w.Body.Bytes())
+			assert.Equal(t, fmt.Sprintf("bytes 10-19/%d", len(content)), w.Header().Get("Content-Range"))
+
+			// an interrupted download resumes only if the copy hasn't changed
+			w = get(s, path, map[string]string{"Range": "bytes=10-", "If-Range": tag})
+			assert.Equal(t, http.StatusPartialContent, w.Code)
+			assert.Equal(t, content[10:], w.Body.Bytes())
+			w = get(s, path, map[string]string{"Range": "bytes=10-", "If-Range": `"stale"`})
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, content, w.Body.Bytes())
+		})
+	}
+
+	original, err := ioutil.ReadFile(b.FilePath)
+	require.NoError(t, err)
+	w := get(s, paths["original"], nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, original, w.Body.Bytes())
+	tag := w.Header().Get("ETag")
+
+	// once the file changes, its indexed hash no longer identifies it, even before it's reindexed
+	writeTestEPUB(t, b.FilePath, "Dragon Tales, Revised", "Jane Doe")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(b.FilePath, later, later))
+	modified, err := ioutil.ReadFile(b.FilePath)
+	require.NoError(t, err)
+
+	w = get(s, paths["original"], map[string]string{"If-None-Match": tag})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, tag, w.Header().Get("ETag"))
+	w = get(s, paths["original"], map[string]string{"Range": "bytes=10-", "If-Range": tag})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, modified, w.Body.Bytes())
+}
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/formats"
+	"github.com/sblinch/BookBrowser/indexer"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// the largest cover image that may be uploaded
+const maxCoverSize = 20 * 1024 * 1024
+
+// fieldLabels are the editor's labels for the editable fields.
+var fieldLabels = map[string]string{
+	booklist.FieldTitle:       "Title",
+	booklist.FieldAuthors:     "Authors (one per line)",
+	booklist.FieldSeries:      "Series",
+	booklist.FieldSeriesIndex: "Series index",
+	booklist.FieldPublisher:   "Publisher",
+	booklist.FieldDescription: "Description",
+	booklist.FieldISBN:        "ISBN",
+	booklist.FieldPublishDate: "Publish date (YYYY-MM-DD)",
+	booklist.FieldCover:       "Cover",
+}
+
+// editField is one of the fields of a book shown in the editor.
+type editField struct {
+	Name     string
+	Label    string
+	Value    string
+	Override *booklist.Override
+}
+
+// Multiline reports whether the field is edited in a textarea.
+func (f editField) Multiline() bool {
+	return f.Name == booklist.FieldAuthors || f.Name == booklist.FieldDescription
+}
+
+// canEdit reports whether the user who made the request may edit books' metadata; when authentication is enabled,
+// only admins may.
+func (s *Server) canEdit(r *http.Request) bool {
+	if !s.auth {
+		return true
+	}
+	user := currentUser(r)
+	return user != nil && user.Admin
+}
+
+// canWrite reports whether the user who made the request may write books' metadata into their files. Since this
+// replaces the original files, it is only allowed without authentication if the server was configured to allow it.
+func (s *Server) canWrite(r *http.Request) bool {
+	return s.canEdit(r) && (s.auth || s.AllowWrite)
+}
+
+// renderForbidden responds with an error page explaining why the user may not do what they requested.
+func (s *Server) renderForbidden(w http.ResponseWriter, r *http.Request, message string) {
+	s.renderHTML(w, r, http.StatusForbidden, "notfound", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Forbidden",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowViewSelector": false,
+		"Title":            "Forbidden",
+		"Message":          message,
+	})
+}
+
+// requireEditor wraps handle so that it may only be used by users who may edit books.
+func (s *Server) requireEditor(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.canEdit(r) {
+			s.renderForbidden(w, r, "Only admins may edit books.")
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// requireWriter wraps handle so that it may only be used by users who may write metadata into books' files.
+func (s *Server) requireWriter(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.canWrite(r) {
+			s.renderForbidden(w, r, "Writing metadata into books' files is disabled.")
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// requireAPIEditor is the equivalent of requireEditor for API handlers.
+func (s *Server) requireAPIEditor(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.canEdit(r) {
+			s.apiError(w, http.StatusForbidden, errors.New("only admins may edit books"))
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// requireAPIWriter is the equivalent of requireWriter for API handlers.
+func (s *Server) requireAPIWriter(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.canWrite(r) {
+			s.apiError(w, http.StatusForbidden, errors.New("writing metadata into books' files is disabled"))
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// loadBook returns the book with the ID given in the route along with its dependencies, or nil if it doesn't exist.
+func (s *Server) loadBook(p httprouter.Params) (*booklist.Book, error) {
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().Filtered("id", p.ByName("id"), true))
+	if err != nil || len(bl) == 0 {
+		return nil, err
+	}
+	return bl[0], nil
+}
+
+// applyEdits sets the book's fields to the edited values, which are in the format returned by Book.FieldValue, and
+// returns overrides for those whose values changed. Fields which aren't in values are left unchanged.
+func applyEdits(r *http.Request, b *booklist.Book, values map[string]string) ([]*booklist.Override, error) {
+	overrides := []*booklist.Override{}
+	for _, field := range booklist.EditableFields {
+		value, ok := values[field]
+		if !ok || field == booklist.FieldCover {
+			continue
+		}
+
+		before := strings.TrimSpace(b.FieldValue(field))
+		if err := b.SetField(field, value); err != nil {
+			return nil, err
+		}
+		if after := b.FieldValue(field); after != before {
+			overrides = append(overrides, &booklist.Override{Field: field, Value: after, UserID: userID(r)})
+		}
+	}
+	return overrides, nil
+}
+
+// setCover replaces the book's cover with an uploaded image and returns the override recording it.
+func (s *Server) setCover(r *http.Request, b *booklist.Book, image io.Reader) (*booklist.Override, error) {
+	value, err := s.Indexer.SetCover(b, image)
+	if err != nil {
+		return nil, err
+	}
+	return &booklist.Override{Field: booklist.FieldCover, Value: value, UserID: userID(r)}, nil
+}
+
+// revertField removes the override for one of a book's fields and restores its value from the book's file.
+func (s *Server) revertField(b *booklist.Book, field string) error {
+	if err := s.storage.Overrides.Delete(b.ID, field); err != nil {
+		return err
+	}
+	return s.Indexer.Reindex(b)
+}
+
+func (s *Server) renderEdit(w http.ResponseWriter, r *http.Request, status int, b *booklist.Book, message string) {
+	overrides, err := s.storage.Overrides.ByBook(b.ID)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	byField := make(map[string]*booklist.Override, len(overrides))
+	for _, o := range overrides {
+		byField[o.Field] = o
+	}
+
+	fields := make([]editField, 0, len(booklist.EditableFields))
+	for _, field := range booklist.EditableFields {
+		if field == booklist.FieldCover && s.NoCovers {
+			continue
+		}
+		fields = append(fields, editField{
+			Name:     field,
+			Label:    fieldLabels[field],
+			Value:    b.FieldValue(field),
+			Override: byField[field],
+		})
+	}
+
+	s.renderHTML(w, r, status, "edit", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Edit " + b.Title,
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowAuthorSearch": false,
+		"ShowSeriesSearch": false,
+		"ShowViewSelector": false,
+		"Title":            "Edit Book",
+		"Book":             b,
+		"Fields":           fields,
+		"CanWrite":         formats.CanWrite(b.FilePath) && s.canWrite(r),
+		"Message":          message,
+	})
+}
+
+func (s *Server) handleBookEdit(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.renderEdit(w, r, http.StatusOK, b, "")
+}
+
+func (s *Server) handleBookEditPost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the form's other fields are small, so allow a little more than the largest cover
+	r.Body = http.MaxBytesReader(w, r.Body, maxCoverSize+1024*1024)
+	if err := r.ParseMultipartForm(maxCoverSize); err != nil && err != http.ErrNotMultipart {
+		s.renderEdit(w, r, http.StatusBadRequest, b, fmt.Sprintf("Invalid form: %v", err))
+		return
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if !s.checkCSRF(w, r) {
+		return
+	}
+	values := make(map[string]string, len(booklist.EditableFields))
+	for _, field := range booklist.EditableFields {
+		if v, ok := r.PostForm[field]; ok && len(v) > 0 {
+			values[field] = v[0]
+		}
+	}
+
+	overrides, err := applyEdits(r, b, values)
+	if err != nil {
+		s.renderEdit(w, r, http.StatusBadRequest, b, err.Error())
+		return
+	}
+
+	if f, _, err := r.FormFile(booklist.FieldCover); err == nil {
+		o, err := s.setCover(r, b, f)
+		f.Close()
+		if err != nil {
+			s.renderEdit(w, r, http.StatusBadRequest, b, err.Error())
+			return
+		}
+		overrides = append(overrides, o)
+	}
+
+	if len(overrides) > 0 {
+		if err := s.storage.Overrides.Edit(b, overrides...); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+	redirectToBook(w, r, b.ID)
+}
+
+// handleBookRevert removes the override for one of a book's fields.
+func (s *Server) handleBookRevert(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.checkCSRF(w, r) {
+		return
+	}
+	if field := r.PostFormValue("field"); booklist.IsEditableField(field) {
+		if err := s.revertField(b, field); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d/edit", b.ID), http.StatusSeeOther)
+}
+
+// handleBookWrite writes a book's metadata into its file.
+func (s *Server) handleBookWrite(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.checkCSRF(w, r) {
+		return
+	}
+	if err := s.Indexer.WriteMetadata(b); err == indexer.ErrIndexingActive {
+		s.renderEdit(w, r, http.StatusServiceUnavailable, b, "The library is being indexed; try again once it has finished.")
+		return
+	} else if err != nil {
+		s.renderEdit(w, r, http.StatusInternalServerError, b, err.Error())
+		return
+	}
+	redirectToBook(w, r, b.ID)
+}
+
+// apiBookEdit holds the fields to edit; fields which are omitted are left unchanged, and empty values clear them.
+type apiBookEdit struct {
+	Title       *string   `json:"title"`
+	Authors     *[]string `json:"authors"`
+	Series      *string   `json:"series"`
+	SeriesIndex *float64  `json:"series_index"`
+	Publisher   *string   `json:"publisher"`
+	Description *string   `json:"description"`
+	ISBN        *string   `json:"isbn"`
+	// YYYY-MM-DD, or an RFC 3339 time as returned by the API
+	PublishDate *string `json:"publish_date"`
+}
+
+// values returns the edited values in the format expected by Book.SetField.
+func (e *apiBookEdit) values() (map[string]string, error) {
+	values := map[string]string{}
+	set := func(field string, value *string) {
+		if value != nil {
+			values[field] = *value
+		}
+	}
+	set(booklist.FieldTitle, e.Title)
+	set(booklist.FieldSeries, e.Series)
+	set(booklist.FieldPublisher, e.Publisher)
+	set(booklist.FieldDescription, e.Description)
+	set(booklist.FieldISBN, e.ISBN)
+	if e.Authors != nil {
+		for _, name := range *e.Authors {
+			if strings.ContainsAny(name, "\r\n") {
+				return nil, errors.New("author names may not contain line breaks")
+			}
+		}
+		values[booklist.FieldAuthors] = strings.Join(*e.Authors, "\n")
+	}
+	if e.SeriesIndex != nil {
+		values[booklist.FieldSeriesIndex] = strconv.FormatFloat(*e.SeriesIndex, 'f', -1, 64)
+	}
+	if e.PublishDate != nil {
+		date := *e.PublishDate
+		if t, err := time.Parse(time.RFC3339, date); err == nil {
+			date = t.Format("2006-01-02")
+		}
+		values[booklist.FieldPublishDate] = date
+	}
+	return values, nil
+}
+
+type apiOverride struct {
+	Field   string     `json:"field"`
+	Value   string     `json:"value"`
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// sendAPIBook responds with the book with the specified ID.
+func (s *Server) sendAPIBook(w http.ResponseWriter, id int) {
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().In("id", []int{id}))
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(bl) == 0 {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+	s.render.JSON(w, http.StatusOK, newAPIBook(bl[0]))
+}
+
+func (s *Server) handleAPIEditBook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if b == nil {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+
+	var req apiBookEdit
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&req); err != nil {
+		s.apiError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	values, err := req.values()
+	if err != nil {
+		s.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	overrides, err := applyEdits(r, b, values)
+	if err != nil {
+		s.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(overrides) > 0 {
+		if err := s.storage.Overrides.Edit(b, overrides...); err != nil {
+			s.apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	s.sendAPIBook(w, b.ID)
+}
+
+func (s *Server) handleAPISetCover(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if b == nil {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+	if s.NoCovers {
+		s.apiError(w, http.StatusNotFound, errors.New("covers are disabled"))
+		return
+	}
+
+	o, err := s.setCover(r, b, io.LimitReader(r.Body, maxCoverSize))
+	if err != nil {
+		s.apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.storage.Overrides.Edit(b, o); err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.sendAPIBook(w, b.ID)
+}
+
+func (s *Server) handleAPIOverrides(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if b == nil {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+
+	overrides, err := s.storage.Overrides.ByBook(b.ID)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]*apiOverride, len(overrides))
+	for k, o := range overrides {
+		result[k] = &apiOverride{Field: o.Field, Value: o.Value, Updated: apiTime(o.Updated)}
+		if o.Field == booklist.FieldCover {
+			// don't expose the cover's location on the server
+			result[k].Value = "/covers/" + b.Hash + ".jpg"
+		}
+	}
+	s.render.JSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleAPIRevert(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if b == nil {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+	field := p.ByName("field")
+	if !booklist.IsEditableField(field) {
+		s.apiError(w, http.StatusNotFound, fmt.Errorf("field %q cannot be edited", field))
+		return
+	}
+
+	if err := s.revertField(b, field); err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.sendAPIBook(w, b.ID)
+}
+
+func (s *Server) handleAPIWriteBook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	b, err := s.loadBook(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if b == nil {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+	if !formats.CanWrite(b.FilePath) {
+		s.apiError(w, http.StatusBadRequest, fmt.Errorf("cannot write metadata into %s files", b.FileType()))
+		return
+	}
+
+	if err := s.Indexer.WriteMetadata(b); err == indexer.ErrIndexingActive {
+		s.apiError(w, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.sendAPIBook(w, b.ID)
+}
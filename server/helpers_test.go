@@ -0,0 +1,54 @@
+package server
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	_ "github.com/sblinch/BookBrowser/formats/epub"
+	"github.com/sblinch/BookBrowser/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestEPUB creates a minimal EPUB with the specified title and author.
+func writeTestEPUB(t *testing.T, filename, title, author string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	files := []struct{ name, content string }{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<?xml version="1.0"?><container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"content.opf", `<?xml version="1.0"?><package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf"><dc:title>` + title + `</dc:title><dc:creator opf:role="aut">` + author + `</dc:creator><dc:identifier id="id">` + title + `</dc:identifier></metadata><manifest><item id="c" href="c.xhtml" media-type="application/xhtml+xml"/></manifest><spine><itemref idref="c"/></spine></package>`},
+		{"c.xhtml", "<html><body><p>" + title + "</p></body></html>"},
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		require.NoError(t, err)
+		w.Write([]byte(file.content))
+	}
+	require.NoError(t, zw.Close())
+}
+
+// addTestBooks writes a book by Jane Doe with each of the specified titles to the server's library, indexes them, and
+// returns them in the order they were given.
+func addTestBooks(t *testing.T, s *Server, stor *storage.Storage, titles ...string) []*booklist.Book {
+	for _, title := range titles {
+		writeTestEPUB(t, filepath.Join(s.Libraries[0].Path, title+".epub"), title, "Jane Doe")
+	}
+	_, err := s.Indexer.Refresh()
+	require.NoError(t, err)
+
+	books := make([]*booklist.Book, len(titles))
+	for n, title := range titles {
+		bl, err := stor.Books.QueryDeps(storage.NewQuery().Filtered("title", title, true))
+		require.NoError(t, err)
+		require.Len(t, bl, 1, "book %q", title)
+		books[n] = bl[0]
+	}
+	return books
+}
@@ -0,0 +1,755 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// koboPrefix is where the Kobo sync API is mounted. A Kobo's api_endpoint should be set to this path on
+// BookBrowser's URL followed by the user's API token, which the Kobo includes in every request.
+const koboPrefix = "/kobo/"
+
+const (
+	// the most books added to a Kobo in one sync request; the Kobo keeps requesting until they've all been added
+	koboSyncLimit  = 100
+	koboTimeFormat = "2006-01-02T15:04:05Z"
+	// Kobos expect books and series to be identified by UUIDs, so their IDs are encoded into these
+	koboBookUUIDPrefix   = 0xb00cb00c
+	koboSeriesUUIDPrefix = 0x5e1e5000
+)
+
+func koboUUID(prefix uint32, id int) string {
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", prefix, id)
+}
+
+// parseKoboUUID returns the ID encoded in a UUID created by koboUUID, or 0 if uuid wasn't created with prefix.
+func parseKoboUUID(prefix uint32, uuid string) int {
+	p := fmt.Sprintf("%08x-0000-4000-8000-", prefix)
+	if len(uuid) != len(p)+12 || !strings.HasPrefix(uuid, p) {
+		return 0
+	}
+	id, err := strconv.ParseInt(uuid[len(p):], 16, 64)
+	if err != nil {
+		return 0
+	}
+	return int(id)
+}
+
+// parseKoboBookUUIDs returns the book IDs in a comma-separated list of book UUIDs, as used in Kobo API paths.
+func parseKoboBookUUIDs(uuids string) []int {
+	var ids []int
+	for _, uuid := range strings.Split(uuids, ",") {
+		if id := parseKoboUUID(koboBookUUIDPrefix, uuid); id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func koboTime(t time.Time) string {
+	return t.UTC().Format(koboTimeFormat)
+}
+
+// latestTime returns the latest of times.
+func latestTime(times ...time.Time) time.Time {
+	var latest time.Time
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// koboSyncToken is sent to the Kobo after each library sync and returned by it on the next, so that only changes
+// since the last sync are sent.
+type koboSyncToken struct {
+	LastSync int64 `json:"lastSync"`
+}
+
+// parseKoboSyncToken returns the request's sync token, and false if it has none (or has one from the Kobo store).
+func parseKoboSyncToken(r *http.Request) (koboSyncToken, bool) {
+	var token koboSyncToken
+	data, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Kobo-Synctoken"))
+	if err != nil || len(data) == 0 || json.Unmarshal(data, &token) != nil || token.LastSync == 0 {
+		return koboSyncToken{}, false
+	}
+	return token, true
+}
+
+func (t koboSyncToken) String() string {
+	data, _ := json.Marshal(t)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+type koboBookEntitlement struct {
+	Accessibility       string
+	ActivePeriod        map[string]string
+	Created             string
+	CrossRevisionID     string `json:"CrossRevisionId"`
+	ID                  string `json:"Id"`
+	IsHiddenFromArchive bool
+	IsLocked            bool
+	IsRemoved           bool
+	LastModified        string
+	OriginCategory      string
+	RevisionID          string `json:"RevisionId"`
+	Status              string
+}
+
+type koboContributor struct {
+	Name string
+}
+
+type koboDownloadURL struct {
+	Format   string
+	Size     int64
+	URL      string `json:"Url"`
+	Platform string
+}
+
+type koboPrice struct {
+	CurrencyCode string `json:",omitempty"`
+	TotalAmount  float64
+}
+
+type koboPublisher struct {
+	Imprint string
+	Name    string
+}
+
+type koboSeries struct {
+	ID          string `json:"Id"`
+	Name        string
+	Number      string
+	NumberFloat float64
+}
+
+type koboBookMetadata struct {
+	Categories              []string
+	ContributorRoles        []koboContributor
+	Contributors            []string
+	CoverImageID            string `json:"CoverImageId,omitempty"`
+	CrossRevisionID         string `json:"CrossRevisionId"`
+	CurrentDisplayPrice     koboPrice
+	CurrentLoveDisplayPrice koboPrice
+	Description             string
+	DownloadUrls            []koboDownloadURL
+	EntitlementID           string `json:"EntitlementId"`
+	ExternalIds             []string
+	Genre                   string
+	IsEligibleForKoboLove   bool
+	IsInternetArchive       bool
+	IsPreOrder              bool
+	IsSocialEnabled         bool
+	Isbn                    string `json:",omitempty"`
+	Language                string
+	PhoneticPronunciations  struct{}
+	PublicationDate         string `json:",omitempty"`
+	Publisher               koboPublisher
+	RevisionID              string      `json:"RevisionId"`
+	Series                  *koboSeries `json:",omitempty"`
+	Title                   string
+	WorkID                  string `json:"WorkId"`
+}
+
+type koboLocation struct {
+	Value  string
+	Type   string
+	Source string
+}
+
+type koboBookmark struct {
+	LastModified                 string
+	ProgressPercent              float64       `json:",omitempty"`
+	ContentSourceProgressPercent float64       `json:",omitempty"`
+	Location                     *koboLocation `json:",omitempty"`
+}
+
+type koboStatusInfo struct {
+	LastModified        string
+	Status              string
+	TimesStartedReading int
+}
+
+type koboStatistics struct {
+	LastModified string
+}
+
+type koboReadingState struct {
+	EntitlementID     string `json:"EntitlementId"`
+	Created           string
+	LastModified      string
+	PriorityTimestamp string
+	StatusInfo        koboStatusInfo
+	Statistics        koboStatistics
+	CurrentBookmark   koboBookmark
+}
+
+// koboEntitlement is a book added to or changed on the Kobo by a library sync.
+type koboEntitlement struct {
+	BookEntitlement *koboBookEntitlement
+	BookMetadata    *koboBookMetadata `json:",omitempty"`
+	ReadingState    *koboReadingState `json:",omitempty"`
+}
+
+// koboEndpoint returns the URL of the Kobo API as used by the Kobo making the request.
+func (s *Server) koboEndpoint(r *http.Request, token string) string {
+	return s.baseURL(r) + koboPrefix + url.PathEscape(token)
+}
+
+// matchKoboPath returns true if the segments of a request path match pattern, in which "*" matches any segment.
+func matchKoboPath(parts []string, pattern ...string) bool {
+	if len(parts) != len(pattern) {
+		return false
+	}
+	for n, p := range pattern {
+		if p != "*" && p != parts[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// handleKobo identifies the user from the API token in the path, and dispatches the request to the Kobo API handler
+// for the rest of the path. When authentication is disabled, any token is accepted.
+func (s *Server) handleKobo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	token := p.ByName("token")
+	if s.auth {
+		user, err := s.storage.Users.ByToken(token)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		if user == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	}
+
+	endpoint := s.koboEndpoint(r, token)
+	parts := strings.Split(strings.Trim(p.ByName("path"), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && matchKoboPath(parts, "v1", "initialization"):
+		s.handleKoboInitialization(w, r, endpoint)
+	case r.Method == http.MethodPost && matchKoboPath(parts, "v1", "auth", "device"):
+		s.handleKoboAuthDevice(w, r)
+	case r.Method == http.MethodGet && matchKoboPath(parts, "v1", "library", "sync"):
+		s.handleKoboSync(w, r, endpoint)
+	case r.Method == http.MethodGet && matchKoboPath(parts, "v1", "library", "*", "metadata"):
+		s.handleKoboMetadata(w, r, endpoint, parseKoboBookUUIDs(parts[2]))
+	case r.Method == http.MethodGet && matchKoboPath(parts, "v1", "library", "*", "state"):
+		s.handleKoboState(w, r, parseKoboBookUUIDs(parts[2]))
+	case r.Method == http.MethodPut && matchKoboPath(parts, "v1", "library", "*", "state"):
+		s.handleKoboSetState(w, r, parseKoboUUID(koboBookUUIDPrefix, parts[2]))
+	case r.Method == http.MethodDelete && matchKoboPath(parts, "v1", "library", "*"):
+		s.handleKoboDelete(w, r, parseKoboUUID(koboBookUUIDPrefix, parts[2]))
+	case r.Method == http.MethodGet && len(parts) >= 7 && matchKoboPath(parts[:4], "v1", "books", "*", "thumbnail"):
+		s.handleKoboCover(w, r, parseKoboUUID(koboBookUUIDPrefix, parts[2]), parts[4], parts[5])
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && matchKoboPath(parts, "download", "*"):
+		s.handleDownload(w, r, httprouter.Params{{Key: "filename", Value: parts[1]}})
+	default:
+		// Kobos also use the store's APIs for recommendations, deals, analytics and so on, which aren't supported
+		s.render.JSON(w, http.StatusOK, struct{}{})
+	}
+}
+
+// handleKoboInitialization tells the Kobo where to find the parts of the API it uses, which are all here.
+func (s *Server) handleKoboInitialization(w http.ResponseWriter, r *http.Request, endpoint string) {
+	w.Header().Set("X-Kobo-Apitoken", "e30=")
+	s.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"Resources": map[string]string{
+			"image_host":                 s.baseURL(r),
+			"image_url_template":         endpoint + "/v1/books/{ImageId}/thumbnail/{Width}/{Height}/false/image.jpg",
+			"image_url_quality_template": endpoint + "/v1/books/{ImageId}/thumbnail/{Width}/{Height}/{Quality}/{IsGreyscale}/image.jpg",
+			"library_sync":               endpoint + "/v1/library/sync",
+			"library_metadata":           endpoint + "/v1/library/{Ids}/metadata",
+			"reading_state":              endpoint + "/v1/library/{Ids}/state",
+		},
+	})
+}
+
+// handleKoboAuthDevice responds to the Kobo's request for store credentials. The API token in the path already
+// identifies the user, so the credentials are random and never checked.
+func (s *Server) handleKoboAuthDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserKey string
+	}
+	json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req)
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	token := hex.EncodeToString(buf)
+	s.render.JSON(w, http.StatusOK, map[string]string{
+		"AccessToken":  token,
+		"RefreshToken": token,
+		"TokenType":    "Bearer",
+		"TrackingId":   koboUUID(0, 0),
+		"UserKey":      req.UserKey,
+	})
+}
+
+// handleKoboSync sends the Kobo the books which have been added to, changed on or taken off the user's Kobo shelves,
+// and the reading states which have changed, since its last sync.
+func (s *Server) handleKoboSync(w http.ResponseWriter, r *http.Request, endpoint string) {
+	uid := userID(r)
+	now := time.Now()
+	token, incremental := parseKoboSyncToken(r)
+
+	if !incremental {
+		// the Kobo is syncing from scratch (for example, after being reset), so send it every book again
+		synced, err := s.storage.Kobo.Synced(uid)
+		if err == nil {
+			err = s.storage.Kobo.Unsync(uid, synced...)
+		}
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+
+	shelved, err := s.koboShelvedBooks(uid)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	syncedIDs, err := s.storage.Kobo.Synced(uid)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	synced := make(map[int]bool, len(syncedIDs))
+	for _, id := range syncedIDs {
+		synced[id] = true
+	}
+
+	entries := make([]map[string]interface{}, 0)
+	more := false
+
+	var added []int
+	for _, b := range shelved {
+		if synced[b.ID] {
+			continue
+		}
+		if len(added) == koboSyncLimit {
+			more = true
+			break
+		}
+		state, err := s.koboReadingState(uid, b)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		entries = append(entries, map[string]interface{}{"NewEntitlement": &koboEntitlement{
+			BookEntitlement: koboBookEntitlementFor(b, false),
+			BookMetadata:    s.koboBookMetadata(endpoint, b),
+			ReadingState:    state,
+		}})
+		added = append(added, b.ID)
+	}
+
+	shelvedByID := make(map[int]*booklist.Book, len(shelved))
+	for _, b := range shelved {
+		shelvedByID[b.ID] = b
+	}
+
+	var removed []int
+	for _, id := range syncedIDs {
+		if shelvedByID[id] == nil {
+			entries = append(entries, map[string]interface{}{"ChangedEntitlement": &koboEntitlement{
+				BookEntitlement: koboBookEntitlementFor(&booklist.Book{ID: id}, true),
+			}})
+			removed = append(removed, id)
+		}
+	}
+
+	if incremental {
+		since := time.Unix(token.LastSync, 0)
+		changedIDs, err := s.storage.Kobo.ChangedStates(uid, since)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		changed := make(map[int]bool, len(changedIDs))
+		for _, id := range changedIDs {
+			changed[id] = true
+		}
+		// editing a book's metadata or cover doesn't change its file's modification time
+		editedIDs, err := s.storage.Overrides.EditedSince(since)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		edited := make(map[int]bool, len(editedIDs))
+		for _, id := range editedIDs {
+			edited[id] = true
+		}
+
+		for _, id := range syncedIDs {
+			b := shelvedByID[id]
+			if b == nil {
+				continue
+			}
+			if !b.ModTime.Before(since) || edited[id] {
+				entries = append(entries, map[string]interface{}{"ChangedEntitlement": &koboEntitlement{
+					BookEntitlement: koboBookEntitlementFor(b, false),
+					BookMetadata:    s.koboBookMetadata(endpoint, b),
+				}})
+			}
+			if changed[id] {
+				state, err := s.koboReadingState(uid, b)
+				if err != nil {
+					s.internalError(w, err)
+					return
+				}
+				entries = append(entries, map[string]interface{}{"ChangedReadingState": map[string]interface{}{"ReadingState": state}})
+			}
+		}
+	}
+
+	if err := s.storage.Kobo.SetSynced(uid, added...); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if err := s.storage.Kobo.Unsync(uid, removed...); err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	w.Header().Set("X-Kobo-Synctoken", koboSyncToken{LastSync: now.Unix()}.String())
+	if more {
+		w.Header().Set("X-Kobo-Sync", "continue")
+	}
+	s.render.JSON(w, http.StatusOK, entries)
+}
+
+// koboShelvedBooks returns the EPUBs on the user's Kobo shelves (which the Kobo downloads as KEPUBs), in the order
+// they were added to the library.
+func (s *Server) koboShelvedBooks(uid int) ([]*booklist.Book, error) {
+	ids, err := s.storage.Kobo.Shelved(uid)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return s.koboBooks(ids)
+}
+
+// koboBooks returns the EPUBs with the given IDs, in the order they were added to the library.
+func (s *Server) koboBooks(ids []int) ([]*booklist.Book, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().In("id", ids))
+	if err != nil {
+		return nil, err
+	}
+
+	books := make([]*booklist.Book, 0, len(bl))
+	for _, b := range bl {
+		if b.FileType() == "epub" {
+			books = append(books, b)
+		}
+	}
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].ID < books[j].ID
+	})
+	return books, nil
+}
+
+func koboBookEntitlementFor(b *booklist.Book, removed bool) *koboBookEntitlement {
+	uuid := koboUUID(koboBookUUIDPrefix, b.ID)
+	return &koboBookEntitlement{
+		Accessibility:   "Full",
+		ActivePeriod:    map[string]string{"From": koboTime(b.ImportDate)},
+		Created:         koboTime(b.ImportDate),
+		CrossRevisionID: uuid,
+		ID:              uuid,
+		IsRemoved:       removed,
+		LastModified:    koboTime(latestTime(b.ImportDate, b.ModTime)),
+		OriginCategory:  "Imported",
+		RevisionID:      uuid,
+		Status:          "Active",
+	}
+}
+
+func (s *Server) koboBookMetadata(endpoint string, b *booklist.Book) *koboBookMetadata {
+	uuid := koboUUID(koboBookUUIDPrefix, b.ID)
+	m := &koboBookMetadata{
+		Categories:      []string{"00000000-0000-0000-0000-000000000001"},
+		CrossRevisionID: uuid,
+		Description:     b.Description,
+		DownloadUrls: []koboDownloadURL{{
+			Format:   "KEPUB",
+			Size:     b.FileSize,
+			URL:      fmt.Sprintf("%s/download/%d.kepub.epub", endpoint, b.ID),
+			Platform: "Generic",
+		}},
+		EntitlementID:   uuid,
+		ExternalIds:     []string{},
+		Genre:           "00000000-0000-0000-0000-000000000001",
+		IsSocialEnabled: true,
+		Isbn:            b.ISBN,
+		Language:        "en",
+		RevisionID:      uuid,
+		Title:           b.Title,
+		WorkID:          uuid,
+	}
+	if b.HasCover {
+		m.CoverImageID = uuid
+	}
+	if b.PublishDate.Unix() > 0 {
+		m.PublicationDate = koboTime(b.PublishDate)
+	}
+	if b.PublisherID > 0 && b.Publisher != nil {
+		m.Publisher.Name = b.Publisher.Name
+	}
+	for _, c := range b.Contributors {
+		if c.Role == booklist.RoleAuthor {
+			m.Contributors = append(m.Contributors, c.Author.Name)
+			m.ContributorRoles = append(m.ContributorRoles, koboContributor{Name: c.Author.Name})
+		}
+	}
+	if len(m.Contributors) == 0 && b.Author != nil {
+		m.Contributors = []string{b.Author.Name}
+		m.ContributorRoles = []koboContributor{{Name: b.Author.Name}}
+	}
+	if b.SeriesID > 0 && b.Series != nil {
+		m.Series = &koboSeries{
+			ID:          koboUUID(koboSeriesUUIDPrefix, b.Series.ID),
+			Name:        b.Series.Name,
+			Number:      strconv.FormatFloat(b.SeriesIndex, 'f', -1, 64),
+			NumberFloat: b.SeriesIndex,
+		}
+	}
+	return m
+}
+
+// koboStatus returns the Kobo's name for a read status; Kobos have no equivalent of "to read".
+func koboStatus(status booklist.ReadStatus) string {
+	switch status {
+	case booklist.StatusReading:
+		return "Reading"
+	case booklist.StatusFinished:
+		return "Finished"
+	default:
+		return "ReadyToRead"
+	}
+}
+
+// parseKoboStatus returns the read status for the Kobo's name for it. Books the Kobo hasn't started reading keep their
+// current status if it's "to read".
+func parseKoboStatus(name string, current booklist.ReadStatus) booklist.ReadStatus {
+	switch name {
+	case "Reading":
+		return booklist.StatusReading
+	case "Finished":
+		return booklist.StatusFinished
+	case "ReadyToRead":
+		if current == booklist.StatusToRead {
+			return current
+		}
+		return booklist.StatusNone
+	default:
+		return current
+	}
+}
+
+func (s *Server) koboReadingState(uid int, b *booklist.Book) (*koboReadingState, error) {
+	state, err := s.storage.Kobo.ReadingState(uid, b.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	statusUpdated := latestTime(b.ImportDate, state.StatusUpdated)
+	bookmarkUpdated := latestTime(b.ImportDate, state.Updated)
+	updated := koboTime(latestTime(statusUpdated, bookmarkUpdated))
+
+	rs := &koboReadingState{
+		EntitlementID:     koboUUID(koboBookUUIDPrefix, b.ID),
+		Created:           koboTime(b.ImportDate),
+		LastModified:      updated,
+		PriorityTimestamp: updated,
+		StatusInfo: koboStatusInfo{
+			LastModified: koboTime(statusUpdated),
+			Status:       koboStatus(state.Status),
+		},
+		Statistics: koboStatistics{LastModified: updated},
+		CurrentBookmark: koboBookmark{
+			LastModified:    koboTime(bookmarkUpdated),
+			ProgressPercent: state.Percentage * 100,
+		},
+	}
+	if state.Status == booklist.StatusReading || state.Status == booklist.StatusFinished {
+		rs.StatusInfo.TimesStartedReading = 1
+	}
+	if state.Location != "" {
+		rs.CurrentBookmark.ContentSourceProgressPercent = rs.CurrentBookmark.ProgressPercent
+		rs.CurrentBookmark.Location = &koboLocation{
+			Value:  state.Location,
+			Type:   state.LocationType,
+			Source: state.LocationSource,
+		}
+	}
+	return rs, nil
+}
+
+func (s *Server) handleKoboMetadata(w http.ResponseWriter, r *http.Request, endpoint string, ids []int) {
+	books, err := s.koboBooks(ids)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(books) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	metadata := make([]*koboBookMetadata, len(books))
+	for n, b := range books {
+		metadata[n] = s.koboBookMetadata(endpoint, b)
+	}
+	s.render.JSON(w, http.StatusOK, metadata)
+}
+
+func (s *Server) handleKoboState(w http.ResponseWriter, r *http.Request, ids []int) {
+	books, err := s.koboBooks(ids)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(books) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	states := make([]*koboReadingState, len(books))
+	for n, b := range books {
+		if states[n], err = s.koboReadingState(userID(r), b); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+	s.render.JSON(w, http.StatusOK, states)
+}
+
+// handleKoboSetState saves the reading state the Kobo reports for a book: its read status, and its bookmark, which
+// shows up as the user's progress on the web interface.
+func (s *Server) handleKoboSetState(w http.ResponseWriter, r *http.Request, bid int) {
+	books, err := s.koboBooks([]int{bid})
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(books) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		ReadingStates []koboReadingState
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		s.apiError(w, http.StatusBadRequest, fmt.Errorf("invalid reading state: %v", err))
+		return
+	}
+
+	uid := userID(r)
+	uuid := koboUUID(koboBookUUIDPrefix, bid)
+	for _, rs := range req.ReadingStates {
+		current, err := s.storage.Kobo.ReadingState(uid, bid)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		if status := parseKoboStatus(rs.StatusInfo.Status, current.Status); status != current.Status {
+			if err := s.storage.Statuses.SetStatus(uid, bid, status); err != nil {
+				s.internalError(w, err)
+				return
+			}
+		}
+
+		bookmark := rs.CurrentBookmark
+		if bookmark.Location != nil || bookmark.ProgressPercent > 0 {
+			state := &booklist.KoboReadingState{
+				BookID:     bid,
+				Percentage: bookmark.ProgressPercent / 100,
+			}
+			if state.Percentage > 1 {
+				state.Percentage = 1
+			}
+			if l := bookmark.Location; l != nil && len(l.Value)+len(l.Source) <= maxPositionLength {
+				state.Location, state.LocationType, state.LocationSource = l.Value, l.Type, l.Source
+			}
+			if err := s.storage.Kobo.SaveBookmark(uid, state); err != nil {
+				s.internalError(w, err)
+				return
+			}
+		}
+	}
+
+	success := map[string]string{"Result": "Success"}
+	s.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"RequestResult": "Success",
+		"UpdateResults": []map[string]interface{}{{
+			"EntitlementId":         uuid,
+			"CurrentBookmarkResult": success,
+			"StatisticsResult":      success,
+			"StatusInfoResult":      success,
+		}},
+	})
+}
+
+// handleKoboDelete removes a book that was deleted on the Kobo from the user's Kobo shelves.
+func (s *Server) handleKoboDelete(w http.ResponseWriter, r *http.Request, bid int) {
+	if bid == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.storage.Kobo.Remove(userID(r), bid); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleKoboCover serves a book's cover thumbnail, or its full-size cover if the Kobo asks for a larger image.
+func (s *Server) handleKoboCover(w http.ResponseWriter, r *http.Request, bid int, width, height string) {
+	books, err := s.koboBooks([]int{bid})
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(books) == 0 || !books[0].HasCover {
+		http.NotFound(w, r)
+		return
+	}
+
+	hash := books[0].Hash
+	suffix := "_thumb.jpg"
+	if wd, _ := strconv.Atoi(width); wd > 400 {
+		suffix = ".jpg"
+	} else if ht, _ := strconv.Atoi(height); ht > 400 {
+		suffix = ".jpg"
+	}
+	http.ServeFile(w, r, filepath.Join(s.DataDir, hash[0:2], hash[2:]+suffix))
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// kosyncPrefix is where the KOReader progress sync (kosync) server is mounted; KOReader's custom sync server should
+// be set to this path on BookBrowser's URL.
+const kosyncPrefix = "/kosync"
+
+const (
+	// the longest document digest accepted; KOReader's digests are 32-character MD5 hashes
+	maxDocumentLength = 64
+	// the longest device name or ID accepted
+	maxDeviceLength = 255
+)
+
+// kosyncError is an error response in the format used by KOReader's reference sync server.
+type kosyncError struct {
+	status  int
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	kosyncServerError          = &kosyncError{http.StatusBadGateway, 1000, "Unknown server error."}
+	kosyncUnauthorized         = &kosyncError{http.StatusUnauthorized, 2001, "Unauthorized"}
+	kosyncUserExists           = &kosyncError{http.StatusPaymentRequired, 2002, "Username is already registered."}
+	kosyncInvalidRequest       = &kosyncError{http.StatusForbidden, 2003, "Invalid request"}
+	kosyncNoDocument           = &kosyncError{http.StatusForbidden, 2004, "Field 'document' not provided."}
+	kosyncRegistrationDisabled = &kosyncError{http.StatusPaymentRequired, 2005, "User registration is disabled."}
+)
+
+func (s *Server) kosyncError(w http.ResponseWriter, e *kosyncError) {
+	s.render.JSON(w, e.status, e)
+}
+
+func (s *Server) kosyncInternalError(w http.ResponseWriter, err error) {
+	log.Printf("KOReader sync error: %v", err)
+	s.kosyncError(w, kosyncServerError)
+}
+
+// kosyncValue is a string which KOReader may send as either a JSON string or a number, such as the progress in a
+// paged document.
+type kosyncValue string
+
+func (v *kosyncValue) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		*v = kosyncValue(str)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*v = kosyncValue(n)
+	return nil
+}
+
+type kosyncUser struct {
+	Username string `json:"username"`
+	// the MD5 hash of the user's password; see booklist.SyncKey
+	Password string `json:"password"`
+}
+
+type kosyncProgress struct {
+	Document   string      `json:"document"`
+	Progress   kosyncValue `json:"progress"`
+	Percentage float64     `json:"percentage"`
+	Device     string      `json:"device"`
+	DeviceID   string      `json:"device_id"`
+	Timestamp  int64       `json:"timestamp,omitempty"`
+}
+
+// handleKOSyncCreateUser handles KOReader's registration. Users can't register themselves when authentication is
+// enabled, but registering with an existing user's username and password succeeds, so that KOReader signs in.
+func (s *Server) handleKOSyncCreateUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req kosyncUser
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil || req.Username == "" || req.Password == "" {
+		s.kosyncError(w, kosyncInvalidRequest)
+		return
+	}
+
+	if s.auth {
+		user, err := s.checkSyncKey(req.Username, req.Password)
+		if err != nil {
+			s.kosyncInternalError(w, err)
+			return
+		}
+		if user == nil {
+			existing, err := s.storage.Users.ByUsername(req.Username)
+			if err != nil {
+				s.kosyncInternalError(w, err)
+				return
+			}
+			if existing != nil {
+				s.kosyncError(w, kosyncUserExists)
+			} else {
+				s.kosyncError(w, kosyncRegistrationDisabled)
+			}
+			return
+		}
+	}
+
+	s.render.JSON(w, http.StatusCreated, map[string]string{"username": req.Username})
+}
+
+// handleKOSyncAuth confirms KOReader's credentials, which authenticate has already checked.
+func (s *Server) handleKOSyncAuth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.render.JSON(w, http.StatusOK, map[string]string{"authorized": "OK"})
+}
+
+func (s *Server) handleKOSyncGetProgress(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	document := strings.ToLower(p.ByName("document"))
+	if document == "" || len(document) > maxDocumentLength {
+		s.kosyncError(w, kosyncNoDocument)
+		return
+	}
+
+	progress, err := s.storage.KOSync.ByDocument(userID(r), document)
+	if err != nil {
+		s.kosyncInternalError(w, err)
+		return
+	}
+	if progress == nil {
+		// KOReader expects an empty object for documents it hasn't synced yet
+		s.render.JSON(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, &kosyncProgress{
+		Document:   progress.Document,
+		Progress:   kosyncValue(progress.Progress),
+		Percentage: progress.Percentage,
+		Device:     progress.Device,
+		DeviceID:   progress.DeviceID,
+		Timestamp:  progress.Updated.Unix(),
+	})
+}
+
+func (s *Server) handleKOSyncSetProgress(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req kosyncProgress
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		s.kosyncError(w, kosyncInvalidRequest)
+		return
+	}
+	if req.Document == "" {
+		s.kosyncError(w, kosyncNoDocument)
+		return
+	}
+	if len(req.Document) > maxDocumentLength || req.Progress == "" || len(req.Progress) > maxPositionLength ||
+		req.Device == "" || len(req.Device) > maxDeviceLength || len(req.DeviceID) > maxDeviceLength {
+		s.kosyncError(w, kosyncInvalidRequest)
+		return
+	}
+	if req.Percentage < 0 {
+		req.Percentage = 0
+	} else if req.Percentage > 1 {
+		req.Percentage = 1
+	}
+
+	// digests are hex-encoded, so match them regardless of case
+	progress := &booklist.SyncProgress{
+		Document:   strings.ToLower(req.Document),
+		Progress:   string(req.Progress),
+		Percentage: req.Percentage,
+		Device:     req.Device,
+		DeviceID:   req.DeviceID,
+	}
+	if err := s.storage.KOSync.Save(userID(r), progress); err != nil {
+		s.kosyncInternalError(w, err)
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"document":  req.Document,
+		"timestamp": progress.Updated.Unix(),
+	})
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// Library is a book directory served by BookBrowser.
+type Library struct {
+	Label string
+	Path  string
+}
+
+// ParseLibrary parses a book directory specified as either PATH or LABEL=PATH. If no label is specified, the
+// directory name is used as the label.
+func ParseLibrary(spec string) Library {
+	l := Library{Path: spec}
+	if _, err := os.Stat(spec); err != nil {
+		// only treat the value as LABEL=PATH if it isn't itself an existing path containing an '='
+		if n := strings.Index(spec, "="); n > 0 {
+			l.Label, l.Path = spec[:n], spec[n+1:]
+		}
+	}
+	if l.Label == "" {
+		l.Label = filepath.Base(filepath.Clean(l.Path))
+	}
+	return l
+}
+
+// library returns the library selected by the request's library parameter, or nil if all libraries are selected.
+// Libraries are selected by label, so that links to them don't change when book directories are reordered.
+func (s *Server) library(r *http.Request) *Library {
+	if len(s.Libraries) < 2 {
+		return nil
+	}
+	label := r.URL.Query().Get("library")
+	for n := range s.Libraries {
+		if s.Libraries[n].Label == label {
+			return &s.Libraries[n]
+		}
+	}
+	return nil
+}
+
+// libraryLabel returns the label of the library selected by the request, or "" if all libraries are selected.
+func (s *Server) libraryLabel(r *http.Request) string {
+	if l := s.library(r); l != nil {
+		return l.Label
+	}
+	return ""
+}
+
+// filterLibrary restricts a book query to the library selected by the request (if any), and returns the selected
+// library's label (or "" for all libraries) for use in templates.
+func (s *Server) filterLibrary(r *http.Request, query *storage.Query) string {
+	l := s.library(r)
+	if l == nil {
+		return ""
+	}
+	query.Prefixed("pathname", l.Path+string(os.PathSeparator))
+	return l.Label
+}
+
+// apiFilterLibrary restricts a book query to the library selected by the request, as for filterLibrary. If the
+// selected library doesn't exist, it responds with an error and returns false.
+func (s *Server) apiFilterLibrary(w http.ResponseWriter, r *http.Request, query *storage.Query) bool {
+	label := r.URL.Query().Get("library")
+	if label != "" && len(s.Libraries) > 1 && s.filterLibrary(r, query) == "" {
+		s.apiError(w, http.StatusBadRequest, fmt.Errorf("library %q doesn't exist", label))
+		return false
+	}
+	return true
+}
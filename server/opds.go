@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+
+	opdsRelAcquisition = "http://opds-spec.org/acquisition"
+	opdsRelImage       = "http://opds-spec.org/image"
+	opdsRelThumbnail   = "http://opds-spec.org/image/thumbnail"
+	opdsRelSortNew     = "http://opds-spec.org/sort/new"
+
+	openSearchType = "application/opensearchdescription+xml"
+)
+
+type opdsLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type opdsContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type opdsEntry struct {
+	ID           string       `xml:"id"`
+	Title        string       `xml:"title"`
+	Updated      string       `xml:"updated"`
+	Authors      []opdsAuthor `xml:"author"`
+	Contributors []opdsAuthor `xml:"contributor"`
+	Publisher    string       `xml:"dc:publisher,omitempty"`
+	Issued       string       `xml:"dc:issued,omitempty"`
+	Identifier   string       `xml:"dc:identifier,omitempty"`
+	Content      *opdsContent `xml:"content,omitempty"`
+	Links        []opdsLink   `xml:"link"`
+}
+
+type opdsFeed struct {
+	XMLName   xml.Name `xml:"feed"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	XmlnsDC   string   `xml:"xmlns:dc,attr"`
+	XmlnsOPDS string   `xml:"xmlns:opds,attr"`
+	XmlnsOS   string   `xml:"xmlns:opensearch,attr"`
+
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  *opdsAuthor `xml:"author,omitempty"`
+	Links   []opdsLink  `xml:"link"`
+
+	TotalResults int `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage int `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex   int `xml:"opensearch:startIndex,omitempty"`
+
+	Entries []opdsEntry `xml:"entry"`
+}
+
+// newOPDSFeed creates an empty OPDS feed with the links common to every feed in the catalog.
+func newOPDSFeed(id, title, self, selfType string) *opdsFeed {
+	return &opdsFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		XmlnsOS:   "http://a9.com/-/spec/opensearch/1.1/",
+		ID:        id,
+		Title:     title,
+		Updated:   time.Now().UTC().Format(time.RFC3339),
+		Author:    &opdsAuthor{Name: "BookBrowser", URI: "https://github.com/sblinch/BookBrowser"},
+		Links: []opdsLink{
+			{Rel: "self", Href: self, Type: selfType},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType, Title: "BookBrowser"},
+			{Rel: "search", Href: "/opensearch.xml", Type: openSearchType, Title: "Search BookBrowser"},
+		},
+	}
+}
+
+// paginate adds the OpenSearch result counts and the first/previous/next/last links described by p to the feed;
+// base is the path of the feed, which is combined with the pagination query string.
+func (f *opdsFeed) paginate(base, feedType string, p *Pagination) {
+	f.TotalResults = p.ItemTotal
+	f.ItemsPerPage = p.ItemLimit
+	f.StartIndex = p.ItemOffset + 1
+
+	link := func(rel string, offset int) {
+		f.Links = append(f.Links, opdsLink{
+			Rel:  rel,
+			Href: base + "?" + fmt.Sprintf(p.queryStringFormat, offset, p.ItemLimit),
+			Type: feedType,
+		})
+	}
+
+	if p.TotalPages <= 1 {
+		return
+	}
+
+	link("first", 0)
+	if p.CurrentPage > 1 {
+		offset := p.ItemOffset - p.ItemLimit
+		if offset < 0 {
+			offset = 0
+		}
+		link("previous", offset)
+	}
+	if p.CurrentPage < p.TotalPages {
+		link("next", p.ItemOffset+p.ItemLimit)
+	}
+	link("last", (p.TotalPages-1)*p.ItemLimit)
+}
+
+// addNavigation adds a navigation entry linking to another feed in the catalog.
+func (f *opdsFeed) addNavigation(id, title, content, href, rel, feedType string) {
+	f.Entries = append(f.Entries, opdsEntry{
+		ID:      id,
+		Title:   title,
+		Updated: f.Updated,
+		Content: &opdsContent{Type: "text", Value: content},
+		Links: []opdsLink{
+			{Rel: rel, Href: href, Type: feedType},
+		},
+	})
+}
+
+// addBooks adds an acquisition entry for each book; the books must have been loaded with QueryDeps.
+func (f *opdsFeed) addBooks(books []*booklist.Book) {
+	for _, b := range books {
+		entry := opdsEntry{
+			ID:      fmt.Sprintf("urn:bookbrowser:book:%d", b.ID),
+			Title:   b.Title,
+			Updated: b.ModTime.UTC().Format(time.RFC3339),
+		}
+
+		for _, c := range b.Contributors {
+			a := opdsAuthor{Name: c.Author.Name, URI: fmt.Sprintf("/opds/authors/%d", c.Author.ID)}
+			if c.Role == booklist.RoleAuthor {
+				entry.Authors = append(entry.Authors, a)
+			} else {
+				entry.Contributors = append(entry.Contributors, a)
+			}
+		}
+		if len(entry.Authors) == 0 && b.AuthorID != 0 && b.Author != nil {
+			entry.Authors = append(entry.Authors, opdsAuthor{Name: b.Author.Name, URI: fmt.Sprintf("/opds/authors/%d", b.AuthorID)})
+		}
+		if b.PublisherID != 0 && b.Publisher != nil {
+			entry.Publisher = b.Publisher.Name
+		}
+		if !b.PublishDate.IsZero() && b.PublishDate.Unix() != 0 {
+			entry.Issued = b.PublishDate.Format("2006-01-02")
+		}
+		if b.ISBN != "" {
+			entry.Identifier = "urn:isbn:" + b.ISBN
+		}
+
+		if b.Description != "" {
+			entry.Content = &opdsContent{Type: "html", Value: b.Description}
+		} else if b.SeriesID != 0 && b.Series != nil {
+			entry.Content = &opdsContent{Type: "text", Value: fmt.Sprintf("%s #%v", b.Series.Name, b.SeriesIndex)}
+		}
+
+		entry.Links = append(entry.Links, opdsLink{
+			Rel:  opdsRelAcquisition,
+			Href: fmt.Sprintf("/download/%d.%s", b.ID, b.FileType()),
+			Type: bookContentType(b.FileType()),
+		})
+		if b.FileType() == "epub" {
+			entry.Links = append(entry.Links, opdsLink{
+				Rel:   opdsRelAcquisition,
+				Href:  fmt.Sprintf("/download/%d.kepub.epub", b.ID),
+				Type:  bookContentType("kepub"),
+				Title: "Kobo EPUB",
+			})
+		}
+		if b.HasCover {
+			entry.Links = append(entry.Links,
+				opdsLink{Rel: opdsRelImage, Href: "/covers/" + b.Hash + ".jpg", Type: "image/jpeg"},
+				opdsLink{Rel: opdsRelThumbnail, Href: "/covers/" + b.Hash + "_thumb.jpg", Type: "image/jpeg"},
+			)
+		}
+		entry.Links = append(entry.Links, opdsLink{Rel: "alternate", Href: fmt.Sprintf("/books/%d", b.ID), Type: "text/html"})
+
+		f.Entries = append(f.Entries, entry)
+	}
+}
+
+// writeOPDS serializes an OPDS feed to the client.
+func (s *Server) writeOPDS(w http.ResponseWriter, feedType string, f *opdsFeed) {
+	w.Header().Set("Content-Type", feedType+";charset=utf-8")
+	io.WriteString(w, xml.Header)
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		s.printLog("Error writing OPDS feed %s: %v", f.ID, err)
+	}
+}
+
+// opdsNotFound responds to a request for a nonexistent catalog entry.
+func (s *Server) opdsNotFound(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusNotFound)
+	io.WriteString(w, message)
+}
+
+// opdsBookFeed queries a page of books and writes them as an acquisition feed.
+func (s *Server) opdsBookFeed(w http.ResponseWriter, r *http.Request, f *opdsFeed, base string, query *storage.Query) {
+	s.filterLibrary(r, query)
+	total, err := s.storage.Books.Count(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+	bl, err := s.storage.Books.QueryDeps(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	f.paginate(base, opdsAcquisitionType, pagination)
+	f.addBooks(bl)
+	s.writeOPDS(w, opdsAcquisitionType, f)
+}
+
+func (s *Server) handleOPDSRoot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	f := newOPDSFeed("urn:bookbrowser:root", "BookBrowser", "/opds", opdsNavigationType)
+	f.addNavigation("urn:bookbrowser:books", "Recently Added", "Books sorted by the date they were added to the library", "/opds/books", opdsRelSortNew, opdsAcquisitionType)
+	f.addNavigation("urn:bookbrowser:authors", "Authors", "Books grouped by author", "/opds/authors", "subsection", opdsNavigationType)
+	f.addNavigation("urn:bookbrowser:series", "Series", "Books grouped by series", "/opds/series", "subsection", opdsNavigationType)
+	f.addNavigation("urn:bookbrowser:shelves", "Shelves", "Your shelves", "/opds/shelves", "subsection", opdsNavigationType)
+	if len(s.Libraries) > 1 {
+		for _, l := range s.Libraries {
+			f.addNavigation("urn:bookbrowser:library:"+url.QueryEscape(l.Label), l.Label, "Books in the "+l.Label+" library", "/opds/books?library="+url.QueryEscape(l.Label), "subsection", opdsAcquisitionType)
+		}
+	}
+
+	s.writeOPDS(w, opdsNavigationType, f)
+}
+
+func (s *Server) handleOPDSBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "importdate", false)
+
+	f := newOPDSFeed("urn:bookbrowser:books", "Recently Added", "/opds/books", opdsAcquisitionType)
+	s.opdsBookFeed(w, r, f, "/opds/books", storage.NewQuery().SortedBy(userSortKey, userSortAsc))
+}
+
+func (s *Server) handleOPDSAuthors(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := storage.NewQuery().SortedBy("sortname", true)
+	total, err := s.storage.Authors.Count(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	al, err := s.storage.Authors.Query(query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	f := newOPDSFeed("urn:bookbrowser:authors", "Authors", "/opds/authors", opdsNavigationType)
+	f.paginate("/opds/authors", opdsNavigationType, pagination)
+	for _, a := range al {
+		f.addNavigation(fmt.Sprintf("urn:bookbrowser:author:%d", a.ID), a.Name, "Books by "+a.Name, fmt.Sprintf("/opds/authors/%d", a.ID), "subsection", opdsAcquisitionType)
+	}
+
+	s.writeOPDS(w, opdsNavigationType, f)
+}
+
+func (s *Server) handleOPDSAuthor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	aid := p.ByName("id")
+	authors, err := s.storage.Authors.Query(storage.NewQuery().Filtered("id", aid, true))
+	if err != nil {
+		s.internalError(w, fmt.Errorf("query-authors: %v", err))
+		return
+	}
+	if len(authors) == 0 {
+		s.opdsNotFound(w, "Author not found.")
+		return
+	}
+	author := authors[0]
+
+	userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
+
+	base := fmt.Sprintf("/opds/authors/%d", author.ID)
+	f := newOPDSFeed(fmt.Sprintf("urn:bookbrowser:author:%d", author.ID), author.Name, base, opdsAcquisitionType)
+	query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+	s.filterLibrary(r, query)
+	total, err := s.storage.Books.CountByContributor(author.ID, query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	bl, err := s.storage.Books.QueryByContributor(author.ID, query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	f.paginate(base, opdsAcquisitionType, pagination)
+	f.addBooks(bl)
+	s.writeOPDS(w, opdsAcquisitionType, f)
+}
+
+func (s *Server) handleOPDSSeriess(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := storage.NewQuery().SortedBy("name", true)
+	total, err := s.storage.Series.Count(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	sl, err := s.storage.Series.Query(query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	f := newOPDSFeed("urn:bookbrowser:series", "Series", "/opds/series", opdsNavigationType)
+	f.paginate("/opds/series", opdsNavigationType, pagination)
+	for _, series := range sl {
+		f.addNavigation(fmt.Sprintf("urn:bookbrowser:series:%d", series.ID), series.Name, "Books in the "+series.Name+" series", fmt.Sprintf("/opds/series/%d", series.ID), "subsection", opdsAcquisitionType)
+	}
+
+	s.writeOPDS(w, opdsNavigationType, f)
+}
+
+func (s *Server) handleOPDSSeries(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	sid := p.ByName("id")
+	seriess, err := s.storage.Series.Query(storage.NewQuery().Filtered("id", sid, true))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if len(seriess) == 0 {
+		s.opdsNotFound(w, "Series not found.")
+		return
+	}
+	series := seriess[0]
+
+	base := fmt.Sprintf("/opds/series/%d", series.ID)
+	f := newOPDSFeed(fmt.Sprintf("urn:bookbrowser:series:%d", series.ID), series.Name, base, opdsAcquisitionType)
+	s.opdsBookFeed(w, r, f, base, storage.NewQuery().Filtered("seriesid", sid, true).SortedBy("seriesindex", true))
+}
+
+func (s *Server) handleOPDSSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query().Get("q")
+
+	f := newOPDSFeed("urn:bookbrowser:search:"+url.QueryEscape(q), "Search Results", "/opds/search?q="+url.QueryEscape(q), opdsAcquisitionType)
+	if len(q) == 0 {
+		f.Title = "Search"
+		s.writeOPDS(w, opdsAcquisitionType, f)
+		return
+	}
+
+	userSortKey, userSortAsc := s.parseKeywordSort(r)
+
+	query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+	s.filterLibrary(r, query)
+	total, err := s.storage.Books.CountKeyword(q, query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	bl, err := s.storage.Books.QueryKeyword(q, query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	f.Title = "Search Results for \"" + q + "\""
+	f.paginate("/opds/search", opdsAcquisitionType, pagination)
+	f.addBooks(bl)
+	s.writeOPDS(w, opdsAcquisitionType, f)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFeed is an OPDS feed as parsed by a client.
+type testFeed struct {
+	ID           string     `xml:"id"`
+	Title        string     `xml:"title"`
+	Links        []opdsLink `xml:"link"`
+	TotalResults int        `xml:"http://a9.com/-/spec/opensearch/1.1/ totalResults"`
+	ItemsPerPage int        `xml:"http://a9.com/-/spec/opensearch/1.1/ itemsPerPage"`
+	StartIndex   int        `xml:"http://a9.com/-/spec/opensearch/1.1/ startIndex"`
+	Entries      []struct {
+		ID      string       `xml:"id"`
+		Title   string       `xml:"title"`
+		Authors []opdsAuthor `xml:"author"`
+		Links   []opdsLink   `xml:"link"`
+	} `xml:"entry"`
+}
+
+// getFeed requests an OPDS feed of the specified type, checks that it was found and parses it.
+func getFeed(t *testing.T, s *Server, path, feedType string) *testFeed {
+	w := get(s, path, nil)
+	require.Equal(t, http.StatusOK, w.Code, "for %s: %s", path, w.Body.String())
+	assert.Equal(t, feedType+";charset=utf-8", w.Header().Get("Content-Type"))
+
+	var f testFeed
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &f), "for %s", path)
+	return &f
+}
+
+// link returns the href of the feed's link with the specified rel, or "" if it has none.
+func (f *testFeed) link(rel string) string {
+	for _, l := range f.Links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// pageOffset returns the offset of the page a pagination link points to, or -1 if the feed has no such link.
+func (f *testFeed) pageOffset(t *testing.T, rel string) int {
+	href := f.link(rel)
+	if href == "" {
+		return -1
+	}
+	u, err := url.Parse(href)
+	require.NoError(t, err)
+	assert.Equal(t, "2", u.Query().Get("limit"), "for the %s link %s", rel, href)
+	var offset int
+	_, err = fmt.Sscan(u.Query().Get("offset"), &offset)
+	require.NoError(t, err, "for the %s link %s", rel, href)
+	return offset
+}
+
+func TestOPDS(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	books := addTestBooks(t, s, stor, "Beta", "Alpha", "Gamma", "Delta", "Epsilon")
+
+	t.Run("root", func(t *testing.T) {
+		f := getFeed(t, s, "/opds", opdsNavigationType)
+		assert.Equal(t, "urn:bookbrowser:root", f.ID)
+		assert.Equal(t, "/opds", f.link("self"))
+		assert.Equal(t, "/opds", f.link("start"))
+		assert.Equal(t, "/opensearch.xml", f.link("search"))
+
+		hrefs := map[string]string{}
+		for _, e := range f.Entries {
+			require.Len(t, e.Links, 1)
+			hrefs[e.Title] = e.Links[0].Href
+		}
+		assert.Equal(t, map[string]string{
+			"Recently Added": "/opds/books",
+			"Authors":        "/opds/authors",
+			"Series":         "/opds/series",
+			"Shelves":        "/opds/shelves",
+		}, hrefs)
+	})
+
+	t.Run("books", func(t *testing.T) {
+		f := getFeed(t, s, "/opds/books", opdsAcquisitionType)
+		assert.Equal(t, 5, f.TotalResults)
+		assert.Len(t, f.Entries, 5)
+		// everything fits on one page
+		assert.Empty(t, f.link("first"))
+		assert.Empty(t, f.link("next"))
+
+		for _, c := range []struct {
+			offset                      int
+			first, previous, next, last int
+			entries                     int
+		}{
+			{0, 0, -1, 2, 4, 2},
+			{2, 0, 0, 4, 4, 2},
+			{4, 0, 2, -1, 4, 1},
+		} {
+			f := getFeed(t, s, fmt.Sprintf("/opds/books?offset=%d&limit=2", c.offset), opdsAcquisitionType)
+			assert.Equal(t, 5, f.TotalResults)
+			assert.Equal(t, 2, f.ItemsPerPage)
+			assert.Equal(t, c.offset+1, f.StartIndex)
+			assert.Len(t, f.Entries, c.entries)
+			assert.Equal(t, c.first, f.pageOffset(t, "first"), "first page from %d", c.offset)
+			assert.Equal(t, c.previous, f.pageOffset(t, "previous"), "previous page from %d", c.offset)
+			assert.Equal(t, c.next, f.pageOffset(t, "next"), "next page from %d", c.offset)
+			assert.Equal(t, c.last, f.pageOffset(t, "last"), "last page from %d", c.offset)
+		}
+	})
+
+	t.Run("author", func(t *testing.T) {
+		a := books[0].Author
+		require.NotNil(t, a)
+		path := fmt.Sprintf("/opds/authors/%d", a.ID)
+
+		f := getFeed(t, s, path+"?limit=2", opdsAcquisitionType)
+		assert.Equal(t, fmt.Sprintf("urn:bookbrowser:author:%d", a.ID), f.ID)
+		assert.Equal(t, "Jane Doe", f.Title)
+		assert.Equal(t, 5, f.TotalResults)
+		assert.Equal(t, path+"?offset=2&limit=2", f.link("next"))
+
+		// the author's books are sorted by title
+		require.Len(t, f.Entries, 2)
+		assert.Equal(t, "Alpha", f.Entries[0].Title)
+		assert.Equal(t, "Beta", f.Entries[1].Title)
+
+		e := f.Entries[1]
+		b := books[0]
+		assert.Equal(t, fmt.Sprintf("urn:bookbrowser:book:%d", b.ID), e.ID)
+		require.Len(t, e.Authors, 1)
+		assert.Equal(t, opdsAuthor{Name: "Jane Doe", URI: path}, e.Authors[0])
+
+		acquisitions := map[string]string{}
+		for _, l := range e.Links {
+			if l.Rel == opdsRelAcquisition {
+				acquisitions[l.Href] = l.Type
+			}
+		}
+		assert.Equal(t, map[string]string{
+			fmt.Sprintf("/download/%d.epub", b.ID):       bookContentType("epub"),
+			fmt.Sprintf("/download/%d.kepub.epub", b.ID): bookContentType("kepub"),
+		}, acquisitions)
+
+		// the acquisition links work
+		for href := range acquisitions {
+			assert.Equal(t, http.StatusOK, get(s, href, nil).Code, "for %s", href)
+		}
+
+		w := get(s, "/opds/authors/9999", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
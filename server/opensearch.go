@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Rel      string `xml:"rel,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchImage struct {
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+	Type   string `xml:"type,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type openSearchDescription struct {
+	XMLName       xml.Name         `xml:"OpenSearchDescription"`
+	Xmlns         string           `xml:"xmlns,attr"`
+	ShortName     string           `xml:"ShortName"`
+	Description   string           `xml:"Description"`
+	InputEncoding string           `xml:"InputEncoding"`
+	Image         *openSearchImage `xml:"Image,omitempty"`
+	URLs          []openSearchURL  `xml:"Url"`
+}
+
+// baseURL returns the server's URL as the client reached it, for use in documents which require absolute URLs. This is
+// BaseURL if it's set; otherwise it's the scheme and host of the request, or those given by a trusted proxy (see
+// SetTrustedProxies) in X-Forwarded-Proto and X-Forwarded-Host.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/")
+	}
+
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if s.isTrustedProxy(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	if !validHost(host) {
+		host = "localhost"
+	}
+	return scheme + "://" + host
+}
+
+// validHost reports whether host is a hostname or IP address, optionally with a port, so that a malformed Host header
+// can't change the rest of a URL built from it.
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/\\?#@ ") {
+		return false
+	}
+	u, err := url.Parse("http://" + host)
+	return err == nil && u.Host == host && u.Hostname() != ""
+}
+
+// handleOpenSearch serves an OpenSearch description document which allows browsers and e-reader apps to search
+// the library, either as HTML or as an OPDS acquisition feed.
+func (s *Server) handleOpenSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	base := s.baseURL(r)
+
+	d := &openSearchDescription{
+		Xmlns:         "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:     "BookBrowser",
+		Description:   "Search books by title, author or series",
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{
+			{Type: "text/html", Template: base + "/search?q={searchTerms}"},
+			{Type: opdsAcquisitionType, Template: base + "/opds/search?q={searchTerms}"},
+			{Type: "application/atom+xml", Template: base + "/opds/search?q={searchTerms}"},
+			{Type: openSearchType, Rel: "self", Template: base + "/opensearch.xml"},
+		},
+	}
+
+	w.Header().Set("Content-Type", openSearchType+";charset=utf-8")
+	io.WriteString(w, xml.Header)
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		s.printLog("Error writing OpenSearch description: %v", err)
+	}
+}
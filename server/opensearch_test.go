@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseURL(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	require.NoError(t, s.SetTrustedProxies([]string{"10.0.0.5"}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		proto      string
+		forwarded  string
+		expected   string
+	}{
+		{name: "request host", remoteAddr: "192.168.1.2:1234", host: "books.local:8090", expected: "http://books.local:8090"},
+		{name: "untrusted forwarded headers", remoteAddr: "192.168.1.2:1234", host: "books.local:8090", proto: "https", forwarded: "evil.example.com", expected: "http://books.local:8090"},
+		{name: "trusted forwarded headers", remoteAddr: "10.0.0.5:1234", host: "127.0.0.1:8090", proto: "https", forwarded: "books.example.com", expected: "https://books.example.com"},
+		{name: "unknown forwarded scheme", remoteAddr: "10.0.0.5:1234", host: "books.local", proto: "javascript", expected: "http://books.local"},
+		{name: "malformed host", remoteAddr: "192.168.1.2:1234", host: "evil.example.com/x?", expected: "http://localhost"},
+		{name: "malformed forwarded host", remoteAddr: "10.0.0.5:1234", host: "books.local", forwarded: "user@evil.example.com", expected: "http://localhost"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/opensearch.xml", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Host = test.host
+			if test.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", test.proto)
+			}
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-Host", test.forwarded)
+			}
+			assert.Equal(t, test.expected, s.baseURL(r))
+		})
+	}
+
+	// a configured URL takes precedence
+	s.BaseURL = "https://books.example.com/"
+	r := httptest.NewRequest(http.MethodGet, "/opensearch.xml", nil)
+	r.Host = "evil.example.com"
+	assert.Equal(t, "https://books.example.com", s.baseURL(r))
+}
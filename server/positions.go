@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+const (
+	// the longest position accepted from a reader; EPUB CFIs are usually well under this
+	maxPositionLength = 1024
+	// books read further than this are considered finished, and aren't shown under Continue Reading
+	finishedPercentage = 0.98
+	// the number of books shown under Continue Reading
+	continueReadingLimit = 6
+)
+
+type apiPosition struct {
+	Position   string     `json:"position"`
+	Percentage float64    `json:"percentage"`
+	Updated    *time.Time `json:"updated,omitempty"`
+}
+
+func (s *Server) handleAPIPosition(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bid, err := s.bookID(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if bid == 0 {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+
+	pos, err := s.storage.Positions.ByBook(userID(r), bid)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if pos == nil {
+		s.apiError(w, http.StatusNotFound, errors.New("no position saved"))
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, &apiPosition{
+		Position:   pos.Position,
+		Percentage: pos.Percentage,
+		Updated:    apiTime(pos.Updated),
+	})
+}
+
+func (s *Server) handleAPISetPosition(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bid, err := s.bookID(p)
+	if err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if bid == 0 {
+		s.apiError(w, http.StatusNotFound, errors.New("book not found"))
+		return
+	}
+
+	var req apiPosition
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		s.apiError(w, http.StatusBadRequest, fmt.Errorf("invalid position: %v", err))
+		return
+	}
+	if req.Position == "" || len(req.Position) > maxPositionLength {
+		s.apiError(w, http.StatusBadRequest, errors.New("invalid position"))
+		return
+	}
+	if req.Percentage < 0 {
+		req.Percentage = 0
+	} else if req.Percentage > 1 {
+		req.Percentage = 1
+	}
+
+	pos := &booklist.Position{
+		BookID:     bid,
+		Position:   req.Position,
+		Percentage: req.Percentage,
+	}
+	if err := s.storage.Positions.Save(userID(r), pos); err != nil {
+		s.apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.render.JSON(w, http.StatusOK, &apiPosition{
+		Position:   pos.Position,
+		Percentage: pos.Percentage,
+		Updated:    apiTime(pos.Updated),
+	})
+}
+
+// readingBook is a book the user is partway through, as shown under Continue Reading.
+type readingBook struct {
+	Book     *booklist.Book
+	Position *booklist.Position
+}
+
+// Percent returns how much of the book has been read, from 0 to 100.
+func (b readingBook) Percent() int {
+	return int(b.Position.Percentage * 100)
+}
+
+// ReaderURL returns the URL of the built-in reader for the book.
+func (b readingBook) ReaderURL() string {
+	if b.Book.FileType() == "pdf" {
+		return fmt.Sprintf("/static/reader/pdf/web/viewer.html?file=/download/%d.pdf", b.Book.ID)
+	}
+	return fmt.Sprintf("/static/reader/epub/#!/download/%d.%s", b.Book.ID, b.Book.FileType())
+}
+
+// continueReading returns the books the user has most recently read in the built-in readers without finishing them.
+func (s *Server) continueReading(r *http.Request) ([]readingBook, error) {
+	positions, err := s.storage.Positions.Unfinished(userID(r), finishedPercentage, continueReadingLimit)
+	if err != nil || len(positions) == 0 {
+		return nil, err
+	}
+
+	ids := make([]int, len(positions))
+	for n, pos := range positions {
+		ids[n] = pos.BookID
+	}
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().In("id", ids))
+	if err != nil {
+		return nil, err
+	}
+	books := make(map[int]*booklist.Book, len(bl))
+	for _, b := range bl {
+		books[b.ID] = b
+	}
+
+	// keep the most recently read books first
+	reading := make([]readingBook, 0, len(positions))
+	for _, pos := range positions {
+		if b, ok := books[pos.BookID]; ok {
+			reading = append(reading, readingBook{Book: b, Position: pos})
+		}
+	}
+	return reading, nil
+}
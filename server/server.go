@@ -12,25 +12,58 @@ import (
 	"regexp"
 	"runtime/debug"
 	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/converter"
 	"github.com/sblinch/BookBrowser/formats"
 	"github.com/sblinch/BookBrowser/indexer"
 	"github.com/sblinch/BookBrowser/public"
 	"github.com/sblinch/BookBrowser/storage"
-	"github.com/geek1011/kepubify/kepub"
 	"github.com/julienschmidt/httprouter"
 	"github.com/unrolled/render"
-	"io/ioutil"
+	"net"
 	"net/url"
 )
 
 // Server is a BookBrowser server.
 type Server struct {
-	Indexer  *indexer.Indexer
-	BookDir  string
+	Indexer   *indexer.Indexer
+	Libraries []Library
 	DataDir  string
 	NoCovers bool
 	Addr     string
 	Verbose  bool
+	// the ebook-convert command used to convert EPUBs to MOBI and AZW3, or empty if conversion is unavailable
+	Converter string
+	// cached converted copies of books
+	Converted *converter.Cache
+	// whether downloaded EPUBs have the metadata from the index, including edits, embedded in them (see
+	// Indexer.EmbedMetadata); the books' files are left unchanged
+	EmbedMetadata bool
+	// whether metadata may be written into books' files from the web interface and API when authentication is
+	// disabled; when it's enabled, admins always may
+	AllowWrite bool
+	// whether books may be uploaded when authentication is disabled; when it's enabled, admins always may
+	AllowUpload bool
+	// the server's external URL (such as https://books.example.com), used in documents which require absolute URLs;
+	// if empty, it's taken from each request (see baseURL)
+	BaseURL string
+	// the template for the pathnames of uploaded books (see SetUploadPath)
+	uploadPath *texttemplate.Template
+	// held by uploads from checking whether they're duplicates until they're indexed, so that two uploads of the same
+	// book can't both be added
+	uploadMu sync.Mutex
+	// the hashes of uploaded books waiting to be indexed (see indexUploadLater), which aren't in the index yet
+	pendingUploads map[string]bool
+	// whether users must sign in (see EnableAuth)
+	auth     bool
+	// verified Basic auth credentials, to avoid checking bcrypt hashes on every request
+	credentials *credentialCache
+	// the header which trusted proxies identify users with, or empty if proxy authentication is disabled
+	proxyHeader string
+	trustedProxies []*net.IPNet
 	storage  *storage.Storage
 	router   *httprouter.Router
 	render   *render.Render
@@ -38,29 +71,42 @@ type Server struct {
 }
 
 // NewServer creates a new BookBrowser server. It will not index the books automatically.
-func NewServer(addr string, stor *storage.Storage, bookdir, datadir, version string, verbose, nocovers bool) *Server {
-	i, err := indexer.New([]string{bookdir}, stor, &datadir, formats.GetExts())
+func NewServer(addr string, stor *storage.Storage, libraries []Library, datadir, version string, verbose, nocovers bool) *Server {
+	paths := make([]string, len(libraries))
+	for n := range libraries {
+		paths[n] = libraries[n].Path
+	}
+
+	i, err := indexer.New(paths, stor, &datadir, formats.GetExts())
 	if err != nil {
 		panic(err)
 	}
 	i.Verbose = verbose
+	i.Converted = converter.NewCache(filepath.Join(datadir, "converted"))
 
 	if verbose {
 		log.Printf("Supported formats: %s", strings.Join(formats.GetExts(), ", "))
 	}
 
 	s := &Server{
-		Indexer:  i,
-		BookDir:  bookdir,
+		Indexer:   i,
+		Converted: i.Converted,
+		Libraries: libraries,
 		Addr:     addr,
 		DataDir:  datadir,
 		NoCovers: nocovers,
 		Verbose:  verbose,
 		storage:  stor,
+		credentials: newCredentialCache(),
+		pendingUploads: map[string]bool{},
 		router:   httprouter.New(),
 		version:  version,
 	}
 
+	if err := s.SetUploadPath(DefaultUploadPath); err != nil {
+		panic(err)
+	}
+
 	s.initRender()
 	s.initRouter()
 
@@ -97,7 +143,11 @@ func (s *Server) RefreshBookIndex() error {
 // Serve starts the BookBrowser server. It does not return unless there is an error.
 func (s *Server) Serve() error {
 	s.printLog("Serving on %s\n", s.Addr)
-	err := http.ListenAndServe(s.Addr, s.router)
+	var handler http.Handler = s.router
+	if s.auth {
+		handler = s.authenticate(handler)
+	}
+	err := http.ListenAndServe(s.Addr, handler)
 	if err != nil {
 		return err
 	}
@@ -118,12 +168,34 @@ func (s *Server) initRender() {
 				"raw": func(s string) template.HTML {
 					return template.HTML(s)
 				},
+				"ReadStatuses": func() []booklist.ReadStatus {
+					return booklist.ReadStatuses
+				},
+				"CanConvert": func() bool {
+					return s.Converter != ""
+				},
+				// the libraries available for filtering, or none if there is only one
+				"Libraries": func() []Library {
+					if len(s.Libraries) < 2 {
+						return nil
+					}
+					return s.Libraries
+				},
 			},
 		},
 		IsDevelopment: false,
 	})
 }
 
+// renderHTML renders the named template, adding the signed-in user (if any), whether they may upload books and the
+// token which forms must be submitted with (see csrfToken) to the template data.
+func (s *Server) renderHTML(w http.ResponseWriter, r *http.Request, status int, name string, data map[string]interface{}) {
+	data["User"] = currentUser(r)
+	data["CanUpload"] = s.canUpload(r)
+	data["CSRF"] = csrfToken(w, r)
+	s.render.HTML(w, status, name, data)
+}
+
 // Allows cover images to be requested by the ebook hash, but converts the requested filename into the two-tier
 // directory format we use internally
 type CoverDir struct {
@@ -147,6 +219,7 @@ func (s *Server) initRouter() {
 	s.router.GET("/search", s.handleSearch)
 	s.router.GET("/search/authors", s.handleSearchAuthors)
 	s.router.GET("/search/series", s.handleSearchSeries)
+	s.router.GET("/search/publishers", s.handleSearchPublishers)
 
 	s.router.GET("/api/indexer", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		w.Header().Set("Cache-Control", "no-cache")
@@ -154,6 +227,26 @@ func (s *Server) initRouter() {
 		fmt.Fprintf(w, `{"indexing": %t, "progress": %f}`, s.Indexer.Progress != 0, s.Indexer.Progress)
 	})
 
+	s.router.GET("/api/v1/books", s.handleAPIBooks)
+	s.router.GET("/api/v1/books/:id", s.handleAPIBook)
+	s.router.GET("/api/v1/books/:id/position", s.handleAPIPosition)
+	s.router.PUT("/api/v1/books/:id/position", s.handleAPISetPosition)
+	s.router.PATCH("/api/v1/books/:id", s.requireAPIEditor(s.handleAPIEditBook))
+	s.router.PUT("/api/v1/books/:id/cover", s.requireAPIEditor(s.handleAPISetCover))
+	s.router.GET("/api/v1/books/:id/overrides", s.handleAPIOverrides)
+	s.router.DELETE("/api/v1/books/:id/overrides/:field", s.requireAPIEditor(s.handleAPIRevert))
+	s.router.POST("/api/v1/books/:id/write", s.requireAPIWriter(s.requireCSRFHeader(s.handleAPIWriteBook)))
+	s.router.POST("/api/v1/books", s.requireAPIUploader(s.requireCSRFHeader(s.handleAPIUpload)))
+	s.router.GET("/api/v1/authors", s.handleAPIAuthors)
+	s.router.GET("/api/v1/authors/:id", s.handleAPIAuthor)
+	s.router.GET("/api/v1/authors/:id/books", s.handleAPIAuthorBooks)
+	s.router.GET("/api/v1/series", s.handleAPISeriess)
+	s.router.GET("/api/v1/series/:id", s.handleAPISeries)
+	s.router.GET("/api/v1/series/:id/books", s.handleAPISeriesBooks)
+	s.router.GET("/api/v1/search/books", s.handleAPISearchBooks)
+	s.router.GET("/api/v1/search/authors", s.handleAPISearchAuthors)
+	s.router.GET("/api/v1/search/series", s.handleAPISearchSeries)
+
 	s.router.GET("/books", s.handleBooks)
 	s.router.GET("/books/:id", s.handleBook)
 
@@ -163,6 +256,48 @@ func (s *Server) initRouter() {
 	s.router.GET("/series", s.handleSeriess)
 	s.router.GET("/series/:id", s.handleSeries)
 
+	s.router.GET("/publishers", s.handlePublishers)
+	s.router.GET("/publishers/:id", s.handlePublisher)
+
+	s.router.GET("/tags", s.handleTags)
+	s.router.GET("/tags/:id", s.handleTag)
+
+	s.router.POST("/books/:id/status", s.handleBookStatus)
+	s.router.POST("/books/:id/favourite", s.handleBookFavourite)
+	s.router.POST("/books/:id/shelves", s.handleBookShelves)
+	s.router.GET("/books/:id/edit", s.requireEditor(s.handleBookEdit))
+	s.router.POST("/books/:id/edit", s.requireEditor(s.handleBookEditPost))
+	s.router.POST("/books/:id/revert", s.requireEditor(s.handleBookRevert))
+	s.router.POST("/books/:id/write", s.requireWriter(s.handleBookWrite))
+	s.router.GET("/upload", s.requireUploader(s.handleUpload))
+	s.router.POST("/upload", s.requireUploader(s.handleUploadPost))
+
+	s.router.GET("/shelves", s.handleShelves)
+	s.router.POST("/shelves", s.handleShelvesCreate)
+	s.router.GET("/shelves/:id", s.handleShelf)
+	s.router.POST("/shelves/:id/delete", s.handleShelfDelete)
+	s.router.POST("/shelves/:id/kobo", s.handleShelfKobo)
+
+	s.router.GET("/opds", s.handleOPDSRoot)
+	s.router.GET("/opds/books", s.handleOPDSBooks)
+	s.router.GET("/opds/authors", s.handleOPDSAuthors)
+	s.router.GET("/opds/authors/:id", s.handleOPDSAuthor)
+	s.router.GET("/opds/series", s.handleOPDSSeriess)
+	s.router.GET("/opds/series/:id", s.handleOPDSSeries)
+	s.router.GET("/opds/shelves", s.handleOPDSShelves)
+	s.router.GET("/opds/shelves/:id", s.handleOPDSShelf)
+	s.router.GET("/opds/search", s.handleOPDSSearch)
+	s.router.GET("/opensearch.xml", s.handleOpenSearch)
+
+	s.router.POST(kosyncPrefix+"/users/create", s.handleKOSyncCreateUser)
+	s.router.GET(kosyncPrefix+"/users/auth", s.handleKOSyncAuth)
+	s.router.PUT(kosyncPrefix+"/syncs/progress", s.handleKOSyncSetProgress)
+	s.router.GET(kosyncPrefix+"/syncs/progress/:document", s.handleKOSyncGetProgress)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		s.router.Handle(method, koboPrefix+":token/*path", s.handleKobo)
+	}
+
 	s.router.GET("/download", s.handleDownloads)
 	s.router.GET("/download/:filename", s.handleDownload)
 
@@ -243,7 +378,8 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, p httpro
 		iskepub = true
 	}
 
-	bl, err := s.storage.Books.Query(storage.NewQuery().Filtered("id", bid, true))
+	// the book's dependencies are embedded along with its own metadata
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().Filtered("id", bid, true))
 	if err != nil || len(bl) == 0 {
 		w.WriteHeader(http.StatusNotFound)
 		io.WriteString(w, "Could not find book with id "+bid)
@@ -251,8 +387,13 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, p httpro
 	}
 
 	b := bl[0]
+	if format := strings.TrimPrefix(filepath.Ext(p.ByName("filename")), "."); !iskepub && format != b.FileType() && convertFormats[format] {
+		s.handleConvertedDownload(w, r, b, format)
+		return
+	}
+
 	if !iskepub {
-		rd, err := os.Open(b.FilePath)
+		cacheFormat, embed, revision, err := s.embedMetadata(b, b.FileType(), nil)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			io.WriteString(w, "Error handling request")
@@ -260,56 +401,115 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, p httpro
 			return
 		}
 
-		w.Header().Set("Content-Disposition", `attachment; filename="`+regexp.MustCompile("[[:^ascii:]]").ReplaceAllString(b.Title, "_")+`.`+b.FileType()+`"`)
-		switch b.FileType() {
-		case "epub":
-			w.Header().Set("Content-Type", "application/epub+zip")
-		case "pdf":
-			w.Header().Set("Content-Type", "application/pdf")
-		default:
-			w.Header().Set("Content-Type", "application/octet-stream")
+		var rd *os.File
+		if revision != "" {
+			rd, err = s.Converted.Open(b.FilePath, b.Hash, cacheFormat, embed)
+			if err == nil {
+				s.recordDigest(b, rd.Name())
+			}
+		} else {
+			rd, err = os.Open(b.FilePath)
 		}
-		_, err = io.Copy(w, rd)
-		rd.Close()
 		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "Error handling request")
 			log.Printf("Error handling request for %s: %s\n", r.URL.Path, err)
+			return
 		}
+
+		defer rd.Close()
+
+		tag, modTime := b.Hash, b.ModTime
+		if revision != "" {
+			// the copy changes whenever the metadata does, which may be long after the book was modified
+			tag, modTime = b.Hash+"-"+revision, time.Time{}
+		} else if fi, err := rd.Stat(); err != nil {
+			tag = ""
+		} else {
+			modTime = fi.ModTime()
+			if fi.Size() != b.FileSize || fi.ModTime().Unix() != b.ModTime.Unix() {
+				// the file has changed since it was indexed, so its hash no longer identifies what's being served
+				tag = fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+			}
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+regexp.MustCompile("[[:^ascii:]]").ReplaceAllString(b.Title, "_")+`.`+b.FileType()+`"`)
+		w.Header().Set("Content-Type", bookContentType(b.FileType()))
+		serveBookContent(w, r, tag, modTime, rd)
 	} else {
 		if b.FileType() != "epub" {
 			w.WriteHeader(http.StatusNotFound)
 			io.WriteString(w, "Not found")
 			return
 		}
-		td, err := ioutil.TempDir("", "kepubify")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Error handling request for %s: %s\n", r.URL.Path, err)
-			io.WriteString(w, "Internal Server Error")
-			return
-		}
-		defer os.RemoveAll(td)
-		kepubf := filepath.Join(td, bid+".kepub.epub")
-		err = (&kepub.Converter{}).Convert(b.FilePath, kepubf)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Error handling request for %s: %s\n", r.URL.Path, err)
-			io.WriteString(w, "Internal Server Error - Error converting book")
-			return
-		}
-		rd, err := os.Open(kepubf)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, "Error handling request")
-			log.Printf("Error handling request for %s: %s\n", r.URL.Path, err)
-			return
-		}
+		s.serveConverted(w, r, b, converter.KepubFormat, converter.Kepub)
+	}
+}
+
+// handleConvertedDownload serves a copy of the book converted to the given format.
+func (s *Server) handleConvertedDownload(w http.ResponseWriter, r *http.Request, b *booklist.Book, format string) {
+	if !s.canConvert(b, format) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Not found")
+		return
+	}
+	s.serveConverted(w, r, b, format, converter.EbookConvert(s.Converter))
+}
+
+// serveConverted serves a copy of the book converted to the given cache format by convert, which is cached.
+func (s *Server) serveConverted(w http.ResponseWriter, r *http.Request, b *booklist.Book, format string, convert converter.Func) {
+	cacheFormat, convert, revision, err := s.embedMetadata(b, format, convert)
+	var rd *os.File
+	if err == nil {
+		rd, err = s.Converted.Open(b.FilePath, b.Hash, cacheFormat, convert)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error handling request for %s: %s\n", r.URL.Path, err)
+		io.WriteString(w, "Internal Server Error - Error converting book")
+		return
+	}
+	defer rd.Close()
+
+	tag, modTime := b.Hash+"-"+format, b.ModTime
+	if revision != "" {
+		tag, modTime = b.Hash+"-"+revision+"-"+format, time.Time{}
+	}
+	if format == converter.KepubFormat {
 		w.Header().Set("Content-Disposition", "attachment; filename="+url.PathEscape(b.Title)+".kepub.epub")
 		w.Header().Set("Content-Type", "application/epub+zip")
-		_, err = io.Copy(w, rd)
-		rd.Close()
-		if err != nil {
-			log.Printf("Error handling request for %s: %s\n", r.URL.Path, err)
-		}
+	} else {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+regexp.MustCompile("[[:^ascii:]]").ReplaceAllString(b.Title, "_")+`.`+format+`"`)
+		w.Header().Set("Content-Type", bookContentType(format))
+	}
+	serveBookContent(w, r, tag, modTime, rd)
+}
+
+// serveBookContent serves a book file, or a converted copy of one, with support for range requests (so that readers
+// can seek and interrupted downloads can resume) and conditional requests. tag identifies the content served; it's
+// derived from the book's content hash, so it changes whenever the book does. If tag is empty, no ETag is sent.
+func serveBookContent(w http.ResponseWriter, r *http.Request, tag string, modTime time.Time, content io.ReadSeeker) {
+	if tag != "" {
+		w.Header().Set("ETag", `"`+tag+`"`)
+	}
+	if modTime.Unix() <= 0 {
+		modTime = time.Time{}
+	}
+	http.ServeContent(w, r, "", modTime, content)
+}
+
+// bookContentType returns the MIME type used when serving a book of the given file type.
+func bookContentType(fileType string) string {
+	switch fileType {
+	case "epub", "kepub":
+		return "application/epub+zip"
+	case "pdf":
+		return "application/pdf"
+	case "mobi":
+		return "application/x-mobipocket-ebook"
+	case "azw", "azw3":
+		return "application/vnd.amazon.ebook"
+	default:
+		return "application/octet-stream"
 	}
 }
 
@@ -337,7 +537,7 @@ func (s *Server) handleAuthors(w http.ResponseWriter, r *http.Request, _ httprou
 		return
 	}
 
-	s.render.HTML(w, http.StatusOK, "authors", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusOK, "authors", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Authors",
 		"ShowBar":          true,
@@ -362,6 +562,20 @@ func parseUserSort(s string, defaultKey string, defaultAscending bool) (key stri
 		return pieces[0], pieces[1] == "asc"
 	}
 }
+
+// keywordSortKey returns the default sort key for a keyword search, which is relevance if supported.
+func (s *Server) keywordSortKey() string {
+	if s.storage.Books.KeywordRelevance() {
+		return "relevance"
+	}
+	return "title"
+}
+
+// parseKeywordSort parses the user's sort key for a keyword search, which defaults to keywordSortKey.
+func (s *Server) parseKeywordSort(r *http.Request) (key string, ascending bool) {
+	return parseUserSort(r.URL.Query().Get("sort"), s.keywordSortKey(), true)
+}
+
 func (s *Server) handleAuthor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	aid := p.ByName("id")
 	authors, err := s.storage.Authors.Query(storage.NewQuery().Filtered("id", aid, true))
@@ -374,8 +588,9 @@ func (s *Server) handleAuthor(w http.ResponseWriter, r *http.Request, p httprout
 		author := authors[0]
 		userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
 
-		query := storage.NewQuery().Filtered("authorid", aid, true).SortedBy(userSortKey, userSortAsc)
-		total, err := s.storage.Books.Count(query)
+		query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+		library := s.filterLibrary(r, query)
+		total, err := s.storage.Books.CountByContributor(author.ID, query)
 		if err != nil {
 			s.internalError(w, fmt.Errorf("count-books: %v", err))
 			return
@@ -384,28 +599,30 @@ func (s *Server) handleAuthor(w http.ResponseWriter, r *http.Request, p httprout
 		pagination := NewPagination(r.URL.Query(), total)
 		query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
 
-		bl, err := s.storage.Books.QueryDeps(query)
+		bl, err := s.storage.Books.QueryByContributor(author.ID, query)
 		if err != nil {
 			s.internalError(w, fmt.Errorf("query-books: %v", err))
 			return
 		}
 
-		s.render.HTML(w, http.StatusOK, "author", map[string]interface{}{
-			"CurVersion":       s.version,
-			"PageTitle":        author.Name,
-			"ShowBar":          true,
-			"ShowSearch":       false,
-			"ShowAuthorSearch": false,
-			"ShowSeriesSearch": false,
-			"ShowViewSelector": true,
-			"Title":            author.Name,
-			"Books":            bl,
-			"Pagination":       pagination,
+		s.renderHTML(w, r, http.StatusOK, "author", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           author.Name,
+			"ShowBar":             true,
+			"ShowSearch":          false,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowViewSelector":    true,
+			"ShowLibrarySelector": true,
+			"Title":               author.Name,
+			"Library":             library,
+			"Books":               bl,
+			"Pagination":          pagination,
 		})
 		return
 	}
 
-	s.render.HTML(w, http.StatusNotFound, "notfound", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusNotFound, "notfound", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Not Found",
 		"ShowBar":          false,
@@ -435,7 +652,7 @@ func (s *Server) handleSeriess(w http.ResponseWriter, r *http.Request, _ httprou
 		return
 	}
 
-	s.render.HTML(w, http.StatusOK, "seriess", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusOK, "seriess", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Series",
 		"ShowBar":          true,
@@ -462,6 +679,7 @@ func (s *Server) handleSeries(w http.ResponseWriter, r *http.Request, p httprout
 		series := seriess[0]
 
 		query := storage.NewQuery().Filtered("seriesid", sid, true).SortedBy("seriesindex", true)
+		library := s.filterLibrary(r, query)
 		total, err := s.storage.Books.Count(query)
 		if err != nil {
 			s.internalError(w, err)
@@ -477,22 +695,24 @@ func (s *Server) handleSeries(w http.ResponseWriter, r *http.Request, p httprout
 			return
 		}
 
-		s.render.HTML(w, http.StatusOK, "series", map[string]interface{}{
-			"CurVersion":       s.version,
-			"PageTitle":        series.Name,
-			"ShowBar":          true,
-			"ShowSearch":       false,
-			"ShowAuthorSearch": false,
-			"ShowSeriesSearch": false,
-			"ShowViewSelector": true,
-			"Title":            series.Name,
-			"Books":            bl,
-			"Pagination":       pagination,
+		s.renderHTML(w, r, http.StatusOK, "series", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           series.Name,
+			"ShowBar":             true,
+			"ShowSearch":          false,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowViewSelector":    true,
+			"ShowLibrarySelector": true,
+			"Title":               series.Name,
+			"Library":             library,
+			"Books":               bl,
+			"Pagination":          pagination,
 		})
 		return
 	}
 
-	s.render.HTML(w, http.StatusNotFound, "notfound", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusNotFound, "notfound", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Not Found",
 		"ShowBar":          false,
@@ -505,11 +725,101 @@ func (s *Server) handleSeries(w http.ResponseWriter, r *http.Request, p httprout
 	})
 }
 
-func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "importdate", false)
+func (s *Server) handlePublishers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := storage.NewQuery().SortedBy("name", true)
+	total, err := s.storage.Publishers.Count(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
 
-	query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
-	total, err := s.storage.Books.Count(query)
+	pagination := NewPagination(r.URL.Query(), total)
+	query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+	pl, err := s.storage.Publishers.Query(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	s.renderHTML(w, r, http.StatusOK, "publishers", map[string]interface{}{
+		"CurVersion":          s.version,
+		"PageTitle":           "Publishers",
+		"ShowBar":             true,
+		"ShowSearch":          false,
+		"ShowAuthorSearch":    false,
+		"ShowSeriesSearch":    false,
+		"ShowPublisherSearch": true,
+		"ShowViewSelector":    true,
+		"Title":               "Publishers",
+		"Publishers":          pl,
+		"Pagination":          pagination,
+	})
+}
+
+func (s *Server) handlePublisher(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	pid := p.ByName("id")
+
+	publishers, err := s.storage.Publishers.Query(storage.NewQuery().Filtered("id", pid, true))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	if len(publishers) > 0 {
+		publisher := publishers[0]
+		userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
+
+		query := storage.NewQuery().Filtered("publisherid", pid, true).SortedBy(userSortKey, userSortAsc)
+		library := s.filterLibrary(r, query)
+		total, err := s.storage.Books.Count(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		pagination := NewPagination(r.URL.Query(), total)
+		query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+		bl, err := s.storage.Books.QueryDeps(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		s.renderHTML(w, r, http.StatusOK, "publisher", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           publisher.Name,
+			"ShowBar":             true,
+			"ShowSearch":          false,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowViewSelector":    true,
+			"ShowLibrarySelector": true,
+			"Title":               publisher.Name,
+			"Library":             library,
+			"Books":               bl,
+			"Pagination":          pagination,
+		})
+		return
+	}
+
+	s.renderHTML(w, r, http.StatusNotFound, "notfound", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Not Found",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowAuthorSearch": false,
+		"ShowSeriesSearch": false,
+		"ShowViewSelector": false,
+		"Title":            "Not Found",
+		"Message":          "Publisher not found.",
+	})
+}
+
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := storage.NewQuery().SortedBy("name", true)
+	total, err := s.storage.Tags.Count(query)
 	if err != nil {
 		s.internalError(w, err)
 		return
@@ -518,26 +828,144 @@ func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request, _ httproute
 	pagination := NewPagination(r.URL.Query(), total)
 	query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
 
-	bl, err := s.storage.Books.QueryDeps(query)
+	tl, err := s.storage.Tags.Query(query)
 	if err != nil {
 		s.internalError(w, err)
 		return
 	}
 
-	s.render.HTML(w, http.StatusOK, "books", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusOK, "tags", map[string]interface{}{
 		"CurVersion":       s.version,
-		"PageTitle":        "Books",
+		"PageTitle":        "Tags",
 		"ShowBar":          true,
-		"ShowSearch":       true,
+		"ShowSearch":       false,
 		"ShowAuthorSearch": false,
 		"ShowSeriesSearch": false,
 		"ShowViewSelector": true,
-		"Title":            "",
-		"Books":            bl,
+		"Title":            "Tags",
+		"Tags":             tl,
 		"Pagination":       pagination,
 	})
 }
 
+func (s *Server) handleTag(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	tags, err := s.storage.Tags.Query(storage.NewQuery().Filtered("id", p.ByName("id"), true))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	if len(tags) > 0 {
+		tag := tags[0]
+		userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
+
+		query := storage.NewQuery().Tagged(tag.ID).SortedBy(userSortKey, userSortAsc)
+		library := s.filterLibrary(r, query)
+		total, err := s.storage.Books.Count(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		pagination := NewPagination(r.URL.Query(), total)
+		query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+		bl, err := s.storage.Books.QueryDeps(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		s.renderHTML(w, r, http.StatusOK, "tag", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           tag.Name,
+			"ShowBar":             true,
+			"ShowSearch":          false,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowViewSelector":    true,
+			"ShowLibrarySelector": true,
+			"Title":               tag.Name,
+			"Library":             library,
+			"Books":               bl,
+			"Pagination":          pagination,
+		})
+		return
+	}
+
+	s.renderHTML(w, r, http.StatusNotFound, "notfound", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Not Found",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowAuthorSearch": false,
+		"ShowSeriesSearch": false,
+		"ShowViewSelector": false,
+		"Title":            "Not Found",
+		"Message":          "Tag not found.",
+	})
+}
+
+func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "importdate", false)
+
+	query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+	library := s.filterLibrary(r, query)
+	filter, err := s.filterUserState(r, query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	shelves, err := s.storage.Shelves.ByUser(userID(r))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	total, err := s.storage.Books.Count(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	pagination := NewPagination(r.URL.Query(), total)
+	query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+	bl, err := s.storage.Books.QueryDeps(query)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	// only show Continue Reading at the top of the unfiltered list
+	var reading []readingBook
+	if pagination.ItemOffset == 0 && filter == (bookFilter{}) && library == "" {
+		if reading, err = s.continueReading(r); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+
+	s.renderHTML(w, r, http.StatusOK, "books", map[string]interface{}{
+		"CurVersion":          s.version,
+		"PageTitle":           "Books",
+		"ShowBar":             true,
+		"ShowSearch":          true,
+		"ShowAuthorSearch":    false,
+		"ShowSeriesSearch":    false,
+		"ShowViewSelector":    true,
+		"ShowLibrarySelector": true,
+		"ShowFilters":         true,
+		"Title":               "",
+		"Library":             library,
+		"Filter":              filter,
+		"Shelves":             shelves,
+		"Continue":            reading,
+		"Books":               bl,
+		"Pagination":          pagination,
+	})
+}
+
 func (s *Server) handleBook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	bid := p.ByName("id")
 	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().Filtered("id", bid, true))
@@ -548,7 +976,25 @@ func (s *Server) handleBook(w http.ResponseWriter, r *http.Request, p httprouter
 
 	if len(bl) > 0 {
 		b := bl[0]
-		s.render.HTML(w, http.StatusOK, "book", map[string]interface{}{
+		state, err := s.storage.Statuses.ByBook(userID(r), b.ID)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		shelves, err := s.storage.Shelves.ByUser(userID(r))
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+		var progress *readingBook
+		if pos, err := s.storage.Positions.Latest(userID(r), b.ID); err != nil {
+			s.internalError(w, err)
+			return
+		} else if pos != nil {
+			progress = &readingBook{Book: b, Position: pos}
+		}
+
+		s.renderHTML(w, r, http.StatusOK, "book", map[string]interface{}{
 			"CurVersion":       s.version,
 			"PageTitle":        b.Title,
 			"ShowBar":          false,
@@ -558,11 +1004,15 @@ func (s *Server) handleBook(w http.ResponseWriter, r *http.Request, p httprouter
 			"ShowViewSelector": false,
 			"Title":            "",
 			"Book":             b,
+			"State":            state,
+			"Shelves":          shelves,
+			"Progress":         progress,
+			"CanEdit":          s.canEdit(r),
 		})
 		return
 	}
 
-	s.render.HTML(w, http.StatusNotFound, "notfound", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusNotFound, "notfound", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Not Found",
 		"ShowBar":          false,
@@ -579,9 +1029,10 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request, _ httprout
 	q := r.URL.Query().Get("q")
 
 	if len(q) != 0 {
-		userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
+		userSortKey, userSortAsc := s.parseKeywordSort(r)
 
 		query := storage.NewQuery().SortedBy(userSortKey, userSortAsc)
+		library := s.filterLibrary(r, query)
 		total, err := s.storage.Books.CountKeyword(q, query)
 		if err != nil {
 			s.internalError(w, err)
@@ -595,32 +1046,36 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request, _ httprout
 			return
 		}
 
-		s.render.HTML(w, http.StatusOK, "search", map[string]interface{}{
-			"CurVersion":       s.version,
-			"PageTitle":        "Search Results",
-			"ShowBar":          true,
-			"ShowSearch":       true,
-			"ShowAuthorSearch": false,
-			"ShowSeriesSearch": false,
-			"ShowViewSelector": true,
-			"Title":            "Search Results",
-			"Query":            q,
-			"Books":            bl,
-			"Pagination":       pagination,
+		s.renderHTML(w, r, http.StatusOK, "search", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           "Search Results",
+			"ShowBar":             true,
+			"ShowSearch":          true,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowViewSelector":    true,
+			"ShowLibrarySelector": true,
+			"Title":               "Search Results",
+			"Library":             library,
+			"Query":               q,
+			"Books":               bl,
+			"Pagination":          pagination,
 		})
 		return
 	}
 
-	s.render.HTML(w, http.StatusOK, "search", map[string]interface{}{
-		"CurVersion":       s.version,
-		"PageTitle":        "Search",
-		"ShowBar":          true,
-		"ShowSearch":       true,
-		"ShowAuthorSearch": false,
-		"ShowSeriesSearch": false,
-		"ShowViewSelector": false,
-		"Title":            "Search",
-		"Query":            "",
+	s.renderHTML(w, r, http.StatusOK, "search", map[string]interface{}{
+		"CurVersion":          s.version,
+		"PageTitle":           "Search",
+		"ShowBar":             true,
+		"ShowSearch":          true,
+		"ShowAuthorSearch":    false,
+		"ShowSeriesSearch":    false,
+		"ShowViewSelector":    false,
+		"ShowLibrarySelector": true,
+		"Title":               "Search",
+		"Library":             s.libraryLabel(r),
+		"Query":               "",
 	})
 }
 
@@ -646,7 +1101,7 @@ func (s *Server) handleSearchAuthors(w http.ResponseWriter, r *http.Request, _ h
 			return
 		}
 
-		s.render.HTML(w, http.StatusOK, "authors", map[string]interface{}{
+		s.renderHTML(w, r, http.StatusOK, "authors", map[string]interface{}{
 			"CurVersion":       s.version,
 			"PageTitle":        "Author Search Results",
 			"ShowBar":          true,
@@ -662,7 +1117,7 @@ func (s *Server) handleSearchAuthors(w http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
-	s.render.HTML(w, http.StatusOK, "authors", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusOK, "authors", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Search Authors",
 		"ShowBar":          true,
@@ -697,7 +1152,7 @@ func (s *Server) handleSearchSeries(w http.ResponseWriter, r *http.Request, _ ht
 			return
 		}
 
-		s.render.HTML(w, http.StatusOK, "seriess", map[string]interface{}{
+		s.renderHTML(w, r, http.StatusOK, "seriess", map[string]interface{}{
 			"CurVersion":       s.version,
 			"PageTitle":        "Series Search Results",
 			"ShowBar":          true,
@@ -713,7 +1168,7 @@ func (s *Server) handleSearchSeries(w http.ResponseWriter, r *http.Request, _ ht
 		return
 	}
 
-	s.render.HTML(w, http.StatusOK, "seriess", map[string]interface{}{
+	s.renderHTML(w, r, http.StatusOK, "seriess", map[string]interface{}{
 		"CurVersion":       s.version,
 		"PageTitle":        "Search Series",
 		"ShowBar":          true,
@@ -726,8 +1181,63 @@ func (s *Server) handleSearchSeries(w http.ResponseWriter, r *http.Request, _ ht
 	})
 }
 
+func (s *Server) handleSearchPublishers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query().Get("q")
+
+	if len(q) != 0 {
+		userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "name", true)
+
+		query := storage.NewQuery().Filtered("name", q, false).SortedBy(userSortKey, userSortAsc)
+		total, err := s.storage.Publishers.Count(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		pagination := NewPagination(r.URL.Query(), total)
+		query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+		pl, err := s.storage.Publishers.Query(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		s.renderHTML(w, r, http.StatusOK, "publishers", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           "Publisher Search Results",
+			"ShowBar":             true,
+			"ShowSearch":          false,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowPublisherSearch": true,
+			"ShowViewSelector":    true,
+			"Title":               "Publisher Search Results",
+			"PublisherQuery":      q,
+			"Publishers":          pl,
+			"Pagination":          pagination,
+		})
+		return
+	}
+
+	s.renderHTML(w, r, http.StatusOK, "publishers", map[string]interface{}{
+		"CurVersion":          s.version,
+		"PageTitle":           "Search Publishers",
+		"ShowBar":             true,
+		"ShowSearch":          false,
+		"ShowAuthorSearch":    false,
+		"ShowSeriesSearch":    false,
+		"ShowPublisherSearch": true,
+		"ShowViewSelector":    false,
+		"Title":               "Search Publishers",
+		"PublisherQuery":      "",
+	})
+}
+
 func (s *Server) handleRandom(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bl, err := s.storage.Books.Query(storage.NewQuery().Random().Take(1))
+	query := storage.NewQuery().Random().Take(1)
+	library := s.filterLibrary(r, query)
+	bl, err := s.storage.Books.Query(query)
 	if err != nil {
 		s.internalError(w, err)
 		return
@@ -735,7 +1245,7 @@ func (s *Server) handleRandom(w http.ResponseWriter, r *http.Request, _ httprout
 
 	if len(bl) == 0 {
 		// empty database
-		s.render.HTML(w, http.StatusOK, "search", map[string]interface{}{
+		s.renderHTML(w, r, http.StatusOK, "search", map[string]interface{}{
 			"CurVersion":       s.version,
 			"PageTitle":        "Search",
 			"ShowBar":          true,
@@ -744,6 +1254,7 @@ func (s *Server) handleRandom(w http.ResponseWriter, r *http.Request, _ httprout
 			"ShowAuthorSearch": false,
 			"ShowViewSelector": false,
 			"Title":            "Search",
+			"Library":          library,
 			"Query":            "",
 		})
 	} else {
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/sblinch/BookBrowser/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTags(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	books := addTestBooks(t, s, stor, "Alpha", "Beta", "Gamma")
+
+	books[0].AddTag("Fantasy")
+	books[1].AddTag("fantasy")
+	books[1].AddTag("Dragons")
+	require.NoError(t, stor.Books.Save(books[0], books[1]))
+	tl, err := stor.Tags.Query(storage.NewQuery().Filtered("name", "FANTASY", true))
+	require.NoError(t, err)
+	require.Len(t, tl, 1)
+	fantasy := tl[0]
+
+	w := get(s, "/tags", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`<a href="/tags/%d" class="item">Fantasy</a>`, fantasy.ID))
+	assert.Contains(t, w.Body.String(), ">Dragons</a>")
+	assert.NotContains(t, w.Body.String(), ">fantasy</a>")
+
+	w = get(s, fmt.Sprintf("/tags/%d", fantasy.ID), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Alpha")
+	assert.Contains(t, w.Body.String(), "Beta")
+	assert.NotContains(t, w.Body.String(), "Gamma")
+
+	w = get(s, "/tags/9999", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
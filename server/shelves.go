@@ -0,0 +1,316 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// userID returns the ID of the user who made the request. When authentication is disabled, everyone shares the
+// statuses, favourites and shelves of user 0.
+func userID(r *http.Request) int {
+	if user := currentUser(r); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+// bookFilter is the read status, favourites or shelf selected on the books page.
+type bookFilter struct {
+	Status     booklist.ReadStatus
+	Favourites bool
+	Shelf      *booklist.Shelf
+}
+
+// filterUserState restricts a book query to the read status, favourites or shelf selected by the request's status,
+// favourites and shelf parameters, and returns the selection for use in templates.
+func (s *Server) filterUserState(r *http.Request, query *storage.Query) (bookFilter, error) {
+	var f bookFilter
+	uid := userID(r)
+	v := r.URL.Query()
+
+	if f.Status = booklist.ParseReadStatus(v.Get("status")); f.Status != booklist.StatusNone {
+		query.WithStatus(uid, f.Status)
+	}
+	if f.Favourites = v.Get("favourites") != ""; f.Favourites {
+		query.Favourited(uid)
+	}
+	if id, err := strconv.Atoi(v.Get("shelf")); err == nil {
+		shelf, err := s.storage.Shelves.ByID(uid, id)
+		if err != nil {
+			return f, err
+		}
+		if f.Shelf = shelf; shelf != nil {
+			query.Shelved(shelf.ID)
+		}
+	}
+	return f, nil
+}
+
+// bookID parses the book ID from a route, returning 0 if the book doesn't exist.
+func (s *Server) bookID(p httprouter.Params) (int, error) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		return 0, nil
+	}
+	total, err := s.storage.Books.Count(storage.NewQuery().In("id", []int{id}))
+	if err != nil || total == 0 {
+		return 0, err
+	}
+	return id, nil
+}
+
+// redirectToBook sends the user back to the book's page after changing its status or shelves.
+func redirectToBook(w http.ResponseWriter, r *http.Request, bookID int) {
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", bookID), http.StatusSeeOther)
+}
+
+func (s *Server) handleBookStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bid, err := s.bookID(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if bid == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.storage.Statuses.SetStatus(userID(r), bid, booklist.ParseReadStatus(r.PostFormValue("status"))); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	redirectToBook(w, r, bid)
+}
+
+func (s *Server) handleBookFavourite(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bid, err := s.bookID(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if bid == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.storage.Statuses.SetFavourite(userID(r), bid, r.PostFormValue("favourite") == "1"); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	redirectToBook(w, r, bid)
+}
+
+// handleBookShelves puts a book on one of the user's shelves (creating the shelf if a new name is given), or takes it
+// off a shelf if remove is set.
+func (s *Server) handleBookShelves(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bid, err := s.bookID(p)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if bid == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	uid := userID(r)
+	var shelf *booklist.Shelf
+	if name := strings.TrimSpace(r.PostFormValue("name")); name != "" {
+		shelf, err = s.shelfNamed(uid, name)
+	} else if id, convErr := strconv.Atoi(r.PostFormValue("shelf")); convErr == nil {
+		shelf, err = s.storage.Shelves.ByID(uid, id)
+	}
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	if shelf != nil {
+		if r.PostFormValue("remove") != "" {
+			err = s.storage.Shelves.RemoveBook(shelf.ID, bid)
+		} else {
+			err = s.storage.Shelves.AddBook(shelf.ID, bid)
+		}
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+	redirectToBook(w, r, bid)
+}
+
+// shelfNamed returns the user's shelf with the given name, creating it if it doesn't exist.
+func (s *Server) shelfNamed(uid int, name string) (*booklist.Shelf, error) {
+	shelf, err := s.storage.Shelves.ByName(uid, name)
+	if shelf != nil || err != nil {
+		return shelf, err
+	}
+	shelf = &booklist.Shelf{UserID: uid, Name: name}
+	return shelf, s.storage.Shelves.Save(shelf)
+}
+
+func (s *Server) handleShelves(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	shelves, err := s.storage.Shelves.ByUser(userID(r))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	s.renderHTML(w, r, http.StatusOK, "shelves", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Shelves",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowAuthorSearch": false,
+		"ShowSeriesSearch": false,
+		"ShowViewSelector": false,
+		"Title":            "Shelves",
+		"Shelves":          shelves,
+	})
+}
+
+func (s *Server) handleShelvesCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if name := strings.TrimSpace(r.PostFormValue("name")); name != "" {
+		if _, err := s.shelfNamed(userID(r), name); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+	http.Redirect(w, r, "/shelves", http.StatusSeeOther)
+}
+
+func (s *Server) handleShelfDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _ := strconv.Atoi(p.ByName("id"))
+	shelf, err := s.storage.Shelves.ByID(userID(r), id)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if shelf != nil {
+		if err := s.storage.Shelves.Delete(shelf.ID); err != nil {
+			s.internalError(w, err)
+			return
+		}
+	}
+	http.Redirect(w, r, "/shelves", http.StatusSeeOther)
+}
+
+// handleShelfKobo starts or stops syncing a shelf's books to the user's Kobo.
+func (s *Server) handleShelfKobo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _ := strconv.Atoi(p.ByName("id"))
+	shelf, err := s.storage.Shelves.ByID(userID(r), id)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if shelf == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	shelf.Kobo = r.PostFormValue("kobo") == "1"
+	if err := s.storage.Shelves.Save(shelf); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/shelves/%d", shelf.ID), http.StatusSeeOther)
+}
+
+func (s *Server) handleShelf(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _ := strconv.Atoi(p.ByName("id"))
+	shelf, err := s.storage.Shelves.ByID(userID(r), id)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	if shelf != nil {
+		userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
+
+		query := storage.NewQuery().Shelved(shelf.ID).SortedBy(userSortKey, userSortAsc)
+		library := s.filterLibrary(r, query)
+		total, err := s.storage.Books.Count(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		pagination := NewPagination(r.URL.Query(), total)
+		query.Skip(pagination.ItemOffset).Take(pagination.ItemLimit)
+
+		bl, err := s.storage.Books.QueryDeps(query)
+		if err != nil {
+			s.internalError(w, err)
+			return
+		}
+
+		s.renderHTML(w, r, http.StatusOK, "shelf", map[string]interface{}{
+			"CurVersion":          s.version,
+			"PageTitle":           shelf.Name,
+			"ShowBar":             true,
+			"ShowSearch":          false,
+			"ShowAuthorSearch":    false,
+			"ShowSeriesSearch":    false,
+			"ShowViewSelector":    true,
+			"ShowLibrarySelector": true,
+			"Title":               shelf.Name,
+			"Library":             library,
+			"Shelf":               shelf,
+			"Books":               bl,
+			"Pagination":          pagination,
+		})
+		return
+	}
+
+	s.renderHTML(w, r, http.StatusNotFound, "notfound", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Not Found",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowAuthorSearch": false,
+		"ShowSeriesSearch": false,
+		"ShowViewSelector": false,
+		"Title":            "Not Found",
+		"Message":          "Shelf not found.",
+	})
+}
+
+func (s *Server) handleOPDSShelves(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	shelves, err := s.storage.Shelves.ByUser(userID(r))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	f := newOPDSFeed("urn:bookbrowser:shelves", "Shelves", "/opds/shelves", opdsNavigationType)
+	for _, shelf := range shelves {
+		f.addNavigation(fmt.Sprintf("urn:bookbrowser:shelf:%d", shelf.ID), shelf.Name, "Books on the "+shelf.Name+" shelf", fmt.Sprintf("/opds/shelves/%d", shelf.ID), "subsection", opdsAcquisitionType)
+	}
+
+	s.writeOPDS(w, opdsNavigationType, f)
+}
+
+func (s *Server) handleOPDSShelf(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _ := strconv.Atoi(p.ByName("id"))
+	shelf, err := s.storage.Shelves.ByID(userID(r), id)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if shelf == nil {
+		s.opdsNotFound(w, "Shelf not found.")
+		return
+	}
+
+	userSortKey, userSortAsc := parseUserSort(r.URL.Query().Get("sort"), "title", true)
+
+	base := fmt.Sprintf("/opds/shelves/%d", shelf.ID)
+	f := newOPDSFeed(fmt.Sprintf("urn:bookbrowser:shelf:%d", shelf.ID), shelf.Name, base, opdsAcquisitionType)
+	s.opdsBookFeed(w, r, f, base, storage.NewQuery().Shelved(shelf.ID).SortedBy(userSortKey, userSortAsc))
+}
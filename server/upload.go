@@ -0,0 +1,447 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/formats"
+	"github.com/sblinch/BookBrowser/formatters"
+	"github.com/sblinch/BookBrowser/indexer"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// DefaultUploadPath is the template for the pathnames of uploaded books used unless SetUploadPath is called.
+const DefaultUploadPath = "{{.Author}}/{{.Title}}"
+
+// the largest book that may be uploaded
+const maxUploadSize = 512 * 1024 * 1024
+
+// the longest name of a directory or file created for an uploaded book, in characters
+const maxUploadNameLength = 100
+
+// uploadPathData holds the values available to the upload path template. Each value has been made safe for use as
+// a file or directory name, so directories are only created by the template's own slashes.
+type uploadPathData struct {
+	Title       string
+	Author      string
+	Series      string
+	SeriesIndex string
+	Publisher   string
+	ISBN        string
+	Year        string
+}
+
+// SetUploadPath sets the template for the pathnames of uploaded books, relative to the library they're uploaded to.
+// It's a Go text/template which can use .Title, .Author, .Series, .SeriesIndex, .Publisher, .ISBN and .Year, and
+// the book's file extension is appended to it.
+func (s *Server) SetUploadPath(pathTemplate string) error {
+	t, err := template.New("upload").Option("missingkey=error").Parse(pathTemplate)
+	if err != nil {
+		return err
+	}
+	// catch references to unknown fields now rather than on the first upload
+	if err := t.Execute(ioutil.Discard, &uploadPathData{}); err != nil {
+		return err
+	}
+	s.uploadPath = t
+	return nil
+}
+
+// safeName makes a metadata value safe to use as a file or directory name.
+func safeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if r := []rune(s); len(r) > maxUploadNameLength {
+		s = string(r[:maxUploadNameLength])
+	}
+	// names starting with a dot are hidden and Windows doesn't allow names ending with one, and separators are left
+	// dangling at the ends of names by template values which are unset, such as "{{.Year}} - {{.Title}}"
+	return strings.Trim(strings.TrimSpace(s), ". -_")
+}
+
+// uploadPathname returns the pathname, without an extension, at which to place an uploaded book in a library.
+func (s *Server) uploadPathname(l *Library, b *booklist.Book, filename string) (string, error) {
+	d := &uploadPathData{
+		Title:     safeName(b.Title),
+		Series:    safeName(b.FieldValue(booklist.FieldSeries)),
+		Publisher: safeName(b.FieldValue(booklist.FieldPublisher)),
+		ISBN:      safeName(b.ISBN),
+	}
+	if authors := b.Authors(); len(authors) > 0 {
+		d.Author = safeName(authors[0])
+	}
+	if d.Title == "" {
+		d.Title = safeName(strings.TrimSuffix(filename, filepath.Ext(filename)))
+	}
+	if d.Title == "" {
+		d.Title = b.Hash
+	}
+	if d.Author == "" {
+		d.Author = "Unknown"
+	}
+	if d.Series != "" {
+		d.SeriesIndex = strconv.FormatFloat(b.SeriesIndex, 'f', -1, 64)
+	}
+	if !b.PublishDate.IsZero() {
+		d.Year = strconv.Itoa(b.PublishDate.Year())
+	}
+
+	var buf bytes.Buffer
+	if err := s.uploadPath.Execute(&buf, d); err != nil {
+		return "", err
+	}
+
+	// drop the empty directories left by unset values, such as the series of a book which isn't in one
+	parts := strings.Split(filepath.ToSlash(buf.String()), "/")
+	names := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = safeName(part); part != "" {
+			names = append(names, part)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, d.Title)
+	}
+	return filepath.Join(append([]string{l.Path}, names...)...), nil
+}
+
+// placeFile moves src to dst without replacing an existing file at dst.
+func placeFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsExist(err) {
+		if err == nil {
+			os.Remove(src)
+		}
+		return err
+	}
+
+	// hard links can't cross filesystems (and some filesystems don't support them), so copy the file instead
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// stageUpload saves an uploaded book to a temporary file in the data directory, where it's checked before it's added
+// to a library. The caller must remove the file.
+func (s *Server) stageUpload(file io.Reader, ext string) (string, error) {
+	dir := filepath.Join(s.DataDir, "uploads")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// keep the extension, which is how formats.Load identifies the format
+	tmp, err := ioutil.TempFile(dir, "upload-*."+ext)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, file)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// placeUpload moves a staged upload into a library at the pathname given by the upload path template, numbering it
+// if another file already has that name, and returns the pathname.
+func (s *Server) placeUpload(l *Library, b *booklist.Book, staged, filename string) (string, error) {
+	base, err := s.uploadPathname(l, b, filename)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return "", err
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	for n := 1; ; n++ {
+		pathname := base + ext
+		if n > 1 {
+			pathname = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		if err := placeFile(staged, pathname); err == nil {
+			return pathname, nil
+		} else if !os.IsExist(err) || n == 100 {
+			return "", err
+		}
+	}
+}
+
+// indexUpload indexes an uploaded book and returns its ID.
+func (s *Server) indexUpload(pathname string) (int, error) {
+	errs, err := s.Indexer.IndexPaths([]string{pathname})
+	if err != nil {
+		return 0, err
+	}
+	if len(errs) > 0 {
+		return 0, errs[0]
+	}
+
+	bl, err := s.storage.Books.Query(storage.NewQuery().Filtered("pathname", pathname, true))
+	if err != nil {
+		return 0, err
+	}
+	if len(bl) == 0 {
+		return 0, fmt.Errorf("%s was not indexed", pathname)
+	}
+	return bl[0].ID, nil
+}
+
+// indexUploadLater indexes an uploaded book once the indexing that was in progress when it was uploaded finishes, then
+// removes its hash from the pending uploads.
+func (s *Server) indexUploadLater(pathname, hash string) {
+	for {
+		time.Sleep(time.Second)
+		s.uploadMu.Lock()
+		_, err := s.indexUpload(pathname)
+		if err != indexer.ErrIndexingActive {
+			delete(s.pendingUploads, hash)
+		}
+		s.uploadMu.Unlock()
+		if err != indexer.ErrIndexingActive {
+			if err != nil {
+				log.Printf("Error indexing uploaded book %s: %v", pathname, err)
+			}
+			return
+		}
+	}
+}
+
+// uploadExts returns the extensions of the formats which can be uploaded, sorted.
+func uploadExts() []string {
+	exts := formats.GetExts()
+	sort.Strings(exts)
+	return exts
+}
+
+// uploadLibrary returns the library selected by the upload's library parameter (its label), or the first library.
+func (s *Server) uploadLibrary(r *http.Request) (*Library, error) {
+	label := r.FormValue("library")
+	if label == "" {
+		return &s.Libraries[0], nil
+	}
+	for n := range s.Libraries {
+		if s.Libraries[n].Label == label {
+			return &s.Libraries[n], nil
+		}
+	}
+	return nil, fmt.Errorf("library %q doesn't exist", label)
+}
+
+// canUpload reports whether the user who made the request may upload books. Since uploads add files to the library,
+// they are only allowed without authentication if the server was configured to allow them.
+func (s *Server) canUpload(r *http.Request) bool {
+	return s.canEdit(r) && (s.auth || s.AllowUpload)
+}
+
+// requireUploader wraps handle so that it may only be used by users who may upload books.
+func (s *Server) requireUploader(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.canUpload(r) {
+			s.renderForbidden(w, r, "Uploading books is disabled.")
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// requireAPIUploader is the equivalent of requireUploader for API handlers.
+func (s *Server) requireAPIUploader(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.canUpload(r) {
+			s.apiError(w, http.StatusForbidden, errors.New("uploading books is disabled"))
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// receiveUpload parses an upload request, checks the uploaded book, adds it to the selected library and indexes it. It
+// returns the ID of the new book, which is 0 if indexing was in progress, in which case the book is indexed once it
+// finishes. If there is an error, status is the HTTP status to respond with; for duplicates it's 409 Conflict, and id
+// is the existing book's ID unless it hasn't been indexed yet. form is true for uploads from the upload
+// form, which must be submitted with the form's token (see csrfToken).
+func (s *Server) receiveUpload(w http.ResponseWriter, r *http.Request, form bool) (id int, status int, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("invalid upload: %v", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+	if form && !validCSRF(r) {
+		return 0, http.StatusForbidden, errors.New("the form has expired; reload the page and try again")
+	}
+
+	l, err := s.uploadLibrary(r)
+	if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return 0, http.StatusBadRequest, errors.New("no book was uploaded")
+	}
+	defer file.Close()
+
+	filename := filepath.Base(header.Filename)
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	exts := uploadExts()
+	if n := sort.SearchStrings(exts, ext); n == len(exts) || exts[n] != ext {
+		return 0, http.StatusBadRequest, fmt.Errorf("%s files can't be uploaded; the supported formats are %s", filename, strings.Join(exts, ", "))
+	}
+
+	staged, err := s.stageUpload(file, ext)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	defer os.Remove(staged)
+
+	bi, err := formats.Load(staged)
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("%s is not a valid %s book: %v", filename, ext, err)
+	}
+	b := bi.Book()
+	formatters.Apply(b)
+
+	// another upload of the same book can't be added between checking for it and indexing this one
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	if s.pendingUploads[b.Hash] {
+		return 0, http.StatusConflict, fmt.Errorf("%s has already been uploaded, and will appear once the library has finished indexing", filename)
+	}
+	bl, err := s.storage.Books.Query(storage.NewQuery().Filtered("hash", b.Hash, true))
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	if len(bl) > 0 {
+		return bl[0].ID, http.StatusConflict, fmt.Errorf("%s is already in the library", filename)
+	}
+
+	pathname, err := s.placeUpload(l, b, staged, filename)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	log.Printf("Uploaded %s to %s", filename, pathname)
+
+	id, err = s.indexUpload(pathname)
+	if err == indexer.ErrIndexingActive {
+		s.pendingUploads[b.Hash] = true
+		go s.indexUploadLater(pathname, b.Hash)
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	return id, 0, nil
+}
+
+// renderUpload renders the upload form with a message, and a link to the existing book if a duplicate was uploaded.
+func (s *Server) renderUpload(w http.ResponseWriter, r *http.Request, status int, message string, existing int) {
+	exts := uploadExts()
+	for k := range exts {
+		exts[k] = "." + exts[k]
+	}
+	s.renderHTML(w, r, status, "upload", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Upload",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowAuthorSearch": false,
+		"ShowSeriesSearch": false,
+		"ShowViewSelector": false,
+		"Title":            "Upload a Book",
+		"Accept":           strings.Join(exts, ","),
+		"UploadLibraries":  s.Libraries,
+		"Message":          message,
+		"Error":            status >= http.StatusBadRequest,
+		"Existing":         existing,
+	})
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.renderUpload(w, r, http.StatusOK, "", 0)
+}
+
+func (s *Server) handleUploadPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id, status, err := s.receiveUpload(w, r, true)
+	if status == http.StatusInternalServerError {
+		s.internalError(w, err)
+		return
+	} else if status == http.StatusConflict {
+		s.renderUpload(w, r, status, err.Error(), id)
+		return
+	} else if err != nil {
+		s.renderUpload(w, r, status, err.Error(), 0)
+		return
+	}
+	if id == 0 {
+		s.renderUpload(w, r, http.StatusAccepted, "The book was uploaded, and will appear once the library has finished indexing.", 0)
+		return
+	}
+	redirectToBook(w, r, id)
+}
+
+// apiUploadPending is the response to an upload that couldn't be indexed immediately.
+type apiUploadPending struct {
+	Message string `json:"message"`
+}
+
+func (s *Server) handleAPIUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id, status, err := s.receiveUpload(w, r, false)
+	if status == http.StatusConflict && id != 0 {
+		s.render.JSON(w, status, &apiErrorResponse{Error: err.Error() + fmt.Sprintf(" (book %d)", id)})
+		return
+	} else if err != nil {
+		s.apiError(w, status, err)
+		return
+	}
+	if id == 0 {
+		s.render.JSON(w, http.StatusAccepted, &apiUploadPending{Message: "the book was uploaded, and will be indexed once indexing finishes"})
+		return
+	}
+
+	bl, err := s.storage.Books.QueryDeps(storage.NewQuery().In("id", []int{id}))
+	if err != nil || len(bl) == 0 {
+		s.apiError(w, http.StatusInternalServerError, fmt.Errorf("error loading uploaded book %d: %v", id, err))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/books/%d", id))
+	s.render.JSON(w, http.StatusCreated, newAPIBook(bl[0]))
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/formats"
+	"github.com/sblinch/BookBrowser/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeName(t *testing.T) {
+	for _, c := range []struct{ in, out string }{
+		{"Dragon Tales", "Dragon Tales"},
+		{"", ""},
+		{"..", ""},
+		{"../../etc/passwd", "etc_passwd"},
+		{`..\..\Windows`, "Windows"},
+		{"Who? Me: A Memoir", "Who_ Me_ A Memoir"},
+		{"Tab\there", "Tab_here"},
+		{"  .hidden.  ", "hidden"},
+		{" - ", ""},
+		{strings.Repeat("é", 150), strings.Repeat("é", maxUploadNameLength)},
+	} {
+		assert.Equal(t, c.out, safeName(c.in), "for %q", c.in)
+	}
+}
+
+func TestUploadPathname(t *testing.T) {
+	l := &Library{Label: "books", Path: "/books"}
+	for _, c := range []struct {
+		name     string
+		template string
+		title    string
+		author   string
+		series   string
+		filename string
+		out      string
+	}{
+		{"default", DefaultUploadPath, "Dragon Tales", "Jane Doe", "", "dragon.epub", "Jane Doe/Dragon Tales"},
+		{"traversal in values", DefaultUploadPath, "../../Dragon Tales", "../..", "", "dragon.epub", "Unknown/Dragon Tales"},
+		{"separators in values", DefaultUploadPath, "Dragon/Tales", `Jane\Doe`, "", "dragon.epub", "Jane_Doe/Dragon_Tales"},
+		{"traversal in template", "{{.Author}}/../../{{.Title}}", "Dragon Tales", "Jane Doe", "", "dragon.epub", "Jane Doe/Dragon Tales"},
+		{"empty segments", "{{.Author}}/{{.Series}}//{{.Title}}", "Dragon Tales", "Jane Doe", "", "dragon.epub", "Jane Doe/Dragon Tales"},
+		{"series", "{{.Series}}/{{.SeriesIndex}} - {{.Title}}", "Dragon Tales", "Jane Doe", "Dragons", "dragon.epub", "Dragons/2 - Dragon Tales"},
+		{"unset values", "{{.Series}}/{{.Year}} - {{.Title}}", "Dragon Tales", "Jane Doe", "", "dragon.epub", "Dragon Tales"},
+		{"title from filename", DefaultUploadPath, "", "Jane Doe", "", "..dragon tales.epub", "Jane Doe/dragon tales"},
+		{"title from hash", DefaultUploadPath, "", "", "", "..epub", "Unknown/0123abcd"},
+		{"only unset values", "{{.Series}}", "Dragon Tales", "Jane Doe", "", "dragon.epub", "Dragon Tales"},
+		{"long names", DefaultUploadPath, strings.Repeat("a", 150), "Jane Doe", "", "dragon.epub", "Jane Doe/" + strings.Repeat("a", maxUploadNameLength)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Server{}
+			require.NoError(t, s.SetUploadPath(c.template))
+
+			b := &booklist.Book{Hash: "0123abcd", Title: c.title, SeriesIndex: 2}
+			if c.author != "" {
+				b.AddContributor(c.author, booklist.RoleAuthor)
+			}
+			if c.series != "" {
+				b.Series = &booklist.Series{Name: c.series}
+			}
+
+			pathname, err := s.uploadPathname(l, b, c.filename)
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(l.Path, filepath.FromSlash(c.out)), pathname)
+		})
+	}
+}
+
+// upload uploads a book through the API.
+func upload(t *testing.T, s *Server, filename string) *httptest.ResponseRecorder {
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filepath.Base(filename))
+	require.NoError(t, err)
+	fw.Write(content)
+	require.NoError(t, mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/books", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set(csrfHeader, "XMLHttpRequest")
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadDuplicate(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	s.AllowUpload = true
+
+	filename := filepath.Join(s.DataDir, "dragon.epub")
+	writeTestEPUB(t, filename, "Dragon Tales", "Jane Doe")
+
+	w := upload(t, s, filename)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var b apiBook
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	assert.Equal(t, "Dragon Tales", b.Title)
+	_, err := os.Stat(filepath.Join(s.Libraries[0].Path, "Jane Doe", "Dragon Tales.epub"))
+	assert.NoError(t, err)
+
+	// the same book again, even under another name, is linked to the existing one
+	renamed := filepath.Join(s.DataDir, "copy.epub")
+	require.NoError(t, os.Link(filename, renamed))
+	w = upload(t, s, renamed)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "is already in the library")
+	assert.Contains(t, w.Body.String(), "(book ")
+	_, err = os.Stat(filepath.Join(s.Libraries[0].Path, "Jane Doe", "Dragon Tales (2).epub"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a book waiting to be indexed is a duplicate too, although it doesn't have an ID yet
+	pending := filepath.Join(s.DataDir, "pending.epub")
+	writeTestEPUB(t, pending, "Pending Tales", "Jane Doe")
+	bi, err := formats.Load(pending)
+	require.NoError(t, err)
+	s.pendingUploads[bi.Book().Hash] = true
+	w = upload(t, s, pending)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "has already been uploaded")
+	assert.NotContains(t, w.Body.String(), "(book ")
+}
+
+func TestUploadConcurrent(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+	s.AllowUpload = true
+
+	filename := filepath.Join(s.DataDir, "dragon.epub")
+	writeTestEPUB(t, filename, "Dragon Tales", "Jane Doe")
+
+	const uploads = 5
+	var wg sync.WaitGroup
+	codes := make([]int, uploads)
+	for n := 0; n < uploads; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			codes[n] = upload(t, s, filename).Code
+		}(n)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusConflict, code)
+		}
+	}
+	assert.Equal(t, 1, created)
+
+	bl, err := stor.Books.Query(storage.NewQuery())
+	require.NoError(t, err)
+	assert.Len(t, bl, 1)
+	files, err := ioutil.ReadDir(filepath.Join(s.Libraries[0].Path, "Jane Doe"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestIndexUploadLater(t *testing.T) {
+	s, stor, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pathname := filepath.Join(s.Libraries[0].Path, "Jane Doe", "Dragon Tales.epub")
+	writeTestEPUB(t, pathname, "Dragon Tales", "Jane Doe")
+	s.pendingUploads["0123abcd"] = true
+
+	done := make(chan struct{})
+	go func() {
+		s.indexUploadLater(pathname, "0123abcd")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upload wasn't indexed")
+	}
+
+	bl, err := stor.Books.Query(storage.NewQuery())
+	require.NoError(t, err)
+	assert.Len(t, bl, 1)
+	s.uploadMu.Lock()
+	assert.False(t, s.pendingUploads["0123abcd"])
+	s.uploadMu.Unlock()
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/sblinch/BookBrowser/storage"
+)
+
+// minPasswordLength is the shortest password accepted for a user.
+const minPasswordLength = 8
+
+func (s *Server) renderAccount(w http.ResponseWriter, r *http.Request, status int, message, token string) {
+	s.renderHTML(w, r, status, "account", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Account",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowViewSelector": false,
+		"Title":            "Account",
+		"Message":          message,
+		"Token":            token,
+		"KoboEndpoint":     s.baseURL(r) + koboPrefix,
+	})
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.renderAccount(w, r, http.StatusOK, "", "")
+}
+
+func (s *Server) handleAccountPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := currentUser(r)
+	if !user.CheckPassword(r.PostFormValue("current")) {
+		s.renderAccount(w, r, http.StatusBadRequest, "Your current password is incorrect.", "")
+		return
+	}
+
+	password := r.PostFormValue("password")
+	if len(password) < minPasswordLength {
+		s.renderAccount(w, r, http.StatusBadRequest, "Your new password must be at least "+strconv.Itoa(minPasswordLength)+" characters long.", "")
+		return
+	}
+	if err := user.SetPassword(password); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if err := s.storage.Users.Save(user); err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	s.renderAccount(w, r, http.StatusOK, "Your password has been changed.", "")
+}
+
+func (s *Server) handleAccountToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token, err := s.storage.Users.NewToken(currentUser(r))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	s.renderAccount(w, r, http.StatusOK, "", token)
+}
+
+func (s *Server) renderUsers(w http.ResponseWriter, r *http.Request, status int, message string) {
+	users, err := s.storage.Users.Query(storage.NewQuery().SortedBy("username", true))
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	s.renderHTML(w, r, status, "users", map[string]interface{}{
+		"CurVersion":       s.version,
+		"PageTitle":        "Users",
+		"ShowBar":          false,
+		"ShowSearch":       false,
+		"ShowViewSelector": false,
+		"Title":            "Users",
+		"Users":            users,
+		"Message":          message,
+	})
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.renderUsers(w, r, http.StatusOK, "")
+}
+
+func (s *Server) handleUsersCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	password := r.PostFormValue("password")
+	if username == "" {
+		s.renderUsers(w, r, http.StatusBadRequest, "A username is required.")
+		return
+	}
+	if len(password) < minPasswordLength {
+		s.renderUsers(w, r, http.StatusBadRequest, "Passwords must be at least "+strconv.Itoa(minPasswordLength)+" characters long.")
+		return
+	}
+
+	existing, err := s.storage.Users.ByUsername(username)
+	if err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if existing != nil {
+		s.renderUsers(w, r, http.StatusConflict, "The user "+username+" already exists.")
+		return
+	}
+
+	user := &booklist.User{
+		Username: username,
+		Admin:    r.PostFormValue("admin") != "",
+	}
+	if err := user.SetPassword(password); err != nil {
+		s.internalError(w, err)
+		return
+	}
+	if err := s.storage.Users.Save(user); err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (s *Server) handleUsersDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		s.renderUsers(w, r, http.StatusBadRequest, "Invalid user.")
+		return
+	}
+	if id == currentUser(r).ID {
+		s.renderUsers(w, r, http.StatusBadRequest, "You can't delete yourself.")
+		return
+	}
+
+	if err := s.storage.Users.Delete(id); err != nil {
+		s.internalError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
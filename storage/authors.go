@@ -145,6 +145,14 @@ func (a *AuthorStorage) Save(authors ... *booklist.Author) error {
 	return err
 }
 
+// Deletes all Authors that are no longer referenced by any book, using the specified transaction.
+func (a *AuthorStorage) DeleteOrphansTx(tx *sql.Tx) error {
+	if _, err := tx.Exec(buildDeleteOrphansQuery(authorFields.table, contributorTable, "authorid")); err != nil {
+		return fmt.Errorf("authors, delete orphans: %v", err)
+	}
+	return nil
+}
+
 func (a *AuthorStorage) Count(q *Query) (int, error) {
 	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
 	query, bindValues, err := q.buildSelect(a.baseCountQuery,authorFields.columns)
@@ -160,6 +168,11 @@ func (a *AuthorStorage) Count(q *Query) (int, error) {
 	return total, nil
 }
 
+// Sortable reports whether authors can be sorted by the specified column.
+func (a *AuthorStorage) Sortable(column string) bool {
+	return hasColumn(authorFields.columns, column)
+}
+
 func (a *AuthorStorage) Query(q *Query) ([]*booklist.Author, error) {
 	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
 	query, bindValues, err := q.buildSelect(a.baseSelectQuery,authorFields.columns)
@@ -15,6 +15,13 @@ type BookStorage struct {
 
 	preparedInsert *sql.Stmt
 	preparedUpdate *sql.Stmt
+	preparedDelete *sql.Stmt
+
+	preparedContributorInsert *sql.Stmt
+	preparedContributorDelete *sql.Stmt
+
+	preparedTagInsert *sql.Stmt
+	preparedTagDelete *sql.Stmt
 
 	baseSelectQuery string
 	baseCountQuery string
@@ -36,18 +43,18 @@ var bookFields = struct {
 	table: "books",
 	
 	// id FIRST in columns
-	columns: []string{"id", "pathname", "filesize", "filemtime", "hash", "hascover", "title", "description", "isbn", "publishdate", "importdate", "authorid", "publisherid", "seriesid", "seriesindex"},
+	columns: []string{"id", "pathname", "filesize", "filemtime", "hash", "hascover", "title", "description", "isbn", "publishdate", "importdate", "authorid", "publisherid", "seriesid", "seriesindex", "partialmd5"},
 	scan: func(rows *sql.Rows, book *booklist.Book, modTime *int64, pubDate *int64, importDate *int64) error {
 		// id FIRST in scan
-		return rows.Scan(&book.ID, &book.FilePath, &book.FileSize, modTime, &book.Hash, &book.HasCover, &book.Title, &book.Description, &book.ISBN, pubDate, importDate, &book.AuthorID, &book.PublisherID, &book.SeriesID, &book.SeriesIndex)
+		return rows.Scan(&book.ID, &book.FilePath, &book.FileSize, modTime, &book.Hash, &book.HasCover, &book.Title, &book.Description, &book.ISBN, pubDate, importDate, &book.AuthorID, &book.PublisherID, &book.SeriesID, &book.SeriesIndex, &book.PartialMD5)
 	},
 	insert: func(stmt *sql.Stmt, book *booklist.Book) (sql.Result, error) {
 		// id OMITTED in insert
-		return stmt.Exec(book.FilePath, book.FileSize, book.ModTime.Unix(), book.Hash, book.HasCover, book.Title, book.Description, book.ISBN, book.PublishDate.Unix(), book.ImportDate.Unix(), book.AuthorID, book.PublisherID, book.SeriesID, book.SeriesIndex)
+		return stmt.Exec(book.FilePath, book.FileSize, book.ModTime.Unix(), book.Hash, book.HasCover, book.Title, book.Description, book.ISBN, book.PublishDate.Unix(), book.ImportDate.Unix(), book.AuthorID, book.PublisherID, book.SeriesID, book.SeriesIndex, book.PartialMD5)
 	},
 	update: func(stmt *sql.Stmt, book *booklist.Book) (sql.Result, error) {
 		// id LAST in update
-		return stmt.Exec(book.FilePath, book.FileSize, book.ModTime.Unix(), book.Hash, book.HasCover, book.Title, book.Description, book.ISBN, book.PublishDate.Unix(), book.ImportDate.Unix(), book.AuthorID, book.PublisherID, book.SeriesID, book.SeriesIndex, book.ID)
+		return stmt.Exec(book.FilePath, book.FileSize, book.ModTime.Unix(), book.Hash, book.HasCover, book.Title, book.Description, book.ISBN, book.PublishDate.Unix(), book.ImportDate.Unix(), book.AuthorID, book.PublisherID, book.SeriesID, book.SeriesIndex, book.PartialMD5, book.ID)
 	},
 }
 
@@ -65,6 +72,18 @@ func NewBookStorage(s *Storage) (*BookStorage, error) {
 		return nil, err
 	}
 
+	if a.preparedDelete, err = s.db.Prepare(buildDeleteQuery(bookFields.table)); err != nil {
+		return nil, err
+	}
+
+	if err = a.prepareContributors(); err != nil {
+		return nil, err
+	}
+
+	if err = a.prepareTags(); err != nil {
+		return nil, err
+	}
+
 	a.baseSelectQuery, a.baseCountQuery = buildSelectQuery(bookFields.table,bookFields.columns)
 
 	return a, nil
@@ -78,6 +97,13 @@ func (a *BookStorage) saveDeps(tx *sql.Tx, book *booklist.Book) error {
 		}
 		book.AuthorID = book.Author.ID
 	}
+	for _, c := range book.Contributors {
+		if c.Author != nil && c.Author.ID == 0 && len(c.Author.Name) != 0 {
+			if err := a.storage.Authors.SaveTx(tx,c.Author); err != nil {
+				return fmt.Errorf("authors: %v",err)
+			}
+		}
+	}
 	if book.PublisherID == 0 && book.Publisher != nil && len(book.Publisher.Name) != 0 {
 		if err := a.storage.Publishers.SaveTx(tx,book.Publisher); err != nil {
 			return fmt.Errorf("publishers: %v",err)
@@ -125,6 +151,14 @@ func (a *BookStorage) SaveTx(tx *sql.Tx, books ... *booklist.Book) error {
 				return fmt.Errorf("books, insert: %v",err)
 			}
 		}
+
+		if err = a.saveContributorsTx(tx, book); err != nil {
+			return err
+		}
+
+		if err = a.saveTagsTx(tx, book); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -147,6 +181,83 @@ func (a *BookStorage) Save(books... *booklist.Book) error {
 	return err
 }
 
+// Deletes one or more books by ID using the specified transaction, along with their contributors and tags, users'
+// statuses, shelf entries, reading positions and Kobo bookmarks for them, the digests of their downloads with embedded
+// metadata, and any metadata overrides; Kobo sync records are kept so that the books are removed from users' Kobos.
+// Then deletes any authors, publishers, series and tags that are no longer referenced by a book.
+func (a *BookStorage) DeleteTx(tx *sql.Tx, ids ...int) error {
+	deleteStmt := tx.Stmt(a.preparedDelete)
+	for _, id := range ids {
+		if _, err := deleteStmt.Exec(id); err != nil {
+			return fmt.Errorf("books, delete: %v", err)
+		}
+	}
+	if err := a.deleteContributorsTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.deleteTagsTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.storage.Statuses.deleteBooksTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.storage.Shelves.deleteBooksTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.storage.Positions.deleteBooksTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.storage.Kobo.deleteBooksTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.storage.Overrides.deleteBooksTx(tx, ids...); err != nil {
+		return err
+	}
+	if err := a.storage.KOSync.deleteBooksTx(tx, ids...); err != nil {
+		return err
+	}
+
+	if err := a.storage.Authors.DeleteOrphansTx(tx); err != nil {
+		return err
+	}
+	if err := a.storage.Publishers.DeleteOrphansTx(tx); err != nil {
+		return err
+	}
+	if err := a.storage.Series.DeleteOrphansTx(tx); err != nil {
+		return err
+	}
+	if err := a.storage.Tags.DeleteOrphansTx(tx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Deletes one or more books by ID, along with any authors, publishers, series and tags left without books.
+func (a *BookStorage) Delete(ids ...int) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = a.DeleteTx(tx, ids...)
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+// Reports whether any book on file has the given content hash.
+func (a *BookStorage) HashExists(hash string) (bool, error) {
+	total := 0
+	if err := a.storage.db.QueryRow("SELECT COUNT(*) FROM "+bookFields.table+" WHERE hash=?", hash).Scan(&total); err != nil {
+		return false, err
+	}
+	return total > 0, nil
+}
+
 // Parses SQL result rows and creates a slice of Books.
 func (a *BookStorage) parseRows(rows *sql.Rows, deps bool) ([]*booklist.Book, error) {
 	books := make([]*booklist.Book, 0, 16)
@@ -218,6 +329,11 @@ func (a *BookStorage) query(q *Query, deps bool) ([]*booklist.Book, error) {
 	return a.parseRows(rows, deps)
 }
 
+// Sortable reports whether books can be sorted by the specified column.
+func (a *BookStorage) Sortable(column string) bool {
+	return hasColumn(bookFields.columns, column)
+}
+
 // Queries the database for one or more books.
 func (a *BookStorage) Query(q *Query) ([]*booklist.Book, error) {
 	return a.query(q, false)
@@ -246,14 +362,18 @@ func (a *BookStorage) Count(q *Query) (int, error) {
 
 // Provides common query logic used by both QueryKeyword and CountKeyword
 func (a *BookStorage) queryKeyword(keyword string, selectColumns []string, q *Query) (*sql.Rows, error) {
+	if a.storage.fullText {
+		return a.querySearch(keyword, selectColumns, q)
+	}
+
 	keyword = "%" + keyword + "%"
 	columnList := strings.Join(selectColumns, ",")
 	baseQuery := fmt.Sprintf(`
 SELECT DISTINCT %s
   FROM books
- WHERE books.authorid IN (SELECT id FROM authors WHERE name LIKE ?)
+ WHERE (books.id IN (SELECT bookid FROM `+contributorTable+` JOIN authors ON authors.id = authorid WHERE name LIKE ?)
     OR books.seriesid IN (SELECT id FROM series WHERE series.name LIKE ?)
-    OR books.title LIKE ?
+    OR books.title LIKE ?)
 `,columnList)
 
 	query, bindValues, err := q.buildSelect(baseQuery,bookFields.columns)
@@ -265,7 +385,33 @@ SELECT DISTINCT %s
 	return a.storage.db.Query(query, bindValues...)
 }
 
-// Queries the database for books whose title, author name, or series name matches the given keyword.
+// Provides the full-text search equivalent of queryKeyword; results may additionally be sorted by "relevance".
+func (a *BookStorage) querySearch(keyword string, selectColumns []string, q *Query) (*sql.Rows, error) {
+	columnList := strings.Join(selectColumns, ",")
+	baseQuery := fmt.Sprintf(`
+SELECT %s
+  FROM books
+  JOIN (SELECT rowid AS searchid, bm25(books_fts, %s) AS relevance FROM books_fts WHERE books_fts MATCH ?) matches
+    ON matches.searchid = books.id
+`, columnList, searchWeights)
+
+	query, bindValues, err := q.buildSelect(baseQuery, append([]string{"relevance"}, bookFields.columns...))
+	if err != nil {
+		return nil, err
+	}
+
+	expr := searchExpression(keyword)
+	if expr == "" {
+		// nothing to search for, so match nothing
+		expr = `""`
+	}
+	bindValues = append([]interface{}{expr}, bindValues...)
+
+	return a.storage.db.Query(query, bindValues...)
+}
+
+// Queries the database for books whose title, author name, or series name (and, if full-text search is available,
+// publisher, description or ISBN) match the given keyword.
 func (a *BookStorage) QueryKeyword(keyword string, q *Query) ([]*booklist.Book, error) {
 	rows, err := a.queryKeyword(keyword,getColumnsWithTable(bookFields.table,bookFields.columns),q)
 	if err != nil {
@@ -274,7 +420,7 @@ func (a *BookStorage) QueryKeyword(keyword string, q *Query) ([]*booklist.Book,
 	return a.parseRows(rows, true)
 }
 
-// Counts the number of books whose title, author name, or series name match the given keyword.
+// Counts the number of books matching the given keyword, as for QueryKeyword.
 func (a *BookStorage) CountKeyword(keyword string, q *Query) (int, error) {
 	rows, err := a.queryKeyword(keyword,[]string{"COUNT(DISTINCT books.id) AS total"},q)
 	if err != nil {
@@ -299,8 +445,17 @@ func mapKeys(m map[int]struct{}) []int {
 	return r
 }
 
-// loadBookDeps loads all dependencies (author, publisher, series) into each specified book
+// loadBookDeps loads all dependencies (author, publisher, series, tags) into each specified book
 func (a *BookStorage) loadBookDeps(books []*booklist.Book, authoridmap map[int]struct{}, seriesidmap map[int]struct{}, publisheridmap map[int]struct{}) error {
+	contributorRefs, err := a.queryContributors(books, authoridmap)
+	if err != nil {
+		return err
+	}
+
+	if err := a.loadTags(books); err != nil {
+		return err
+	}
+
 	authorList, err := a.storage.Authors.Query(NewQuery().In("id", mapKeys(authoridmap)))
 	if err != nil {
 		return err
@@ -325,6 +480,12 @@ func (a *BookStorage) loadBookDeps(books []*booklist.Book, authoridmap map[int]s
 		} else {
 			book.Author = &booklist.Author{}
 		}
+		book.Contributors = make([]*booklist.Contributor, 0, len(contributorRefs[book.ID]))
+		for _, ref := range contributorRefs[book.ID] {
+			if author, exists := authorsById[ref.authorID]; exists {
+				book.Contributors = append(book.Contributors, &booklist.Contributor{Author: author, Role: ref.role})
+			}
+		}
 		if series, exists := seriesById[book.SeriesID]; exists {
 			book.Series = series
 		} else {
@@ -342,26 +503,30 @@ func (a *BookStorage) loadBookDeps(books []*booklist.Book, authoridmap map[int]s
 
 // Holds file metadata to help determine if an ebook file has been "seen" by the indexer before.
 type BookSeen struct {
+	ID       int
+	FilePath string
+	Hash     string
 	FileSize int64
 	ModTime  int64
+
+	ImportDate int64
 }
 
 // Returns a map of file size/time information for all books on file, keyed by filename hash
 func (a *BookStorage) GetSeen() (map[string]BookSeen, error) {
-	rows, err := a.storage.db.Query("SELECT pathname,filesize,filemtime FROM "+bookFields.table)
+	rows, err := a.storage.db.Query("SELECT id,pathname,hash,filesize,filemtime,importdate FROM "+bookFields.table)
 	if err != nil {
 		return nil, err
 	}
 
 	seenList := make(map[string]BookSeen)
-	filename := ""
 	defer rows.Close()
 	for rows.Next() {
 		seen := BookSeen{}
-		if err := rows.Scan(&filename, &seen.FileSize, &seen.ModTime); err != nil {
+		if err := rows.Scan(&seen.ID, &seen.FilePath, &seen.Hash, &seen.FileSize, &seen.ModTime, &seen.ImportDate); err != nil {
 			return nil, err
 		}
-		filenameHash := fmt.Sprintf("%x", sha1.Sum([]byte(filename)))
+		filenameHash := fmt.Sprintf("%x", sha1.Sum([]byte(seen.FilePath)))
 		seenList[filenameHash] = seen
 	}
 	if err := rows.Close(); err != nil {
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// contributorTable joins books to the authors who contributed to them, in each of the roles they contributed in.
+const contributorTable = "books_authors"
+
+// contributorRef is a book's reference to one of its contributors, before the contributor's author is loaded.
+type contributorRef struct {
+	authorID int
+	role     string
+}
+
+// prepareContributors prepares the statements used to maintain books' contributors.
+func (a *BookStorage) prepareContributors() (err error) {
+	if a.preparedContributorInsert, err = a.storage.db.Prepare("INSERT OR IGNORE INTO " + contributorTable + " (bookid, authorid, role, position) VALUES (?,?,?,?)"); err != nil {
+		return err
+	}
+	a.preparedContributorDelete, err = a.storage.db.Prepare("DELETE FROM " + contributorTable + " WHERE bookid = ?")
+	return err
+}
+
+// saveContributorsTx replaces the stored contributors of a book using the specified transaction. The contributors'
+// authors must already have been saved.
+func (a *BookStorage) saveContributorsTx(tx *sql.Tx, book *booklist.Book) error {
+	contributors := book.Contributors
+	if len(contributors) == 0 && book.AuthorID > 0 {
+		// some formats only provide an author
+		contributors = []*booklist.Contributor{{Author: &booklist.Author{ID: book.AuthorID}, Role: booklist.RoleAuthor}}
+	}
+
+	if _, err := tx.Stmt(a.preparedContributorDelete).Exec(book.ID); err != nil {
+		return fmt.Errorf("books, contributors delete: %v", err)
+	}
+
+	insertStmt := tx.Stmt(a.preparedContributorInsert)
+	for position, c := range contributors {
+		if c.Author == nil || c.Author.ID == 0 {
+			continue
+		}
+		if _, err := insertStmt.Exec(book.ID, c.Author.ID, c.Role, position); err != nil {
+			return fmt.Errorf("books, contributors insert: %v", err)
+		}
+	}
+	return nil
+}
+
+// deleteContributorsTx removes the stored contributors of the specified books using the specified transaction.
+func (a *BookStorage) deleteContributorsTx(tx *sql.Tx, ids ...int) error {
+	deleteStmt := tx.Stmt(a.preparedContributorDelete)
+	for _, id := range ids {
+		if _, err := deleteStmt.Exec(id); err != nil {
+			return fmt.Errorf("books, contributors delete: %v", err)
+		}
+	}
+	return nil
+}
+
+// queryContributors retrieves references to the contributors of each of the specified books, keyed by book ID and
+// in the order they're listed in the book, and adds their author IDs to authorIDs.
+func (a *BookStorage) queryContributors(books []*booklist.Book, authorIDs map[int]struct{}) (map[int][]contributorRef, error) {
+	refs := make(map[int][]contributorRef)
+	if len(books) == 0 {
+		return refs, nil
+	}
+
+	ids := make([]string, len(books))
+	for k, book := range books {
+		ids[k] = strconv.Itoa(book.ID)
+	}
+
+	// ids are integers, so this is safe from SQL injection
+	rows, err := a.storage.db.Query("SELECT bookid, authorid, role FROM " + contributorTable + " WHERE bookid IN (" + strings.Join(ids, ",") + ") ORDER BY bookid, position")
+	if err != nil {
+		return nil, fmt.Errorf("books, contributors query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			bookID int
+			ref    contributorRef
+		)
+		if err := rows.Scan(&bookID, &ref.authorID, &ref.role); err != nil {
+			return nil, fmt.Errorf("books, contributors scan: %v", err)
+		}
+		refs[bookID] = append(refs[bookID], ref)
+		authorIDs[ref.authorID] = struct{}{}
+	}
+	return refs, rows.Err()
+}
+
+// Provides common query logic used by both QueryByContributor and CountByContributor
+func (a *BookStorage) queryContributor(authorID int, selectColumns []string, q *Query) (*sql.Rows, error) {
+	baseQuery := fmt.Sprintf(`
+SELECT %s
+  FROM books
+ WHERE books.id IN (SELECT bookid FROM `+contributorTable+` WHERE authorid = ?)
+`, strings.Join(selectColumns, ","))
+
+	query, bindValues, err := q.buildSelect(baseQuery, bookFields.columns)
+	if err != nil {
+		return nil, err
+	}
+	bindValues = append([]interface{}{authorID}, bindValues...)
+
+	return a.storage.db.Query(query, bindValues...)
+}
+
+// Queries the database for books that the given author contributed to in any role.
+func (a *BookStorage) QueryByContributor(authorID int, q *Query) ([]*booklist.Book, error) {
+	rows, err := a.queryContributor(authorID, getColumnsWithTable(bookFields.table, bookFields.columns), q)
+	if err != nil {
+		return nil, err
+	}
+	return a.parseRows(rows, true)
+}
+
+// Counts the number of books that the given author contributed to in any role.
+func (a *BookStorage) CountByContributor(authorID int, q *Query) (int, error) {
+	rows, err := a.queryContributor(authorID, []string{"COUNT(*) AS total"}, q)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, nil
+	}
+	total := 0
+	if err := rows.Scan(&total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
@@ -44,6 +44,18 @@ func buildUpdateQuery(table string, columns []string) string {
 	return b.String()
 }
 
+// buildDeleteQuery creates a DELETE query string, for deleting a single row by ID, suitable for use as a prepared
+// statement.
+func buildDeleteQuery(table string) string {
+	return "DELETE FROM " + table + " WHERE id=?"
+}
+
+// buildDeleteOrphansQuery creates a DELETE query string which removes all rows from table whose IDs are not
+// referenced by refColumn in refTable.
+func buildDeleteOrphansQuery(table string, refTable string, refColumn string) string {
+	return "DELETE FROM " + table + " WHERE id NOT IN (SELECT " + refColumn + " FROM " + refTable + " WHERE " + refColumn + " IS NOT NULL)"
+}
+
 func buildSelectQuery(table string, columns []string) (query, count string) {
 	b := strings.Builder{}
 	b.WriteString("SELECT ")
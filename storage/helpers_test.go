@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStorage opens a new database in a temporary directory, which is removed by cleanup.
+func newTestStorage(t *testing.T) (s *Storage, cleanup func()) {
+	dir, err := ioutil.TempDir("", "bookbrowser-storage")
+	require.NoError(t, err)
+
+	s, err = New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	require.NoError(t, err)
+
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// seedBooks saves n books titled A, B, C, etc, whose hashes, partial MD5s and filenames are derived from their titles.
+func seedBooks(t *testing.T, s *Storage, n int) []*booklist.Book {
+	books := make([]*booklist.Book, n)
+	for k := range books {
+		name := string(rune('a' + k))
+		books[k] = &booklist.Book{
+			Hash:       name,
+			PartialMD5: strings.Repeat(name, 4),
+			FilePath:   "/books/" + name + ".epub",
+			Title:      strings.ToUpper(name),
+		}
+	}
+	require.NoError(t, s.Books.Save(books...))
+	return books
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+const (
+	// koboSyncedTable records which books have been synced to each user's Kobo, so that books taken off their Kobo
+	// shelves can be removed from it.
+	koboSyncedTable = "kobo_synced"
+	// koboBookmarkTable holds each user's reading position in each book as reported by their Kobo.
+	koboBookmarkTable = "kobo_bookmarks"
+)
+
+// KoboStorage provides database functionality for syncing books and reading states with users' Kobo e-readers.
+type KoboStorage struct {
+	storage *Storage
+
+	preparedShelved        *sql.Stmt
+	preparedSynced         *sql.Stmt
+	preparedSyncedInsert   *sql.Stmt
+	preparedSyncedDelete   *sql.Stmt
+	preparedChangedStates  *sql.Stmt
+	preparedReadingState   *sql.Stmt
+	preparedBookmarkUpsert *sql.Stmt
+	preparedShelfRemove    *sql.Stmt
+}
+
+// Creates a new Kobo storage object.
+func NewKoboStorage(s *Storage) (*KoboStorage, error) {
+	a := &KoboStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedShelved, err = s.db.Prepare("SELECT DISTINCT sb.bookid FROM " + shelfBookTable + " sb JOIN " + shelfFields.table + " s ON s.id = sb.shelfid WHERE s.userid = ? AND s.kobo = 1"); err != nil {
+		return nil, err
+	}
+	if a.preparedSynced, err = s.db.Prepare("SELECT bookid FROM " + koboSyncedTable + " WHERE userid = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedSyncedInsert, err = s.db.Prepare("INSERT OR REPLACE INTO " + koboSyncedTable + " (userid, bookid, synced) VALUES (?,?,?)"); err != nil {
+		return nil, err
+	}
+	if a.preparedSyncedDelete, err = s.db.Prepare("DELETE FROM " + koboSyncedTable + " WHERE userid = ? AND bookid = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedChangedStates, err = s.db.Prepare("SELECT bookid FROM " + koboSyncedTable + " WHERE userid = ? AND (" +
+		"bookid IN (SELECT bookid FROM " + bookStatusTable + " WHERE userid = ? AND updated >= ?) OR " +
+		"bookid IN (SELECT bookid FROM " + koboBookmarkTable + " WHERE userid = ? AND updated >= ?))"); err != nil {
+		return nil, err
+	}
+	if a.preparedReadingState, err = s.db.Prepare("SELECT COALESCE(s.status, 0), COALESCE(s.updated, 0), COALESCE(k.location, ''), COALESCE(k.locationtype, ''), COALESCE(k.locationsource, ''), COALESCE(k.percentage, 0), COALESCE(k.updated, 0)" +
+		" FROM (SELECT ? AS userid, ? AS bookid) b" +
+		" LEFT JOIN " + bookStatusTable + " s ON s.userid = b.userid AND s.bookid = b.bookid" +
+		" LEFT JOIN " + koboBookmarkTable + " k ON k.userid = b.userid AND k.bookid = b.bookid"); err != nil {
+		return nil, err
+	}
+	if a.preparedBookmarkUpsert, err = s.db.Prepare("INSERT INTO " + koboBookmarkTable + " (userid, bookid, location, locationtype, locationsource, percentage, updated) VALUES (?,?,?,?,?,?,?) ON CONFLICT (userid, bookid) DO UPDATE SET location = excluded.location, locationtype = excluded.locationtype, locationsource = excluded.locationsource, percentage = excluded.percentage, updated = excluded.updated"); err != nil {
+		return nil, err
+	}
+	if a.preparedShelfRemove, err = s.db.Prepare("DELETE FROM " + shelfBookTable + " WHERE bookid = ? AND shelfid IN (SELECT id FROM " + shelfFields.table + " WHERE userid = ? AND kobo = 1)"); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// queryIDs runs a prepared query which selects book IDs.
+func queryIDs(stmt *sql.Stmt, table string, args ...interface{}) ([]int, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s, select: %v", table, err)
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0, 64)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Retrieves the IDs of the books on the shelves the user syncs to their Kobo.
+func (a *KoboStorage) Shelved(userID int) ([]int, error) {
+	return queryIDs(a.preparedShelved, "shelves", userID)
+}
+
+// Retrieves the IDs of the books which have been synced to the user's Kobo.
+func (a *KoboStorage) Synced(userID int) ([]int, error) {
+	return queryIDs(a.preparedSynced, "kobo_synced", userID)
+}
+
+// Records that one or more books have been synced to the user's Kobo.
+func (a *KoboStorage) SetSynced(userID int, bookIDs ...int) error {
+	return a.execBooks(a.preparedSyncedInsert, "kobo_synced, insert", func(stmt *sql.Stmt, id int) error {
+		_, err := stmt.Exec(userID, id, time.Now().Unix())
+		return err
+	}, bookIDs)
+}
+
+// Records that one or more books have been removed from the user's Kobo.
+func (a *KoboStorage) Unsync(userID int, bookIDs ...int) error {
+	return a.execBooks(a.preparedSyncedDelete, "kobo_synced, delete", func(stmt *sql.Stmt, id int) error {
+		_, err := stmt.Exec(userID, id)
+		return err
+	}, bookIDs)
+}
+
+// Removes a book from the user's Kobo by taking it off all of their Kobo shelves, so that it isn't synced again.
+func (a *KoboStorage) Remove(userID, bookID int) error {
+	if _, err := a.preparedShelfRemove.Exec(bookID, userID); err != nil {
+		return fmt.Errorf("shelves, books delete: %v", err)
+	}
+	return a.Unsync(userID, bookID)
+}
+
+// execBooks runs exec for each book ID in a single transaction.
+func (a *KoboStorage) execBooks(prepared *sql.Stmt, op string, exec func(stmt *sql.Stmt, id int) error, bookIDs []int) error {
+	if len(bookIDs) == 0 {
+		return nil
+	}
+
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(prepared)
+	for _, id := range bookIDs {
+		if err = exec(stmt, id); err != nil {
+			err = fmt.Errorf("%s: %v", op, err)
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return err
+}
+
+// Retrieves the IDs of the books synced to the user's Kobo whose read status or Kobo bookmark has changed since the
+// given time.
+func (a *KoboStorage) ChangedStates(userID int, since time.Time) ([]int, error) {
+	return queryIDs(a.preparedChangedStates, "kobo_synced", userID, userID, since.Unix(), userID, since.Unix())
+}
+
+// Retrieves the user's read status and Kobo bookmark for a book.
+func (a *KoboStorage) ReadingState(userID, bookID int) (*booklist.KoboReadingState, error) {
+	state := &booklist.KoboReadingState{BookID: bookID}
+	var statusUpdated, updated int64
+	err := a.preparedReadingState.QueryRow(userID, bookID).Scan(&state.Status, &statusUpdated, &state.Location, &state.LocationType, &state.LocationSource, &state.Percentage, &updated)
+	if err != nil {
+		return nil, fmt.Errorf("kobo_bookmarks, select: %v", err)
+	}
+	if statusUpdated > 0 {
+		state.StatusUpdated = time.Unix(statusUpdated, 0)
+	}
+	if updated > 0 {
+		state.Updated = time.Unix(updated, 0)
+	}
+	return state, nil
+}
+
+// Saves the Kobo bookmark in the user's reading state, replacing their previous bookmark. If the state's Updated time
+// is unset, the current time is used. The read status is saved separately with StatusStorage.SetStatus.
+func (a *KoboStorage) SaveBookmark(userID int, state *booklist.KoboReadingState) error {
+	if state.Updated.IsZero() {
+		state.Updated = time.Unix(time.Now().Unix(), 0)
+	}
+	if _, err := a.preparedBookmarkUpsert.Exec(userID, state.BookID, state.Location, state.LocationType, state.LocationSource, state.Percentage, state.Updated.Unix()); err != nil {
+		return fmt.Errorf("kobo_bookmarks, upsert: %v", err)
+	}
+	return nil
+}
+
+// Deletes all of a user's Kobo sync records and bookmarks using the specified transaction.
+func (a *KoboStorage) deleteUserTx(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("DELETE FROM "+koboSyncedTable+" WHERE userid = ?", userID); err != nil {
+		return fmt.Errorf("kobo_synced, delete: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM "+koboBookmarkTable+" WHERE userid = ?", userID); err != nil {
+		return fmt.Errorf("kobo_bookmarks, delete: %v", err)
+	}
+	return nil
+}
+
+// Deletes every user's Kobo bookmarks in one or more deleted books using the specified transaction. The books' sync
+// records are kept, so that the books are removed from users' Kobos when they next sync.
+func (a *KoboStorage) deleteBooksTx(tx *sql.Tx, ids ...int) error {
+	stmt, err := tx.Prepare("DELETE FROM " + koboBookmarkTable + " WHERE bookid = ?")
+	if err != nil {
+		return fmt.Errorf("kobo_bookmarks, delete: %v", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("kobo_bookmarks, delete: %v", err)
+		}
+	}
+	return nil
+}
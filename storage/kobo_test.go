@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKobo(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	books := seedBooks(t, s, 3)
+
+	kobo := &booklist.Shelf{UserID: 1, Name: "Kobo", Kobo: true}
+	other := &booklist.Shelf{UserID: 1, Name: "Other"}
+	require.NoError(t, s.Shelves.Save(kobo, other))
+	require.NoError(t, s.Shelves.AddBook(kobo.ID, books[0].ID))
+	require.NoError(t, s.Shelves.AddBook(kobo.ID, books[1].ID))
+	require.NoError(t, s.Shelves.AddBook(other.ID, books[2].ID))
+
+	shelf, err := s.Shelves.ByID(1, kobo.ID)
+	require.NoError(t, err)
+	assert.True(t, shelf.Kobo)
+
+	shelved, err := s.Kobo.Shelved(1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{books[0].ID, books[1].ID}, shelved)
+
+	require.NoError(t, s.Kobo.SetSynced(1, books[0].ID, books[1].ID))
+	synced, err := s.Kobo.Synced(1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{books[0].ID, books[1].ID}, synced)
+
+	state, err := s.Kobo.ReadingState(1, books[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, booklist.StatusNone, state.Status)
+	assert.True(t, state.Updated.IsZero())
+
+	since := time.Unix(time.Now().Unix(), 0)
+	changed, err := s.Kobo.ChangedStates(1, since)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	require.NoError(t, s.Statuses.SetStatus(1, books[0].ID, booklist.StatusReading))
+	require.NoError(t, s.Kobo.SaveBookmark(1, &booklist.KoboReadingState{BookID: books[1].ID, Location: "kobo.3.1", LocationType: "KoboSpan", LocationSource: "OEBPS/ch1.xhtml", Percentage: 0.25}))
+	changed, err = s.Kobo.ChangedStates(1, since)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{books[0].ID, books[1].ID}, changed)
+
+	state, err = s.Kobo.ReadingState(1, books[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "kobo.3.1", state.Location)
+	assert.Equal(t, "KoboSpan", state.LocationType)
+	assert.Equal(t, "OEBPS/ch1.xhtml", state.LocationSource)
+	assert.Equal(t, 0.25, state.Percentage)
+
+	// the Kobo bookmark shows up as the user's progress
+	pos, err := s.Positions.Latest(1, books[1].ID)
+	require.NoError(t, err)
+	require.NotNil(t, pos)
+	assert.Equal(t, "Kobo", pos.Device)
+	assert.Equal(t, 0.25, pos.Percentage)
+
+	// removing a book from the Kobo takes it off the Kobo shelves only
+	require.NoError(t, s.Shelves.AddBook(other.ID, books[0].ID))
+	require.NoError(t, s.Kobo.Remove(1, books[0].ID))
+	shelved, err = s.Kobo.Shelved(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{books[1].ID}, shelved)
+	synced, err = s.Kobo.Synced(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{books[1].ID}, synced)
+	bookState, err := s.Statuses.ByBook(1, books[0].ID)
+	require.NoError(t, err)
+	assert.True(t, bookState.ShelfIDs[other.ID])
+
+	// deleted books stay synced until the Kobo is told to remove them
+	require.NoError(t, s.Books.Delete(books[1].ID))
+	synced, err = s.Kobo.Synced(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{books[1].ID}, synced)
+	state, err = s.Kobo.ReadingState(1, books[1].ID)
+	require.NoError(t, err)
+	assert.Empty(t, state.Location)
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// kosyncProgressTable holds each user's progress in each document synced from KOReader. Documents are identified by
+// KOReader's digest rather than by book, since KOReader may sync documents that aren't in the library; those that are
+// match the partialmd5 column of the books table.
+const kosyncProgressTable = "kosync_progress"
+
+// kosyncDigestTable maps the digests of downloaded copies of books which differ from the books' files (such as those
+// with their metadata embedded) to the books, so that progress in those copies is recognized too.
+const kosyncDigestTable = "kosync_digests"
+
+// KOSyncStorage provides database functionality for progress synced from KOReader.
+type KOSyncStorage struct {
+	storage *Storage
+
+	preparedSelect *sql.Stmt
+	preparedUpsert *sql.Stmt
+	preparedDigest *sql.Stmt
+}
+
+// Creates a new KOReader progress storage object.
+func NewKOSyncStorage(s *Storage) (*KOSyncStorage, error) {
+	a := &KOSyncStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedSelect, err = s.db.Prepare("SELECT document, progress, percentage, device, deviceid, updated FROM " + kosyncProgressTable + " WHERE userid = ? AND document = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedUpsert, err = s.db.Prepare("INSERT INTO " + kosyncProgressTable + " (userid, document, progress, percentage, device, deviceid, updated) VALUES (?,?,?,?,?,?,?) ON CONFLICT (userid, document) DO UPDATE SET progress = excluded.progress, percentage = excluded.percentage, device = excluded.device, deviceid = excluded.deviceid, updated = excluded.updated"); err != nil {
+		return nil, err
+	}
+	if a.preparedDigest, err = s.db.Prepare("INSERT INTO " + kosyncDigestTable + " (document, bookid) VALUES (?,?) ON CONFLICT (document) DO UPDATE SET bookid = excluded.bookid"); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Retrieves the user's progress in a document, or nil if they haven't synced any.
+func (a *KOSyncStorage) ByDocument(userID int, document string) (*booklist.SyncProgress, error) {
+	p := &booklist.SyncProgress{}
+	var updated int64
+	err := a.preparedSelect.QueryRow(userID, document).Scan(&p.Document, &p.Progress, &p.Percentage, &p.Device, &p.DeviceID, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("kosync_progress, select: %v", err)
+	}
+	p.Updated = time.Unix(updated, 0)
+	return p, nil
+}
+
+// Saves the user's progress in a document, replacing their previous progress. If the progress's Updated time is
+// unset, the current time is used.
+func (a *KOSyncStorage) Save(userID int, p *booklist.SyncProgress) error {
+	if p.Updated.IsZero() {
+		p.Updated = time.Unix(time.Now().Unix(), 0)
+	}
+	if _, err := a.preparedUpsert.Exec(userID, p.Document, p.Progress, p.Percentage, p.Device, p.DeviceID, p.Updated.Unix()); err != nil {
+		return fmt.Errorf("kosync_progress, upsert: %v", err)
+	}
+	return nil
+}
+
+// Deletes all of a user's progress using the specified transaction.
+func (a *KOSyncStorage) deleteUserTx(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("DELETE FROM "+kosyncProgressTable+" WHERE userid = ?", userID); err != nil {
+		return fmt.Errorf("kosync_progress, delete: %v", err)
+	}
+	return nil
+}
+
+// Records the digest of a downloaded copy of a book whose file differs from the book's, so that progress synced in the
+// copy is matched to the book like progress in the book's own file.
+func (a *KOSyncStorage) AddDigest(bookID int, document string) error {
+	if _, err := a.preparedDigest.Exec(document, bookID); err != nil {
+		return fmt.Errorf("kosync_digests, upsert: %v", err)
+	}
+	return nil
+}
+
+// Deletes the digests of copies of one or more deleted books using the specified transaction.
+func (a *KOSyncStorage) deleteBooksTx(tx *sql.Tx, ids ...int) error {
+	stmt, err := tx.Prepare("DELETE FROM " + kosyncDigestTable + " WHERE bookid = ?")
+	if err != nil {
+		return fmt.Errorf("kosync_digests, delete: %v", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("kosync_digests, delete: %v", err)
+		}
+	}
+	return nil
+}
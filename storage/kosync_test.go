@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKOSync(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	books := seedBooks(t, s, 2)
+
+	user := &booklist.User{Username: "reader"}
+	require.NoError(t, s.Users.Save(user))
+
+	progress, err := s.KOSync.ByDocument(user.ID, "aaaa")
+	require.NoError(t, err)
+	assert.Nil(t, progress)
+
+	now := time.Now()
+	require.NoError(t, s.Positions.Save(user.ID, &booklist.Position{BookID: books[0].ID, Position: "epubcfi(/6/4)", Percentage: 0.1, Updated: now.Add(-time.Hour)}))
+	require.NoError(t, s.KOSync.Save(user.ID, &booklist.SyncProgress{Document: "aaaa", Progress: "/body/DocFragment[3]/body/p[2]/text().0", Percentage: 0.3, Device: "Kobo", DeviceID: "k1", Updated: now}))
+	require.NoError(t, s.KOSync.Save(user.ID, &booklist.SyncProgress{Document: "bbbb", Progress: "/body/DocFragment[1]/body/p[1]/text().0", Percentage: 0.2, Device: "Kobo", DeviceID: "k1", Updated: now.Add(-2 * time.Hour)}))
+	require.NoError(t, s.KOSync.Save(user.ID, &booklist.SyncProgress{Document: "cccc", Progress: "5", Percentage: 0.4, Device: "Kobo", DeviceID: "k1", Updated: now.Add(time.Hour)}))
+
+	progress, err = s.KOSync.ByDocument(user.ID, "aaaa")
+	require.NoError(t, err)
+	require.NotNil(t, progress)
+	assert.Equal(t, "/body/DocFragment[3]/body/p[2]/text().0", progress.Progress)
+	assert.Equal(t, 0.3, progress.Percentage)
+	assert.Equal(t, "Kobo", progress.Device)
+	assert.Equal(t, "k1", progress.DeviceID)
+	assert.Equal(t, now.Unix(), progress.Updated.Unix())
+
+	// the built-in readers' position is still kept separately
+	pos, err := s.Positions.ByBook(user.ID, books[0].ID)
+	require.NoError(t, err)
+	require.NotNil(t, pos)
+	assert.Equal(t, "epubcfi(/6/4)", pos.Position)
+
+	pos, err = s.Positions.Latest(user.ID, books[0].ID)
+	require.NoError(t, err)
+	require.NotNil(t, pos)
+	assert.Equal(t, 0.3, pos.Percentage, "more recent KOReader progress")
+	assert.Equal(t, "Kobo", pos.Device)
+
+	// documents that aren't in the library are left out
+	unfinished, err := s.Positions.Unfinished(user.ID, 0.98, 10)
+	require.NoError(t, err)
+	require.Len(t, unfinished, 2)
+	assert.Equal(t, books[0].ID, unfinished[0].BookID)
+	assert.Equal(t, 0.3, unfinished[0].Percentage)
+	assert.Equal(t, books[1].ID, unfinished[1].BookID)
+
+	// progress in a downloaded copy of a book is matched to it once the copy's digest is recorded
+	require.NoError(t, s.KOSync.Save(user.ID, &booklist.SyncProgress{Document: "eeee", Progress: "9", Percentage: 0.5, Device: "Kobo", DeviceID: "k1", Updated: now.Add(2 * time.Hour)}))
+	pos, err = s.Positions.Latest(user.ID, books[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0.2, pos.Percentage)
+	require.NoError(t, s.KOSync.AddDigest(books[1].ID, "eeee"))
+	pos, err = s.Positions.Latest(user.ID, books[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, pos.Percentage)
+	unfinished, err = s.Positions.Unfinished(user.ID, 0.98, 10)
+	require.NoError(t, err)
+	require.Len(t, unfinished, 2)
+	assert.Equal(t, books[1].ID, unfinished[0].BookID)
+	assert.Equal(t, 0.5, unfinished[0].Percentage)
+
+	require.NoError(t, s.Books.Delete(books[1].ID))
+	var digests int
+	require.NoError(t, s.db.QueryRow("SELECT COUNT(*) FROM "+kosyncDigestTable).Scan(&digests))
+	assert.Zero(t, digests)
+
+	require.NoError(t, s.Users.Delete(user.ID))
+	progress, err = s.KOSync.ByDocument(user.ID, "aaaa")
+	require.NoError(t, err)
+	assert.Nil(t, progress)
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+// A migration upgrades the database schema from the previous version.
+type migration struct {
+	description string
+	queries     []string
+	// fullText migrations are only applied if SQLite was built with FTS5 support; see setupSearch
+	fullText bool
+}
+
+// migrations lists every schema change in order; the schema version of a database is the number of migrations that
+// have been applied to it. Migrations must never be modified or reordered once released; to change the schema, append
+// a new migration.
+var migrations = []migration{
+	{
+		description: "initial schema",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS books (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	pathname VARCHAR(255) NOT NULL,
+	filesize INTEGER NOT NULL,
+	filemtime INTEGER NOT NULL,
+	hash VARCHAR(40) NOT NULL,
+	hascover INTEGER NOT NULL DEFAULT 0,
+	title VARCHAR(255) NOT NULL,
+	description TEXT NOT NULL,
+	isbn VARCHAR(16) NOT NULL,
+	publishdate INTEGER NOT NULL,
+	importdate INTEGER NOT NULL,
+	authorid INTEGER NOT NULL,
+	publisherid INTEGER,
+	seriesid INTEGER,
+	seriesindex INTEGER
+)`,
+			`CREATE TABLE IF NOT EXISTS authors (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	sortname VARCHAR(255) NOT NULL,
+	UNIQUE(name)
+)`,
+			`CREATE TABLE IF NOT EXISTS publishers (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	UNIQUE(name)
+)`,
+			`CREATE TABLE IF NOT EXISTS series (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	UNIQUE(name)
+)`,
+		},
+	},
+	{
+		description: "book contributors",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS books_authors (
+	bookid INTEGER NOT NULL,
+	authorid INTEGER NOT NULL,
+	role VARCHAR(16) NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (bookid, authorid, role)
+)`,
+			`CREATE INDEX IF NOT EXISTS books_authors_authorid ON books_authors (authorid)`,
+			`INSERT OR IGNORE INTO books_authors (bookid, authorid, role, position) SELECT id, authorid, 'author', 0 FROM books WHERE authorid > 0`,
+			// books only record their first author, so have the indexer reload them all to find their other contributors
+			`UPDATE books SET filemtime = 0`,
+		},
+	},
+	{
+		description: "book tags",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS tags (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL COLLATE NOCASE,
+	UNIQUE(name)
+)`,
+			`CREATE TABLE IF NOT EXISTS books_tags (
+	bookid INTEGER NOT NULL,
+	tagid INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (bookid, tagid)
+)`,
+			`CREATE INDEX IF NOT EXISTS books_tags_tagid ON books_tags (tagid)`,
+			// tags weren't previously indexed, so have the indexer reload every book to find them
+			`UPDATE books SET filemtime = 0`,
+		},
+	},
+	{
+		description: "users and sessions",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(64) NOT NULL COLLATE NOCASE,
+	admin INTEGER NOT NULL DEFAULT 0,
+	passwordhash VARCHAR(60) NOT NULL,
+	tokenhash VARCHAR(64) NOT NULL DEFAULT '',
+	UNIQUE(username)
+)`,
+			`CREATE INDEX IF NOT EXISTS users_tokenhash ON users (tokenhash)`,
+			`CREATE TABLE IF NOT EXISTS sessions (
+	tokenhash VARCHAR(64) NOT NULL PRIMARY KEY,
+	userid INTEGER NOT NULL,
+	expires INTEGER NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS sessions_userid ON sessions (userid)`,
+		},
+	},
+	{
+		description: "read status, favourites and shelves",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS books_status (
+	userid INTEGER NOT NULL,
+	bookid INTEGER NOT NULL,
+	status INTEGER NOT NULL DEFAULT 0,
+	favourite INTEGER NOT NULL DEFAULT 0,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (userid, bookid)
+)`,
+			`CREATE INDEX IF NOT EXISTS books_status_bookid ON books_status (bookid)`,
+			`CREATE TABLE IF NOT EXISTS shelves (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	userid INTEGER NOT NULL,
+	name VARCHAR(255) NOT NULL COLLATE NOCASE,
+	UNIQUE(userid, name)
+)`,
+			`CREATE TABLE IF NOT EXISTS shelves_books (
+	shelfid INTEGER NOT NULL,
+	bookid INTEGER NOT NULL,
+	added INTEGER NOT NULL,
+	PRIMARY KEY (shelfid, bookid)
+)`,
+			`CREATE INDEX IF NOT EXISTS shelves_books_bookid ON shelves_books (bookid)`,
+		},
+	},
+	{
+		description: "reading positions",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS books_position (
+	userid INTEGER NOT NULL,
+	bookid INTEGER NOT NULL,
+	position TEXT NOT NULL,
+	percentage REAL NOT NULL DEFAULT 0,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (userid, bookid)
+)`,
+			`CREATE INDEX IF NOT EXISTS books_position_updated ON books_position (userid, updated)`,
+			`CREATE INDEX IF NOT EXISTS books_position_bookid ON books_position (bookid)`,
+		},
+	},
+	{
+		description: "KOReader progress sync",
+		queries: []string{
+			`ALTER TABLE books ADD COLUMN partialmd5 VARCHAR(32) NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS books_partialmd5 ON books (partialmd5)`,
+			`ALTER TABLE users ADD COLUMN synckeyhash VARCHAR(60) NOT NULL DEFAULT ''`,
+			`CREATE TABLE IF NOT EXISTS kosync_progress (
+	userid INTEGER NOT NULL,
+	document VARCHAR(32) NOT NULL,
+	progress TEXT NOT NULL,
+	percentage REAL NOT NULL DEFAULT 0,
+	device VARCHAR(255) NOT NULL,
+	deviceid VARCHAR(255) NOT NULL,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (userid, document)
+)`,
+			// existing books haven't been digested, so have the indexer reload them all
+			`UPDATE books SET filemtime = 0`,
+		},
+	},
+	{
+		description: "Kobo sync",
+		queries: []string{
+			`ALTER TABLE shelves ADD COLUMN kobo INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS kobo_synced (
+	userid INTEGER NOT NULL,
+	bookid INTEGER NOT NULL,
+	synced INTEGER NOT NULL,
+	PRIMARY KEY (userid, bookid)
+)`,
+			`CREATE TABLE IF NOT EXISTS kobo_bookmarks (
+	userid INTEGER NOT NULL,
+	bookid INTEGER NOT NULL,
+	location TEXT NOT NULL,
+	locationtype VARCHAR(32) NOT NULL,
+	locationsource TEXT NOT NULL,
+	percentage REAL NOT NULL DEFAULT 0,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (userid, bookid)
+)`,
+			`CREATE INDEX IF NOT EXISTS kobo_bookmarks_bookid ON kobo_bookmarks (bookid)`,
+		},
+	},
+	{
+		description: "metadata overrides",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS books_overrides (
+	bookid INTEGER NOT NULL,
+	field VARCHAR(32) NOT NULL,
+	value TEXT NOT NULL,
+	userid INTEGER NOT NULL DEFAULT 0,
+	updated INTEGER NOT NULL,
+	PRIMARY KEY (bookid, field)
+)`,
+		},
+	},
+	{
+		description: "full-text search",
+		queries:     searchSchema,
+		fullText:    true,
+	},
+	{
+		description: "metadata edit times",
+		queries: []string{
+			// when each book's metadata was last edited or reverted, which doesn't change the book's file
+			`ALTER TABLE books ADD COLUMN edited INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE books SET edited = (SELECT MAX(updated) FROM books_overrides WHERE bookid = books.id) WHERE id IN (SELECT bookid FROM books_overrides)`,
+		},
+	},
+	{
+		description: "KOReader digests of downloads",
+		queries: []string{
+			`CREATE TABLE IF NOT EXISTS kosync_digests (
+	document VARCHAR(32) NOT NULL PRIMARY KEY,
+	bookid INTEGER NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS kosync_digests_bookid ON kosync_digests (bookid)`,
+		},
+	},
+}
+
+// SchemaVersion is the database schema version used by this version of BookBrowser.
+var SchemaVersion = len(migrations)
+
+// migrate brings the database schema up to date. If the database already contains data, it is backed up beside the
+// database file before any changes are made. All pending migrations are applied in a single transaction, so a failed
+// upgrade leaves the database untouched.
+func (s *Storage) migrate(pathname string) error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("schema version: %v", err)
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than the latest version supported by this version of BookBrowser (%d)", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+
+	var tables int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables); err != nil {
+		return fmt.Errorf("schema version: %v", err)
+	}
+	// databases created before schema versioning have tables but no version
+	if tables > 0 {
+		backup := fmt.Sprintf("%s.v%d.bak", pathname, version)
+		log.Printf("Upgrading database schema from version %d to %d (backing up to %s)", version, SchemaVersion, backup)
+		if err := s.backup(backup); err != nil {
+			return fmt.Errorf("schema backup: %v", err)
+		}
+	}
+
+	fullText, err := s.fullTextAvailable()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for n := version; n < SchemaVersion; n++ {
+		if migrations[n].fullText && !fullText {
+			continue
+		}
+		if err = migrations[n].apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema migration %d (%s): %v", n+1, migrations[n].description, err)
+		}
+	}
+	// PRAGMA does not accept bind parameters; SchemaVersion is an integer, so this is safe
+	if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, SchemaVersion)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("schema version: %v", err)
+	}
+	return tx.Commit()
+}
+
+// apply runs a migration's queries using the specified transaction.
+func (m migration) apply(tx *sql.Tx) error {
+	for _, query := range m.queries {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("%s: %v", query, err)
+		}
+	}
+	return nil
+}
+
+// backup writes a consistent copy of the database to pathname, replacing any existing file.
+func (s *Storage) backup(pathname string) error {
+	if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err := s.db.Exec(`VACUUM INTO ?`, pathname)
+	return err
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemaVersion returns the schema version and number of books of the database at pathname.
+func schemaVersion(t *testing.T, pathname string) (version, books int) {
+	db, err := sql.Open("sqlite3", pathname)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.QueryRow(`PRAGMA user_version`).Scan(&version))
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM books`).Scan(&books))
+	return version, books
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-migrations")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a database created before schema versioning has the initial schema but no version
+	pathname := filepath.Join(dir, "test.db")
+	db, err := sql.Open("sqlite3", pathname)
+	require.NoError(t, err)
+	for _, query := range migrations[0].queries {
+		_, err = db.Exec(query)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(`INSERT INTO authors (name, sortname) VALUES ('Jane Doe', 'Doe, Jane')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO books (pathname, filesize, filemtime, hash, title, description, isbn, publishdate, importdate, authorid, publisherid, seriesid, seriesindex) VALUES ('/books/a.epub', 1, 1, 'a', 'A Book', '', '', 0, 0, 1, 0, 0, 0)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := New(pathname)
+	require.NoError(t, err)
+	bl, err := s.Books.QueryDeps(NewQuery())
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	assert.Equal(t, "A Book", bl[0].Title)
+	assert.Equal(t, []string{"Jane Doe"}, bl[0].Authors())
+	require.NoError(t, s.Close())
+
+	version, books := schemaVersion(t, pathname)
+	assert.Equal(t, SchemaVersion, version)
+	assert.Equal(t, 1, books)
+
+	// the database was backed up as it was before the upgrade
+	backup := pathname + ".v0.bak"
+	version, books = schemaVersion(t, backup)
+	assert.Equal(t, 0, version)
+	assert.Equal(t, 1, books)
+
+	// once up to date, opening the database changes nothing
+	require.NoError(t, os.Remove(backup))
+	s, err = New(pathname)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	version, books = schemaVersion(t, pathname)
+	assert.Equal(t, SchemaVersion, version)
+	assert.Equal(t, 1, books)
+	_, err = os.Stat(backup)
+	assert.True(t, os.IsNotExist(err))
+
+	// a database from a newer version of BookBrowser is refused
+	db, err = sql.Open("sqlite3", pathname)
+	require.NoError(t, err)
+	_, err = db.Exec(`PRAGMA user_version = 1000`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = New(pathname)
+	assert.Error(t, err)
+}
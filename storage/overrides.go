@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// bookOverrideTable holds the fields of each book's metadata that have been edited, which take precedence over the
+// metadata in the book's file whenever it is reindexed.
+const bookOverrideTable = "books_overrides"
+
+// OverrideStorage provides database functionality for manual edits to books' metadata.
+type OverrideStorage struct {
+	storage *Storage
+
+	preparedSelect      *sql.Stmt
+	preparedUpsert      *sql.Stmt
+	preparedDelete      *sql.Stmt
+	preparedEdited      *sql.Stmt
+	preparedEditedSince *sql.Stmt
+}
+
+// Creates a new override storage object.
+func NewOverrideStorage(s *Storage) (*OverrideStorage, error) {
+	a := &OverrideStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedSelect, err = s.db.Prepare("SELECT bookid, field, value, userid, updated FROM " + bookOverrideTable + " WHERE bookid = ? ORDER BY field"); err != nil {
+		return nil, err
+	}
+	if a.preparedUpsert, err = s.db.Prepare("INSERT INTO " + bookOverrideTable + " (bookid, field, value, userid, updated) VALUES (?,?,?,?,?) ON CONFLICT (bookid, field) DO UPDATE SET value = excluded.value, userid = excluded.userid, updated = excluded.updated"); err != nil {
+		return nil, err
+	}
+	if a.preparedDelete, err = s.db.Prepare("DELETE FROM " + bookOverrideTable + " WHERE bookid = ? AND field = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedEdited, err = s.db.Prepare("UPDATE books SET edited = ? WHERE id = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedEditedSince, err = s.db.Prepare("SELECT id FROM books WHERE edited >= ?"); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Retrieves the overridden fields of a book.
+func (a *OverrideStorage) ByBook(bookID int) ([]*booklist.Override, error) {
+	rows, err := a.preparedSelect.Query(bookID)
+	if err != nil {
+		return nil, fmt.Errorf("books_overrides, select: %v", err)
+	}
+	defer rows.Close()
+
+	overrides := []*booklist.Override{}
+	for rows.Next() {
+		o := &booklist.Override{}
+		var updated int64
+		if err := rows.Scan(&o.BookID, &o.Field, &o.Value, &o.UserID, &updated); err != nil {
+			return nil, err
+		}
+		o.Updated = time.Unix(updated, 0)
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// Saves a book along with the overrides for the fields that were edited, replacing any earlier overrides for those
+// fields, in a single transaction. If an override's Updated time is unset, the current time is used.
+func (a *OverrideStorage) Edit(book *booklist.Book, overrides ...*booklist.Override) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = a.editTx(tx, book, overrides)
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return err
+}
+
+func (a *OverrideStorage) editTx(tx *sql.Tx, book *booklist.Book, overrides []*booklist.Override) error {
+	if err := a.storage.Books.SaveTx(tx, book); err != nil {
+		return err
+	}
+
+	upsertStmt := tx.Stmt(a.preparedUpsert)
+	for _, o := range overrides {
+		o.BookID = book.ID
+		if o.Updated.IsZero() {
+			o.Updated = time.Unix(time.Now().Unix(), 0)
+		}
+		if _, err := upsertStmt.Exec(o.BookID, o.Field, o.Value, o.UserID, o.Updated.Unix()); err != nil {
+			return fmt.Errorf("books_overrides, upsert: %v", err)
+		}
+	}
+	if len(overrides) > 0 {
+		if _, err := tx.Stmt(a.preparedEdited).Exec(time.Now().Unix(), book.ID); err != nil {
+			return fmt.Errorf("books, edited: %v", err)
+		}
+	}
+
+	// the book's old author, series or publisher may no longer be referenced by any book
+	if err := a.storage.Authors.DeleteOrphansTx(tx); err != nil {
+		return err
+	}
+	if err := a.storage.Publishers.DeleteOrphansTx(tx); err != nil {
+		return err
+	}
+	return a.storage.Series.DeleteOrphansTx(tx)
+}
+
+// Deletes the overrides for one or more of a book's fields, so that their values are read from the book's file when
+// it is next reindexed.
+func (a *OverrideStorage) Delete(bookID int, fields ...string) error {
+	for _, field := range fields {
+		if _, err := a.preparedDelete.Exec(bookID, field); err != nil {
+			return fmt.Errorf("books_overrides, delete: %v", err)
+		}
+	}
+	if len(fields) > 0 {
+		if _, err := a.preparedEdited.Exec(time.Now().Unix(), bookID); err != nil {
+			return fmt.Errorf("books, edited: %v", err)
+		}
+	}
+	return nil
+}
+
+// Retrieves the IDs of the books whose metadata was edited, or had edits reverted, at or after since. These changes
+// don't modify the books' files, so they aren't reflected in their modification times.
+func (a *OverrideStorage) EditedSince(since time.Time) ([]int, error) {
+	return queryIDs(a.preparedEditedSince, "books", since.Unix())
+}
+
+// Deletes the overrides for one or more deleted books using the specified transaction.
+func (a *OverrideStorage) deleteBooksTx(tx *sql.Tx, ids ...int) error {
+	stmt, err := tx.Prepare("DELETE FROM " + bookOverrideTable + " WHERE bookid = ?")
+	if err != nil {
+		return fmt.Errorf("books_overrides, delete: %v", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("books_overrides, delete: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrides(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+	start := time.Unix(time.Now().Unix(), 0)
+
+	book := &booklist.Book{Hash: "a", FilePath: "/books/a.epub", Title: "Teh Book", Series: &booklist.Series{Name: "Wrong Series"}}
+	book.AddContributor("Wrong Author", booklist.RoleAuthor)
+	book.AddContributor("Some Translator", booklist.RoleTranslator)
+	require.NoError(t, s.Books.Save(book))
+
+	bl, err := s.Books.QueryDeps(NewQuery().In("id", []int{book.ID}))
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	edited := bl[0]
+
+	require.NoError(t, edited.SetField(booklist.FieldTitle, "The Book"))
+	require.NoError(t, edited.SetField(booklist.FieldAuthors, "Right Author\r\nCo Author"))
+	require.NoError(t, edited.SetField(booklist.FieldSeries, "Right Series"))
+	assert.Error(t, edited.SetField(booklist.FieldPublishDate, "yesterday"))
+	require.NoError(t, s.Overrides.Edit(edited,
+		&booklist.Override{Field: booklist.FieldTitle, Value: edited.FieldValue(booklist.FieldTitle), UserID: 1},
+		&booklist.Override{Field: booklist.FieldAuthors, Value: edited.FieldValue(booklist.FieldAuthors), UserID: 1},
+		&booklist.Override{Field: booklist.FieldSeries, Value: edited.FieldValue(booklist.FieldSeries), UserID: 1},
+	))
+
+	bl, err = s.Books.QueryDeps(NewQuery().In("id", []int{book.ID}))
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	assert.Equal(t, "The Book", bl[0].Title)
+	assert.Equal(t, []string{"Right Author", "Co Author"}, bl[0].Authors())
+	assert.Equal(t, "Right Author", bl[0].Author.Name)
+	require.Len(t, bl[0].Contributors, 3)
+	assert.Equal(t, booklist.RoleTranslator, bl[0].Contributors[2].Role)
+	assert.Equal(t, "Right Series", bl[0].Series.Name)
+
+	// the replaced author and series are no longer referenced
+	total, err := s.Series.Count(NewQuery())
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	authors, err := s.Authors.Query(NewQuery())
+	require.NoError(t, err)
+	assert.Len(t, authors, 3)
+
+	overrides, err := s.Overrides.ByBook(book.ID)
+	require.NoError(t, err)
+	require.Len(t, overrides, 3)
+	assert.Equal(t, booklist.FieldAuthors, overrides[0].Field)
+	assert.Equal(t, "Right Author\nCo Author", overrides[0].Value)
+	assert.Equal(t, 1, overrides[0].UserID)
+	assert.False(t, overrides[0].Updated.IsZero())
+
+	// reindexing re-reads the original metadata, which the overrides replace
+	reread := &booklist.Book{ID: book.ID, Hash: "a", FilePath: "/books/a.epub", Title: "Teh Book"}
+	reread.AddContributor("Wrong Author", booklist.RoleAuthor)
+	reread.ApplyOverrides(overrides)
+	assert.Equal(t, "The Book", reread.Title)
+	assert.Equal(t, []string{"Right Author", "Co Author"}, reread.Authors())
+	assert.Equal(t, "Right Series", reread.Series.Name)
+
+	// edits and reverts are recorded, since they don't change the book's file
+	ids, err := s.Overrides.EditedSince(start)
+	require.NoError(t, err)
+	assert.Equal(t, []int{book.ID}, ids)
+	ids, err = s.Overrides.EditedSince(start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+	_, err = s.db.Exec(`UPDATE books SET edited = 0`)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Overrides.Delete(book.ID, booklist.FieldTitle))
+	overrides, err = s.Overrides.ByBook(book.ID)
+	require.NoError(t, err)
+	assert.Len(t, overrides, 2)
+	ids, err = s.Overrides.EditedSince(start)
+	require.NoError(t, err)
+	assert.Equal(t, []int{book.ID}, ids)
+
+	require.NoError(t, s.Books.Delete(book.ID))
+	overrides, err = s.Overrides.ByBook(book.ID)
+	require.NoError(t, err)
+	assert.Empty(t, overrides)
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// bookPositionTable holds each user's reading position in each book.
+const bookPositionTable = "books_position"
+
+// PositionStorage provides database functionality for users' reading positions.
+type PositionStorage struct {
+	storage *Storage
+
+	preparedSelect *sql.Stmt
+	preparedUpsert *sql.Stmt
+	preparedLatest *sql.Stmt
+	preparedRecent *sql.Stmt
+}
+
+// positionsUnion selects a user's positions saved by the built-in readers along with their progress synced from
+// KOReader (in the books' files or in downloaded copies with their metadata embedded) and their Kobo in books in the
+// library, so that all of them show up on the web UI. The user ID must be bound four times.
+const positionsUnion = "SELECT bookid, position, percentage, updated, '' AS device FROM " + bookPositionTable + " WHERE userid = ?" +
+	" UNION ALL SELECT books.id, '', kosync.percentage, kosync.updated, kosync.device FROM " + kosyncProgressTable + " kosync" +
+	" JOIN books ON books.partialmd5 = kosync.document WHERE kosync.userid = ?" +
+	" UNION ALL SELECT digests.bookid, '', kosync.percentage, kosync.updated, kosync.device FROM " + kosyncProgressTable + " kosync" +
+	" JOIN " + kosyncDigestTable + " digests ON digests.document = kosync.document WHERE kosync.userid = ?" +
+	" UNION ALL SELECT bookid, '', percentage, updated, 'Kobo' FROM " + koboBookmarkTable + " WHERE userid = ?"
+
+// Creates a new position storage object.
+func NewPositionStorage(s *Storage) (*PositionStorage, error) {
+	a := &PositionStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedSelect, err = s.db.Prepare("SELECT bookid, position, percentage, updated, '' FROM " + bookPositionTable + " WHERE userid = ? AND bookid = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedUpsert, err = s.db.Prepare("INSERT INTO " + bookPositionTable + " (userid, bookid, position, percentage, updated) VALUES (?,?,?,?,?) ON CONFLICT (userid, bookid) DO UPDATE SET position = excluded.position, percentage = excluded.percentage, updated = excluded.updated"); err != nil {
+		return nil, err
+	}
+	if a.preparedLatest, err = s.db.Prepare("SELECT bookid, position, percentage, updated, device FROM (" + positionsUnion + ") WHERE bookid = ? ORDER BY updated DESC LIMIT 1"); err != nil {
+		return nil, err
+	}
+	// SQLite takes the other columns from the row with the MAX() value, so each book's most recent position is used;
+	// books the user has marked as finished are excluded even if their position isn't at the end
+	if a.preparedRecent, err = s.db.Prepare("SELECT bookid, position, percentage, updated, device FROM (SELECT bookid, position, percentage, MAX(updated) AS updated, device FROM (" + positionsUnion + ") GROUP BY bookid) WHERE percentage < ? AND bookid NOT IN (SELECT bookid FROM " + bookStatusTable + " WHERE userid = ? AND status = ?) ORDER BY updated DESC LIMIT ?"); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func scanPosition(scan func(dest ...interface{}) error) (*booklist.Position, error) {
+	p := &booklist.Position{}
+	var updated int64
+	if err := scan(&p.BookID, &p.Position, &p.Percentage, &updated, &p.Device); err != nil {
+		return nil, err
+	}
+	p.Updated = time.Unix(updated, 0)
+	return p, nil
+}
+
+// Retrieves the user's position in a book, or nil if they haven't read it.
+func (a *PositionStorage) ByBook(userID, bookID int) (*booklist.Position, error) {
+	p, err := scanPosition(a.preparedSelect.QueryRow(userID, bookID).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("books_position, select: %v", err)
+	}
+	return p, nil
+}
+
+// Retrieves the user's most recent position in a book from the built-in readers, KOReader or their Kobo, or nil if
+// they haven't read it.
+func (a *PositionStorage) Latest(userID, bookID int) (*booklist.Position, error) {
+	p, err := scanPosition(a.preparedLatest.QueryRow(userID, userID, userID, userID, bookID).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("books_position, select: %v", err)
+	}
+	return p, nil
+}
+
+// Saves the user's position in a book, replacing their previous position. If the position's Updated time is unset,
+// the current time is used.
+func (a *PositionStorage) Save(userID int, p *booklist.Position) error {
+	if p.Updated.IsZero() {
+		p.Updated = time.Unix(time.Now().Unix(), 0)
+	}
+	if _, err := a.preparedUpsert.Exec(userID, p.BookID, p.Position, p.Percentage, p.Updated.Unix()); err != nil {
+		return fmt.Errorf("books_position, upsert: %v", err)
+	}
+	return nil
+}
+
+// Retrieves up to limit of the user's most recent positions (from the built-in readers, KOReader or their Kobo) in books
+// they're partway through (having read less than the given percentage, and not having marked them as finished), most
+// recently read first.
+func (a *PositionStorage) Unfinished(userID int, percentage float64, limit int) ([]*booklist.Position, error) {
+	rows, err := a.preparedRecent.Query(userID, userID, userID, userID, percentage, userID, booklist.StatusFinished, limit)
+	if err != nil {
+		return nil, fmt.Errorf("books_position, select: %v", err)
+	}
+	defer rows.Close()
+
+	positions := make([]*booklist.Position, 0, limit)
+	for rows.Next() {
+		p, err := scanPosition(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+// Deletes all of a user's positions using the specified transaction.
+func (a *PositionStorage) deleteUserTx(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("DELETE FROM "+bookPositionTable+" WHERE userid = ?", userID); err != nil {
+		return fmt.Errorf("books_position, delete: %v", err)
+	}
+	return nil
+}
+
+// Deletes every user's positions in one or more deleted books using the specified transaction.
+func (a *PositionStorage) deleteBooksTx(tx *sql.Tx, ids ...int) error {
+	stmt, err := tx.Prepare("DELETE FROM " + bookPositionTable + " WHERE bookid = ?")
+	if err != nil {
+		return fmt.Errorf("books_position, delete: %v", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("books_position, delete: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPositions(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	books := seedBooks(t, s, 3)
+
+	pos, err := s.Positions.ByBook(1, books[0].ID)
+	require.NoError(t, err)
+	assert.Nil(t, pos)
+
+	now := time.Now()
+	require.NoError(t, s.Positions.Save(1, &booklist.Position{BookID: books[0].ID, Position: "epubcfi(/6/4)", Percentage: 0.1, Updated: now.Add(-time.Hour)}))
+	require.NoError(t, s.Positions.Save(1, &booklist.Position{BookID: books[1].ID, Position: "12", Percentage: 0.5, Updated: now}))
+	require.NoError(t, s.Positions.Save(1, &booklist.Position{BookID: books[2].ID, Position: "epubcfi(/6/40)", Percentage: 1}))
+	require.NoError(t, s.Positions.Save(2, &booklist.Position{BookID: books[0].ID, Position: "epubcfi(/6/8)", Percentage: 0.2}))
+
+	pos, err = s.Positions.ByBook(1, books[1].ID)
+	require.NoError(t, err)
+	require.NotNil(t, pos)
+	assert.Equal(t, "12", pos.Position)
+	assert.Equal(t, 0.5, pos.Percentage)
+	assert.Equal(t, now.Unix(), pos.Updated.Unix())
+
+	unfinished, err := s.Positions.Unfinished(1, 0.98, 10)
+	require.NoError(t, err)
+	require.Len(t, unfinished, 2)
+	assert.Equal(t, books[1].ID, unfinished[0].BookID, "most recently read first")
+	assert.Equal(t, books[0].ID, unfinished[1].BookID)
+
+	require.NoError(t, s.Statuses.SetStatus(1, books[1].ID, booklist.StatusFinished))
+	unfinished, err = s.Positions.Unfinished(1, 0.98, 10)
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	assert.Equal(t, books[0].ID, unfinished[0].BookID)
+
+	require.NoError(t, s.Books.Delete(books[0].ID))
+	pos, err = s.Positions.ByBook(2, books[0].ID)
+	require.NoError(t, err)
+	assert.Nil(t, pos)
+}
@@ -129,6 +129,14 @@ func (a *PublisherStorage) Save(publishers ... *booklist.Publisher) error {
 
 }
 
+// Deletes all Publishers that are no longer referenced by any book, using the specified transaction.
+func (a *PublisherStorage) DeleteOrphansTx(tx *sql.Tx) error {
+	if _, err := tx.Exec(buildDeleteOrphansQuery(publisherFields.table, bookFields.table, "publisherid")); err != nil {
+		return fmt.Errorf("publishers, delete orphans: %v", err)
+	}
+	return nil
+}
+
 func (a *PublisherStorage) Count(q *Query) (int, error) {
 	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
 	query, bindValues, err := q.buildSelect(a.baseCountQuery,publisherFields.columns)
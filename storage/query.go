@@ -4,12 +4,20 @@ import (
 	"strings"
 	"fmt"
 	"strconv"
+
+	"github.com/sblinch/BookBrowser/booklist"
 	)
 
 type queryFilter struct {
-	value string
-	exact bool
-	set   bool
+	value  string
+	exact  bool
+	set    bool
+	prefix bool
+}
+// querySubquery is a SELECT of book IDs, built only from trusted strings with its values bound separately.
+type querySubquery struct {
+	query  string
+	values []interface{}
 }
 type querySort struct {
 	value     string
@@ -23,6 +31,9 @@ type Query struct {
 	offset     int
 	limit      int
 
+	// restricts book queries to books whose IDs are returned by each of these subqueries
+	subqueries []querySubquery
+
 	random        bool
 	modified      bool
 	cachedClauses string
@@ -67,6 +78,46 @@ func (q *Query) Filtered(key string, value string, exact bool) *Query {
 	return q
 }
 
+// Prefixed filters the results to those whose key column begins with the given prefix.
+func (q *Query) Prefixed(key string, prefix string) *Query {
+	if key == "" {
+		return q
+	}
+	q.filters[key] = queryFilter{
+		value:  prefix,
+		prefix: true,
+	}
+	q.modified = true
+	return q
+}
+
+// Tagged filters book results to those with the given tag.
+func (q *Query) Tagged(tagID int) *Query {
+	return q.bookIDsIn("SELECT bookid FROM "+bookTagTable+" WHERE tagid = ?", tagID)
+}
+
+// WithStatus filters book results to those which the user has given the read status.
+func (q *Query) WithStatus(userID int, status booklist.ReadStatus) *Query {
+	return q.bookIDsIn("SELECT bookid FROM "+bookStatusTable+" WHERE userid = ? AND status = ?", userID, status)
+}
+
+// Favourited filters book results to the user's favourites.
+func (q *Query) Favourited(userID int) *Query {
+	return q.bookIDsIn("SELECT bookid FROM "+bookStatusTable+" WHERE userid = ? AND favourite = 1", userID)
+}
+
+// Shelved filters book results to those on the given shelf.
+func (q *Query) Shelved(shelfID int) *Query {
+	return q.bookIDsIn("SELECT bookid FROM "+shelfBookTable+" WHERE shelfid = ?", shelfID)
+}
+
+// bookIDsIn filters book results to those whose IDs are returned by the subquery.
+func (q *Query) bookIDsIn(subquery string, values ...interface{}) *Query {
+	q.subqueries = append(q.subqueries, querySubquery{query: subquery, values: values})
+	q.modified = true
+	return q
+}
+
 func (q *Query) OrFiltered(value string, exact bool, keys ...string) *Query {
 	if len(keys) == 0 {
 		return q
@@ -112,11 +163,24 @@ var queryExactStrings = map[bool]string{
 	false: "(%s LIKE ?)",
 	true:  "(%s = ?)",
 }
+// escapes the LIKE wildcards in a value that must be matched literally
+var queryLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 var querySortAscending = map[bool]string{
 	false: "DESC",
 	true:  "ASC",
 }
 
+// hasColumn reports whether column is one of columns.
+func hasColumn(columns []string, column string) bool {
+	for _, c := range columns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
 func (q *Query) buildCountSelect(baseQuery string, validColumns []string) (queryString string, bindValues []string, err error) {
 	return
 }
@@ -128,20 +192,14 @@ func (q *Query) buildSelect(baseQuery string, validColumns []string) (queryStrin
 
 	if q.modified {
 		cachedValues := make([]interface{},0,len(q.filters))
-		// validate filter/sort column names in case they're from untrusted input
-		isValidColumn := func(col string) bool {
-			for _, column := range validColumns {
-				if col == column {
-					return true
-				}
-			}
-			return false
-		}
 		writeFilter := func(w *strings.Builder, column string, f queryFilter) {
 			if f.set {
 				// value.set can only be assigned from In() which only accepts an integer slice, so the next line
 				// should be safe from SQL injection
 				w.WriteString(fmt.Sprintf("%s IN (%s)", column, f.value))
+			} else if f.prefix {
+				w.WriteString(fmt.Sprintf(`(%s LIKE ? ESCAPE '\')`, column))
+				cachedValues = append(cachedValues, queryLikeEscaper.Replace(f.value)+"%")
 			} else {
 				w.WriteString(fmt.Sprintf(queryExactStrings[f.exact], column))
 				keyword := f.value
@@ -165,7 +223,8 @@ func (q *Query) buildSelect(baseQuery string, validColumns []string) (queryStrin
 
 			first := true
 			for key, value := range q.filters {
-				if !isValidColumn(key) {
+				// validate filter/sort column names in case they're from untrusted input
+				if !hasColumn(validColumns, key) {
 					err = fmt.Errorf("invalid column name \"%s\"", key)
 					return
 				}
@@ -180,6 +239,17 @@ func (q *Query) buildSelect(baseQuery string, validColumns []string) (queryStrin
 			}
 		}
 
+		for _, sub := range q.subqueries {
+			if wroteWhere {
+				c.WriteString(" AND ")
+			} else {
+				c.WriteString(" WHERE ")
+				wroteWhere = true
+			}
+			c.WriteString("id IN (" + sub.query + ")")
+			cachedValues = append(cachedValues, sub.values...)
+		}
+
 		if len(q.multi) > 0 {
 			if wroteWhere {
 				c.WriteString(" AND ")
@@ -218,7 +288,7 @@ func (q *Query) buildSelect(baseQuery string, validColumns []string) (queryStrin
 			} else {
 				first := true
 				for _, sortV := range q.sortValues {
-					if !isValidColumn(sortV.value) {
+					if !hasColumn(validColumns, sortV.value) {
 						err = fmt.Errorf("invalid column name \"%s\"", sortV.value)
 						return
 					}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// searchColumns are the columns of the full-text search table, and the column qualifiers accepted in search queries
+// (eg: author:tolkien)
+var searchColumns = []string{"title", "author", "series", "publisher", "description", "isbn"}
+
+// searchWeights are the bm25 weights of each of searchColumns when ranking search results by relevance
+const searchWeights = "10.0, 5.0, 5.0, 2.0, 1.0, 1.0"
+
+// selects the full-text search content for books; a WHERE clause may be appended to restrict the books selected
+const searchContentQuery = `
+INSERT INTO books_fts (rowid, title, author, series, publisher, description, isbn)
+SELECT books.id, books.title, COALESCE((SELECT group_concat(authors.name, ' ') FROM ` + contributorTable + ` JOIN authors ON authors.id = authorid WHERE bookid = books.id), ''), COALESCE(series.name, ''), COALESCE(publishers.name, ''), books.description, books.isbn
+  FROM books
+  LEFT JOIN series ON series.id = books.seriesid
+  LEFT JOIN publishers ON publishers.id = books.publisherid`
+
+// searchRefresh returns the statements which replace the full-text search content of the books selected by where.
+func searchRefresh(where string) string {
+	return `DELETE FROM books_fts WHERE rowid IN (SELECT books.id FROM books WHERE ` + where + `);
+	` + searchContentQuery + ` WHERE ` + where + `;`
+}
+
+// searchTriggers are the triggers which keep the full-text search table up to date as books and the authors, series
+// and publishers they refer to change.
+var searchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS books_fts_books_insert AFTER INSERT ON books BEGIN
+	` + searchContentQuery + ` WHERE books.id = NEW.id;
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_books_update AFTER UPDATE OF title, description, isbn, seriesid, publisherid ON books BEGIN
+	` + searchRefresh("books.id = NEW.id") + `
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_books_delete AFTER DELETE ON books BEGIN
+	DELETE FROM books_fts WHERE rowid = OLD.id;
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_contributors_insert AFTER INSERT ON ` + contributorTable + ` BEGIN
+	` + searchRefresh("books.id = NEW.bookid") + `
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_contributors_delete AFTER DELETE ON ` + contributorTable + ` BEGIN
+	` + searchRefresh("books.id = OLD.bookid") + `
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_authors_update AFTER UPDATE OF name ON authors BEGIN
+	` + searchRefresh("books.id IN (SELECT bookid FROM "+contributorTable+" WHERE authorid = NEW.id)") + `
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_series_update AFTER UPDATE OF name ON series BEGIN
+	` + searchRefresh("books.seriesid = NEW.id") + `
+END`,
+	`CREATE TRIGGER IF NOT EXISTS books_fts_publishers_update AFTER UPDATE OF name ON publishers BEGIN
+	` + searchRefresh("books.publisherid = NEW.id") + `
+END`,
+}
+
+// searchSchema creates the full-text search table and the triggers which maintain it, and populates it with every
+// book; it is applied by the full-text search migration, and again by setupSearch if the triggers were removed.
+var searchSchema = append([]string{
+	fmt.Sprintf(`CREATE VIRTUAL TABLE IF NOT EXISTS books_fts USING fts5(%s, tokenize = 'unicode61 remove_diacritics 1')`, strings.Join(searchColumns, ", ")),
+	// the table may have been populated (and left out of date) by an earlier version, which didn't use triggers
+	`DELETE FROM books_fts`,
+	searchContentQuery,
+}, searchTriggers...)
+
+// fullTextAvailable reports whether SQLite was built with FTS5 support (ie: with the sqlite_fts5 build tag).
+func (s *Storage) fullTextAvailable() (bool, error) {
+	var available bool
+	if err := s.db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&available); err != nil {
+		return false, fmt.Errorf("search setup: %v", err)
+	}
+	return available, nil
+}
+
+// setupSearch enables full-text search if SQLite was built with FTS5 support; otherwise, keyword searches fall back
+// to simple substring matching. The search table is created by a migration and maintained by triggers, but those
+// triggers would fail without FTS5 support, so they are removed when the database is opened by a build without it,
+// and recreated (and the table rebuilt) when it is next opened by a build with it.
+func (s *Storage) setupSearch() error {
+	available, err := s.fullTextAvailable()
+	if err != nil {
+		return err
+	}
+
+	var triggers int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'books\_fts\_%' ESCAPE '\'`).Scan(&triggers); err != nil {
+		return fmt.Errorf("search setup: %v", err)
+	}
+
+	if !available {
+		if triggers > 0 {
+			if err := s.dropSearchTriggers(); err != nil {
+				return fmt.Errorf("search setup: %v", err)
+			}
+		}
+		return nil
+	}
+	s.fullText = true
+
+	if triggers == len(searchTriggers) {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = (migration{queries: searchSchema}).apply(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("search rebuild: %v", err)
+	}
+	return tx.Commit()
+}
+
+// dropSearchTriggers removes the triggers which maintain the full-text search table.
+func (s *Storage) dropSearchTriggers() error {
+	rows, err := s.db.Query(`SELECT name FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'books\_fts\_%' ESCAPE '\'`)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		// trigger names come from sqlite_master, and consist only of letters and underscores
+		if _, err := s.db.Exec(`DROP TRIGGER IF EXISTS ` + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeywordRelevance reports whether keyword search results can be sorted by relevance (using the "relevance" sort key).
+func (a *BookStorage) KeywordRelevance() bool {
+	return a.storage.fullText
+}
+
+// searchExpression converts a user's search query into an FTS5 match expression. All words must match; words match
+// as prefixes, "quoted phrases" match exactly, and a word or phrase may be restricted to a single column with a
+// qualifier such as author: or series:. Returns an empty string if the query contains nothing to search for.
+func searchExpression(q string) string {
+	terms := []string{}
+
+	for _, term := range splitSearchQuery(q) {
+		column := ""
+		if n := strings.Index(term, ":"); n > 0 {
+			for _, c := range searchColumns {
+				if strings.EqualFold(term[:n], c) {
+					column, term = c, term[n+1:]
+					break
+				}
+			}
+		}
+
+		phrase := strings.HasPrefix(term, `"`)
+		term = strings.Trim(term, `"`)
+		if strings.IndexFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) == -1 {
+			// nothing the tokenizer would index, which FTS5 would reject
+			continue
+		}
+
+		expr := `"` + strings.Replace(term, `"`, `""`, -1) + `"`
+		if !phrase {
+			expr += "*"
+		}
+		if column != "" {
+			expr = column + ":" + expr
+		}
+		terms = append(terms, expr)
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// splitSearchQuery splits a search query on whitespace, keeping quoted phrases (including any qualifier immediately
+// preceding them, as in series:"the expanse") together. An unterminated quote extends to the end of the query.
+func splitSearchQuery(q string) []string {
+	terms := []string{}
+	b := strings.Builder{}
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				terms = append(terms, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		terms = append(terms, b.String())
+	}
+	return terms
+}
@@ -0,0 +1,84 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// searchTitles returns the titles of the books matching a keyword search, in order of relevance.
+func searchTitles(t *testing.T, s *Storage, keyword string) []string {
+	bl, err := s.Books.QueryKeyword(keyword, NewQuery().SortedBy("relevance", true))
+	require.NoError(t, err)
+	titles := make([]string, len(bl))
+	for n, b := range bl {
+		titles[n] = b.Title
+	}
+	return titles
+}
+
+func TestKeywordSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookbrowser-search")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(filepath.Join(dir, "test.db"))
+	require.NoError(t, err)
+	require.True(t, s.Books.KeywordRelevance())
+
+	dune := &booklist.Book{Hash: "a", FilePath: "/books/a.epub", Title: "Dune", Series: &booklist.Series{Name: "Dune Chronicles"}}
+	dune.AddContributor("Frank Herbert", booklist.RoleAuthor)
+	desert := &booklist.Book{Hash: "b", FilePath: "/books/b.epub", Title: "Desert Planet", Description: "A story of a planet covered by a single dune."}
+	desert.AddContributor("Jane Doe", booklist.RoleAuthor)
+	garden := &booklist.Book{Hash: "c", FilePath: "/books/c.epub", Title: "Herbert's Garden", Publisher: &booklist.Publisher{Name: "Arrakis Press"}}
+	garden.AddContributor("Jane Doe", booklist.RoleAuthor)
+	require.NoError(t, s.Books.Save(dune, desert, garden))
+
+	// matches in the title outrank matches in the description
+	assert.Equal(t, []string{"Dune", "Desert Planet"}, searchTitles(t, s, "dune"))
+	assert.Equal(t, []string{"Desert Planet"}, searchTitles(t, s, "plan"))
+	assert.Equal(t, []string{"Herbert's Garden"}, searchTitles(t, s, "arrakis"))
+
+	// qualifiers restrict matches to a single column
+	assert.ElementsMatch(t, []string{"Dune", "Herbert's Garden"}, searchTitles(t, s, "herbert"))
+	assert.Equal(t, []string{"Dune"}, searchTitles(t, s, "author:herbert"))
+	assert.Equal(t, []string{"Dune"}, searchTitles(t, s, `series:"dune chronicles"`))
+	assert.Empty(t, searchTitles(t, s, "series:desert"))
+
+	// the search table is kept up to date as books are edited and deleted
+	garden.Title = "Rose Garden"
+	require.NoError(t, s.Books.Save(garden))
+	assert.Equal(t, []string{"Dune"}, searchTitles(t, s, "herbert"))
+	assert.Equal(t, []string{"Rose Garden"}, searchTitles(t, s, "rose"))
+
+	bl, err := s.Books.QueryDeps(NewQuery().In("id", []int{desert.ID}))
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	require.NoError(t, bl[0].SetField(booklist.FieldAuthors, "Frank Herbert"))
+	require.NoError(t, s.Overrides.Edit(bl[0], &booklist.Override{Field: booklist.FieldAuthors, Value: "Frank Herbert", UserID: 1}))
+	assert.Equal(t, []string{"Dune", "Desert Planet"}, searchTitles(t, s, "author:herbert"))
+	assert.Equal(t, []string{"Rose Garden"}, searchTitles(t, s, "author:doe"))
+
+	require.NoError(t, s.Books.Delete(dune.ID))
+	assert.Equal(t, []string{"Desert Planet"}, searchTitles(t, s, "dune"))
+
+	// changes made while the triggers were removed (by a build without FTS5 support) are picked up when they're restored
+	require.NoError(t, s.dropSearchTriggers())
+	_, err = s.db.Exec(`UPDATE books SET title = 'Thorn Garden' WHERE id = ?`, garden.ID)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = New(filepath.Join(dir, "test.db"))
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, []string{"Thorn Garden"}, searchTitles(t, s, "thorn"))
+	assert.Empty(t, searchTitles(t, s, "rose"))
+}
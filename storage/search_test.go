@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchExpression(t *testing.T) {
+	tests := map[string]string{
+		"":                               "",
+		"   ":                            "",
+		"dune":                           `"dune"*`,
+		"Frank Herbert":                  `"Frank"* "Herbert"*`,
+		`"the left hand"`:                `"the left hand"`,
+		`ursula "left hand"`:             `"ursula"* "left hand"`,
+		"author:tolkien":                 `author:"tolkien"*`,
+		"AUTHOR:tolkien":                 `author:"tolkien"*`,
+		`series:"the expanse" leviathan`: `series:"the expanse" "leviathan"*`,
+		"isbn:978":                       `isbn:"978"*`,
+		"foo:bar":                        `"foo:bar"*`,
+		"author:":                        "",
+		`"unterminated phrase`:           `"unterminated phrase"`,
+		"it's":                           `"it's"*`,
+		"- & *":                          "",
+		"naïve café":                     `"naïve"* "café"*`,
+	}
+
+	for input, expected := range tests {
+		assert.Equal(t, expected, searchExpression(input), "for %q", input)
+	}
+}
@@ -130,6 +130,14 @@ func (a *SeriesStorage) Save(series ... *booklist.Series) error {
 }
 
 
+// Deletes all Series that are no longer referenced by any book, using the specified transaction.
+func (a *SeriesStorage) DeleteOrphansTx(tx *sql.Tx) error {
+	if _, err := tx.Exec(buildDeleteOrphansQuery(seriesFields.table, bookFields.table, "seriesid")); err != nil {
+		return fmt.Errorf("series, delete orphans: %v", err)
+	}
+	return nil
+}
+
 func (a *SeriesStorage) Count(q *Query) (int, error) {
 	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
 	query, bindValues, err := q.buildSelect(a.baseCountQuery,seriesFields.columns)
@@ -145,6 +153,11 @@ func (a *SeriesStorage) Count(q *Query) (int, error) {
 	return total, nil
 }
 
+// Sortable reports whether series can be sorted by the specified column.
+func (a *SeriesStorage) Sortable(column string) bool {
+	return hasColumn(seriesFields.columns, column)
+}
+
 func (a *SeriesStorage) Query(q *Query) ([]*booklist.Series, error) {
 	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
 	query, bindValues, err := q.buildSelect(a.baseSelectQuery,seriesFields.columns)
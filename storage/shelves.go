@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// shelfBookTable joins shelves to the books on them.
+const shelfBookTable = "shelves_books"
+
+// ShelfStorage provides database functionality for users' Shelf objects and the books on them.
+type ShelfStorage struct {
+	storage *Storage
+
+	preparedInsert *sql.Stmt
+	preparedUpdate *sql.Stmt
+	preparedDelete *sql.Stmt
+
+	preparedBookInsert *sql.Stmt
+	preparedBookDelete *sql.Stmt
+
+	baseSelectQuery string
+	baseCountQuery  string
+}
+
+// shelfFields puts all of the code that maps database columns to struct fields in one place for ease of management when
+// adding or removing fields.
+//
+// Each of these declarations each must remain in precisely the same order as the others (with the exception of the ID
+// field which has special requirements noted below), and all declarations must be updated when fields are added or removed.
+var shelfFields = struct {
+	table   string
+	columns []string
+
+	insert func(stmt *sql.Stmt, shelf *booklist.Shelf) (sql.Result, error)
+	update func(stmt *sql.Stmt, shelf *booklist.Shelf) (sql.Result, error)
+	scan   func(rows *sql.Rows, shelf *booklist.Shelf) error
+}{
+	table: "shelves",
+
+	// id FIRST in columns
+	columns: []string{"id", "userid", "name", "kobo"},
+	scan: func(rows *sql.Rows, shelf *booklist.Shelf) error {
+		// id FIRST in scan
+		return rows.Scan(&shelf.ID, &shelf.UserID, &shelf.Name, &shelf.Kobo)
+	},
+	insert: func(stmt *sql.Stmt, shelf *booklist.Shelf) (sql.Result, error) {
+		// id OMITTED in insert
+		return stmt.Exec(shelf.UserID, shelf.Name, shelf.Kobo)
+	},
+	update: func(stmt *sql.Stmt, shelf *booklist.Shelf) (sql.Result, error) {
+		// id LAST in update
+		return stmt.Exec(shelf.UserID, shelf.Name, shelf.Kobo, shelf.ID)
+	},
+}
+
+// Creates a new shelf storage object.
+func NewShelfStorage(s *Storage) (*ShelfStorage, error) {
+	a := &ShelfStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedInsert, err = s.db.Prepare(buildInsertQuery(shelfFields.table, shelfFields.columns, false)); err != nil {
+		return nil, err
+	}
+	if a.preparedUpdate, err = s.db.Prepare(buildUpdateQuery(shelfFields.table, shelfFields.columns)); err != nil {
+		return nil, err
+	}
+	if a.preparedDelete, err = s.db.Prepare(buildDeleteQuery(shelfFields.table)); err != nil {
+		return nil, err
+	}
+
+	if a.preparedBookInsert, err = s.db.Prepare("INSERT OR IGNORE INTO " + shelfBookTable + " (shelfid, bookid, added) VALUES (?,?,?)"); err != nil {
+		return nil, err
+	}
+	if a.preparedBookDelete, err = s.db.Prepare("DELETE FROM " + shelfBookTable + " WHERE shelfid = ? AND bookid = ?"); err != nil {
+		return nil, err
+	}
+
+	a.baseSelectQuery, a.baseCountQuery = buildSelectQuery(shelfFields.table, shelfFields.columns)
+
+	return a, nil
+}
+
+// Saves one or more Shelves using the specified transaction.
+func (a *ShelfStorage) SaveTx(tx *sql.Tx, shelves ...*booklist.Shelf) error {
+	insertStmt := tx.Stmt(a.preparedInsert)
+	updateStmt := tx.Stmt(a.preparedUpdate)
+
+	var (
+		res      sql.Result
+		insertID int64
+		err      error
+	)
+	for _, shelf := range shelves {
+		if shelf.ID > 0 {
+			if _, err = shelfFields.update(updateStmt, shelf); err != nil {
+				return fmt.Errorf("shelves, update: %v", err)
+			}
+
+		} else {
+			res, err = shelfFields.insert(insertStmt, shelf)
+			if err == nil {
+				insertID, err = res.LastInsertId()
+				if err == nil {
+					shelf.ID = int(insertID)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("shelves, insert: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Saves one or more Shelves.
+func (a *ShelfStorage) Save(shelves ...*booklist.Shelf) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = a.SaveTx(tx, shelves...)
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+// Deletes one or more shelves by ID. The books on them are not affected.
+func (a *ShelfStorage) Delete(ids ...int) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	deleteStmt := tx.Stmt(a.preparedDelete)
+	for _, id := range ids {
+		if _, err = deleteStmt.Exec(id); err != nil {
+			err = fmt.Errorf("shelves, delete: %v", err)
+			break
+		}
+		if _, err = tx.Exec("DELETE FROM "+shelfBookTable+" WHERE shelfid = ?", id); err != nil {
+			err = fmt.Errorf("shelves, books delete: %v", err)
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+func (a *ShelfStorage) Count(q *Query) (int, error) {
+	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
+	query, bindValues, err := q.buildSelect(a.baseCountQuery, shelfFields.columns)
+	if err != nil {
+		return -1, err
+	}
+
+	total := 0
+	row := a.storage.db.QueryRow(query, bindValues...)
+	if err := row.Scan(&total); err != nil {
+		return -1, err
+	}
+	return total, nil
+}
+
+func (a *ShelfStorage) Query(q *Query) ([]*booklist.Shelf, error) {
+	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
+	query, bindValues, err := q.buildSelect(a.baseSelectQuery, shelfFields.columns)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := a.storage.db.Query(query, bindValues...)
+	if err != nil {
+		return nil, err
+	}
+
+	shelves := make([]*booklist.Shelf, 0, 16)
+
+	defer rows.Close()
+	for rows.Next() {
+		shelf := &booklist.Shelf{}
+		if err := shelfFields.scan(rows, shelf); err != nil {
+			return nil, err
+		}
+		shelves = append(shelves, shelf)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return shelves, nil
+}
+
+// Retrieves all of a user's shelves, sorted by name.
+func (a *ShelfStorage) ByUser(userID int) ([]*booklist.Shelf, error) {
+	return a.Query(NewQuery().In("userid", []int{userID}).SortedBy("name", true))
+}
+
+// Retrieves one of a user's shelves by ID, or nil if the user has no such shelf.
+func (a *ShelfStorage) ByID(userID, id int) (*booklist.Shelf, error) {
+	shelves, err := a.Query(NewQuery().In("id", []int{id}).In("userid", []int{userID}))
+	if err != nil || len(shelves) == 0 {
+		return nil, err
+	}
+	return shelves[0], nil
+}
+
+// Retrieves one of a user's shelves by name (which is case-insensitive), or nil if the user has no such shelf.
+func (a *ShelfStorage) ByName(userID int, name string) (*booklist.Shelf, error) {
+	shelves, err := a.Query(NewQuery().In("userid", []int{userID}).Filtered("name", name, true))
+	if err != nil || len(shelves) == 0 {
+		return nil, err
+	}
+	return shelves[0], nil
+}
+
+// Puts a book on a shelf, if it isn't already there.
+func (a *ShelfStorage) AddBook(shelfID, bookID int) error {
+	if _, err := a.preparedBookInsert.Exec(shelfID, bookID, time.Now().Unix()); err != nil {
+		return fmt.Errorf("shelves, books insert: %v", err)
+	}
+	return nil
+}
+
+// Takes a book off a shelf.
+func (a *ShelfStorage) RemoveBook(shelfID, bookID int) error {
+	if _, err := a.preparedBookDelete.Exec(shelfID, bookID); err != nil {
+		return fmt.Errorf("shelves, books delete: %v", err)
+	}
+	return nil
+}
+
+// Deletes all of a user's shelves using the specified transaction.
+func (a *ShelfStorage) deleteUserTx(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("DELETE FROM "+shelfBookTable+" WHERE shelfid IN (SELECT id FROM "+shelfFields.table+" WHERE userid = ?)", userID); err != nil {
+		return fmt.Errorf("shelves, books delete: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM "+shelfFields.table+" WHERE userid = ?", userID); err != nil {
+		return fmt.Errorf("shelves, delete: %v", err)
+	}
+	return nil
+}
+
+// Takes one or more deleted books off every shelf using the specified transaction.
+func (a *ShelfStorage) deleteBooksTx(tx *sql.Tx, ids ...int) error {
+	stmt, err := tx.Prepare("DELETE FROM " + shelfBookTable + " WHERE bookid = ?")
+	if err != nil {
+		return fmt.Errorf("shelves, books delete: %v", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("shelves, books delete: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShelvesAndStatuses(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	books := seedBooks(t, s, 2)
+
+	count := func(q *Query) int {
+		total, err := s.Books.Count(q)
+		require.NoError(t, err)
+		return total
+	}
+
+	require.NoError(t, s.Statuses.SetStatus(1, books[0].ID, booklist.StatusReading))
+	require.NoError(t, s.Statuses.SetFavourite(1, books[0].ID, true))
+	require.NoError(t, s.Statuses.SetStatus(2, books[1].ID, booklist.StatusReading))
+	assert.Equal(t, 1, count(NewQuery().WithStatus(1, booklist.StatusReading)))
+	assert.Equal(t, 0, count(NewQuery().WithStatus(1, booklist.StatusFinished)))
+	assert.Equal(t, 1, count(NewQuery().Favourited(1)))
+	assert.Equal(t, 0, count(NewQuery().Favourited(2)))
+
+	// changing the status mustn't clear the favourite, and vice versa
+	require.NoError(t, s.Statuses.SetStatus(1, books[0].ID, booklist.StatusFinished))
+	require.NoError(t, s.Statuses.SetFavourite(2, books[1].ID, true))
+	state, err := s.Statuses.ByBook(1, books[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, booklist.StatusFinished, state.Status)
+	assert.True(t, state.Favourite)
+	state, err = s.Statuses.ByBook(2, books[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, booklist.StatusReading, state.Status)
+
+	shelf := &booklist.Shelf{UserID: 1, Name: "Holiday"}
+	require.NoError(t, s.Shelves.Save(shelf))
+	require.NoError(t, s.Shelves.AddBook(shelf.ID, books[0].ID))
+	require.NoError(t, s.Shelves.AddBook(shelf.ID, books[0].ID))
+	require.NoError(t, s.Shelves.AddBook(shelf.ID, books[1].ID))
+	assert.Equal(t, 2, count(NewQuery().Shelved(shelf.ID)))
+	assert.Equal(t, 1, count(NewQuery().Shelved(shelf.ID).WithStatus(1, booklist.StatusFinished)))
+
+	found, err := s.Shelves.ByName(1, "holiday")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	found, err = s.Shelves.ByID(2, shelf.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found, "shelves belong to their user")
+
+	state, err = s.Statuses.ByBook(1, books[1].ID)
+	require.NoError(t, err)
+	assert.True(t, state.ShelfIDs[shelf.ID])
+
+	require.NoError(t, s.Books.Delete(books[0].ID))
+	assert.Equal(t, 1, count(NewQuery().Shelved(shelf.ID)))
+	assert.Equal(t, 0, count(NewQuery().Favourited(1)))
+
+	require.NoError(t, s.Shelves.RemoveBook(shelf.ID, books[1].ID))
+	assert.Equal(t, 0, count(NewQuery().Shelved(shelf.ID)))
+}
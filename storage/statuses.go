@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// bookStatusTable holds each user's read status and favourites.
+const bookStatusTable = "books_status"
+
+// StatusStorage provides database functionality for users' read statuses and favourites.
+type StatusStorage struct {
+	storage *Storage
+
+	preparedSelect          *sql.Stmt
+	preparedSelectShelves   *sql.Stmt
+	preparedUpsertStatus    *sql.Stmt
+	preparedUpsertFavourite *sql.Stmt
+}
+
+// Creates a new status storage object.
+func NewStatusStorage(s *Storage) (*StatusStorage, error) {
+	a := &StatusStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedSelect, err = s.db.Prepare("SELECT status, favourite FROM " + bookStatusTable + " WHERE userid = ? AND bookid = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedSelectShelves, err = s.db.Prepare("SELECT sb.shelfid FROM " + shelfBookTable + " sb JOIN " + shelfFields.table + " s ON s.id = sb.shelfid WHERE s.userid = ? AND sb.bookid = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedUpsertStatus, err = s.db.Prepare("INSERT INTO " + bookStatusTable + " (userid, bookid, status, updated) VALUES (?,?,?,?) ON CONFLICT (userid, bookid) DO UPDATE SET status = excluded.status, updated = excluded.updated"); err != nil {
+		return nil, err
+	}
+	if a.preparedUpsertFavourite, err = s.db.Prepare("INSERT INTO " + bookStatusTable + " (userid, bookid, favourite, updated) VALUES (?,?,?,?) ON CONFLICT (userid, bookid) DO UPDATE SET favourite = excluded.favourite, updated = excluded.updated"); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Retrieves the user's read status and favourite flag for a book, and the shelves it's on.
+func (a *StatusStorage) ByBook(userID, bookID int) (*booklist.BookState, error) {
+	state := &booklist.BookState{ShelfIDs: make(map[int]bool)}
+
+	err := a.preparedSelect.QueryRow(userID, bookID).Scan(&state.Status, &state.Favourite)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("books_status, select: %v", err)
+	}
+
+	rows, err := a.preparedSelectShelves.Query(userID, bookID)
+	if err != nil {
+		return nil, fmt.Errorf("shelves, books select: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var shelfID int
+		if err := rows.Scan(&shelfID); err != nil {
+			return nil, err
+		}
+		state.ShelfIDs[shelfID] = true
+	}
+
+	return state, rows.Err()
+}
+
+// Sets the user's read status for a book.
+func (a *StatusStorage) SetStatus(userID, bookID int, status booklist.ReadStatus) error {
+	if _, err := a.preparedUpsertStatus.Exec(userID, bookID, status, time.Now().Unix()); err != nil {
+		return fmt.Errorf("books_status, upsert: %v", err)
+	}
+	return nil
+}
+
+// Adds a book to or removes it from the user's favourites.
+func (a *StatusStorage) SetFavourite(userID, bookID int, favourite bool) error {
+	if _, err := a.preparedUpsertFavourite.Exec(userID, bookID, favourite, time.Now().Unix()); err != nil {
+		return fmt.Errorf("books_status, upsert: %v", err)
+	}
+	return nil
+}
+
+// Deletes all of a user's statuses and favourites using the specified transaction.
+func (a *StatusStorage) deleteUserTx(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("DELETE FROM "+bookStatusTable+" WHERE userid = ?", userID); err != nil {
+		return fmt.Errorf("books_status, delete: %v", err)
+	}
+	return nil
+}
+
+// Deletes every user's statuses and favourites for one or more deleted books using the specified transaction.
+func (a *StatusStorage) deleteBooksTx(tx *sql.Tx, ids ...int) error {
+	stmt, err := tx.Prepare("DELETE FROM " + bookStatusTable + " WHERE bookid = ?")
+	if err != nil {
+		return fmt.Errorf("books_status, delete: %v", err)
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return fmt.Errorf("books_status, delete: %v", err)
+		}
+	}
+	return nil
+}
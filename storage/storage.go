@@ -3,7 +3,6 @@ package storage
 import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
-	"fmt"
 	)
 
 // Storage provides back-end storage for BookBrowser
@@ -15,11 +14,22 @@ type Storage struct {
 	// Author as part of a Book save; the active transaction is stored here
 	activeTx *sql.Tx
 
+	// whether the full-text search table is available
+	fullText bool
+
 	// data mappers for BookBrowser's models
 	Books      *BookStorage
 	Authors    *AuthorStorage
 	Series     *SeriesStorage
 	Publishers *PublisherStorage
+	Tags       *TagStorage
+	Users      *UserStorage
+	Shelves    *ShelfStorage
+	Statuses   *StatusStorage
+	Positions  *PositionStorage
+	KOSync     *KOSyncStorage
+	Kobo       *KoboStorage
+	Overrides  *OverrideStorage
 }
 
 // New creates a new Storage instance from a SQLite database located at pathname.
@@ -39,7 +49,10 @@ func New(pathname string) (s *Storage, err error) {
 		}
 	}()
 
-	if err = s.setupSchema(); err != nil {
+	if err = s.migrate(pathname); err != nil {
+		return
+	}
+	if err = s.setupSearch(); err != nil {
 		return
 	}
 
@@ -57,55 +70,39 @@ func New(pathname string) (s *Storage, err error) {
 		return
 	}
 
-	return
-}
+	if s.Tags, err = NewTagStorage(s); err != nil {
+		return
+	}
 
-// setupSchema creates any tables that may be missing from the SQLite database.
-func (s *Storage) setupSchema() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS books (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	pathname VARCHAR(255) NOT NULL,
-	filesize INTEGER NOT NULL,
-	filemtime INTEGER NOT NULL,
-	hash VARCHAR(40) NOT NULL,
-	hascover INTEGER NOT NULL DEFAULT 0,
-	title VARCHAR(255) NOT NULL,
-	description TEXT NOT NULL,
-	isbn VARCHAR(16) NOT NULL,
-	publishdate INTEGER NOT NULL,
-	importdate INTEGER NOT NULL,
-	authorid INTEGER NOT NULL,
-	publisherid INTEGER,
-	seriesid INTEGER,
-	seriesindex INTEGER
-)`,
-		`CREATE TABLE IF NOT EXISTS authors (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	name VARCHAR(255) NOT NULL,
-	sortname VARCHAR(255) NOT NULL,
-	UNIQUE(name)
-)`,
-		`CREATE TABLE IF NOT EXISTS publishers (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	name VARCHAR(255) NOT NULL,
-	UNIQUE(name)
-)`,
-		`CREATE TABLE IF NOT EXISTS series (
-	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	name VARCHAR(255) NOT NULL,
-	UNIQUE(name)
-)`,
-	}
-
-	for _, query := range queries {
-		_, err := s.db.Exec(query)
-		if err != nil {
-			err := fmt.Errorf("schema setup (%s): %v", query, err.Error())
-			return err
-		}
+	if s.Users, err = NewUserStorage(s); err != nil {
+		return
+	}
+
+	if s.Shelves, err = NewShelfStorage(s); err != nil {
+		return
+	}
+
+	if s.Statuses, err = NewStatusStorage(s); err != nil {
+		return
+	}
+
+	if s.Positions, err = NewPositionStorage(s); err != nil {
+		return
 	}
-	return nil
+
+	if s.KOSync, err = NewKOSyncStorage(s); err != nil {
+		return
+	}
+
+	if s.Kobo, err = NewKoboStorage(s); err != nil {
+		return
+	}
+
+	if s.Overrides, err = NewOverrideStorage(s); err != nil {
+		return
+	}
+
+	return
 }
 
 // Close closes the underlying database handle.
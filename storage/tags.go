@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// bookTagTable joins books to their tags.
+const bookTagTable = "books_tags"
+
+type TagStorage struct {
+	storage *Storage
+
+	preparedInsert   *sql.Stmt
+	preparedUpdate   *sql.Stmt
+	preparedSelectID *sql.Stmt
+
+	baseSelectQuery string
+	baseCountQuery  string
+}
+
+// tagFields puts all of the code that maps database columns to struct fields in one place for ease of management when
+// adding or removing fields.
+//
+// Each of these declarations each must remain in precisely the same order as the others (with the exception of the ID
+// field which has special requirements noted below), and all declarations must be updated when fields are added or removed.
+var tagFields = struct {
+	table   string
+	columns []string
+
+	insert func(stmt *sql.Stmt, tag *booklist.Tag) (sql.Result, error)
+	update func(stmt *sql.Stmt, tag *booklist.Tag) (sql.Result, error)
+	scan   func(rows *sql.Rows, tag *booklist.Tag) error
+}{
+	table: "tags",
+
+	// id FIRST in columns
+	columns: []string{"id", "name"},
+	scan: func(rows *sql.Rows, tag *booklist.Tag) error {
+		// id FIRST in scan
+		return rows.Scan(&tag.ID, &tag.Name)
+	},
+	insert: func(stmt *sql.Stmt, tag *booklist.Tag) (sql.Result, error) {
+		// id OMITTED in insert
+		return stmt.Exec(tag.Name)
+	},
+	update: func(stmt *sql.Stmt, tag *booklist.Tag) (sql.Result, error) {
+		// id LAST in update
+		return stmt.Exec(tag.Name, tag.ID)
+	},
+}
+
+func NewTagStorage(s *Storage) (*TagStorage, error) {
+	a := &TagStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedInsert, err = s.db.Prepare(buildInsertQuery(tagFields.table, tagFields.columns, true)); err != nil {
+		return nil, err
+	}
+	if a.preparedUpdate, err = s.db.Prepare(buildUpdateQuery(tagFields.table, tagFields.columns)); err != nil {
+		return nil, err
+	}
+
+	q, _ := buildSelectQuery(tagFields.table, []string{"id"})
+	if a.preparedSelectID, err = s.db.Prepare(q + " WHERE name=?"); err != nil {
+		return nil, err
+	}
+
+	a.baseSelectQuery, a.baseCountQuery = buildSelectQuery(tagFields.table, tagFields.columns)
+
+	return a, nil
+}
+
+// Saves one or more Tags using the specified transaction.
+func (a *TagStorage) SaveTx(tx *sql.Tx, tags ...*booklist.Tag) error {
+	insertStmt := tx.Stmt(a.preparedInsert)
+	updateStmt := tx.Stmt(a.preparedUpdate)
+	selectIDStmt := tx.Stmt(a.preparedSelectID)
+
+	var (
+		res        sql.Result
+		insertID   int64
+		existingID int
+		err        error
+	)
+	for _, tag := range tags {
+		if tag.ID > 0 {
+			if _, err = tagFields.update(updateStmt, tag); err != nil {
+				return fmt.Errorf("tags, update: %v", err)
+			}
+
+		} else {
+			// tag names are case-insensitive, so this finds the existing tag regardless of case
+			if err := selectIDStmt.QueryRow(tag.Name).Scan(&existingID); err == nil && existingID > 0 {
+				tag.ID = existingID
+				continue
+			}
+
+			res, err = tagFields.insert(insertStmt, tag)
+			if err == nil {
+				insertID, err = res.LastInsertId()
+				if err == nil {
+					tag.ID = int(insertID)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("tags, insert: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Saves one or more Tags.
+func (a *TagStorage) Save(tags ...*booklist.Tag) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = a.SaveTx(tx, tags...)
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+// Deletes all Tags that are no longer referenced by any book, using the specified transaction.
+func (a *TagStorage) DeleteOrphansTx(tx *sql.Tx) error {
+	if _, err := tx.Exec(buildDeleteOrphansQuery(tagFields.table, bookTagTable, "tagid")); err != nil {
+		return fmt.Errorf("tags, delete orphans: %v", err)
+	}
+	return nil
+}
+
+func (a *TagStorage) Count(q *Query) (int, error) {
+	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
+	query, bindValues, err := q.buildSelect(a.baseCountQuery, tagFields.columns)
+	if err != nil {
+		return -1, err
+	}
+
+	total := 0
+	row := a.storage.db.QueryRow(query, bindValues...)
+	if err := row.Scan(&total); err != nil {
+		return -1, err
+	}
+	return total, nil
+}
+
+func (a *TagStorage) Query(q *Query) ([]*booklist.Tag, error) {
+	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
+	query, bindValues, err := q.buildSelect(a.baseSelectQuery, tagFields.columns)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := a.storage.db.Query(query, bindValues...)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]*booklist.Tag, 0, 16)
+
+	defer rows.Close()
+	for rows.Next() {
+		tag := &booklist.Tag{}
+		if err := tagFields.scan(rows, tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func (a *TagStorage) ByID(tl []*booklist.Tag) map[int]*booklist.Tag {
+	valuesByID := make(map[int]*booklist.Tag)
+	for _, value := range tl {
+		valuesByID[value.ID] = value
+	}
+	return valuesByID
+}
+
+// prepareTags prepares the statements used to maintain books' tags.
+func (a *BookStorage) prepareTags() (err error) {
+	if a.preparedTagInsert, err = a.storage.db.Prepare("INSERT OR IGNORE INTO " + bookTagTable + " (bookid, tagid, position) VALUES (?,?,?)"); err != nil {
+		return err
+	}
+	a.preparedTagDelete, err = a.storage.db.Prepare("DELETE FROM " + bookTagTable + " WHERE bookid = ?")
+	return err
+}
+
+// saveTagsTx saves a book's tags (if not already saved) and replaces the book's stored tags using the specified
+// transaction.
+func (a *BookStorage) saveTagsTx(tx *sql.Tx, book *booklist.Book) error {
+	for _, tag := range book.Tags {
+		if tag.ID == 0 {
+			if err := a.storage.Tags.SaveTx(tx, tag); err != nil {
+				return fmt.Errorf("books, tags: %v", err)
+			}
+		}
+	}
+
+	if _, err := tx.Stmt(a.preparedTagDelete).Exec(book.ID); err != nil {
+		return fmt.Errorf("books, tags delete: %v", err)
+	}
+
+	insertStmt := tx.Stmt(a.preparedTagInsert)
+	for position, tag := range book.Tags {
+		if _, err := insertStmt.Exec(book.ID, tag.ID, position); err != nil {
+			return fmt.Errorf("books, tags insert: %v", err)
+		}
+	}
+	return nil
+}
+
+// deleteTagsTx removes the stored tags of the specified books using the specified transaction.
+func (a *BookStorage) deleteTagsTx(tx *sql.Tx, ids ...int) error {
+	deleteStmt := tx.Stmt(a.preparedTagDelete)
+	for _, id := range ids {
+		if _, err := deleteStmt.Exec(id); err != nil {
+			return fmt.Errorf("books, tags delete: %v", err)
+		}
+	}
+	return nil
+}
+
+// loadTags loads the tags of each of the specified books.
+func (a *BookStorage) loadTags(books []*booklist.Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(books))
+	byID := make(map[int]*booklist.Book, len(books))
+	for k, book := range books {
+		ids[k] = strconv.Itoa(book.ID)
+		byID[book.ID] = book
+		book.Tags = make([]*booklist.Tag, 0)
+	}
+
+	// ids are integers, so this is safe from SQL injection
+	rows, err := a.storage.db.Query("SELECT " + bookTagTable + ".bookid, tags.id, tags.name FROM " + bookTagTable + " JOIN tags ON tags.id = " + bookTagTable + ".tagid WHERE " + bookTagTable + ".bookid IN (" + strings.Join(ids, ",") + ") ORDER BY " + bookTagTable + ".bookid, " + bookTagTable + ".position")
+	if err != nil {
+		return fmt.Errorf("books, tags query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookID int
+		tag := &booklist.Tag{}
+		if err := rows.Scan(&bookID, &tag.ID, &tag.Name); err != nil {
+			return fmt.Errorf("books, tags scan: %v", err)
+		}
+		if book, exists := byID[bookID]; exists {
+			book.Tags = append(book.Tags, tag)
+		}
+	}
+	return rows.Err()
+}
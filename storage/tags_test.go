@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTags(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	books := []*booklist.Book{
+		{Hash: "a", FilePath: "/books/a.epub", Title: "A"},
+		{Hash: "b", FilePath: "/books/b.epub", Title: "B"},
+		{Hash: "c", FilePath: "/books/c.epub", Title: "C"},
+	}
+	books[0].AddTag("Fantasy")
+	books[0].AddTag("Dragons")
+	books[1].AddTag("fantasy")
+	books[2].AddTag("FANTASY")
+	books[2].AddTag("Science Fiction")
+	require.NoError(t, s.Books.Save(books...))
+
+	count := func(q *Query) int {
+		total, err := s.Books.Count(q)
+		require.NoError(t, err)
+		return total
+	}
+	tagNamed := func(name string) *booklist.Tag {
+		tl, err := s.Tags.Query(NewQuery().Filtered("name", name, true))
+		require.NoError(t, err)
+		require.Len(t, tl, 1, "tag %q", name)
+		return tl[0]
+	}
+
+	// tag names are case-insensitive, so the first spelling saved is shared by every book
+	tl, err := s.Tags.Query(NewQuery().SortedBy("name", true))
+	require.NoError(t, err)
+	names := make([]string, len(tl))
+	for k, tag := range tl {
+		names[k] = tag.Name
+	}
+	assert.Equal(t, []string{"Dragons", "Fantasy", "Science Fiction"}, names)
+	fantasy := tagNamed("fantasy")
+	assert.Equal(t, "Fantasy", fantasy.Name)
+	assert.Equal(t, fantasy.ID, books[1].Tags[0].ID)
+	assert.Equal(t, fantasy.ID, books[2].Tags[0].ID)
+
+	// books' tags are loaded in the order they're listed in the book
+	bl, err := s.Books.QueryDeps(NewQuery().In("id", []int{books[2].ID}))
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	require.Len(t, bl[0].Tags, 2)
+	assert.Equal(t, "Fantasy", bl[0].Tags[0].Name)
+	assert.Equal(t, "Science Fiction", bl[0].Tags[1].Name)
+
+	assert.Equal(t, 3, count(NewQuery().Tagged(fantasy.ID)))
+	assert.Equal(t, 1, count(NewQuery().Tagged(tagNamed("Dragons").ID)))
+	assert.Equal(t, 0, count(NewQuery().Tagged(fantasy.ID+100)))
+
+	// the tag filter combines with other filters
+	assert.Equal(t, 1, count(NewQuery().Tagged(fantasy.ID).Filtered("title", "B", true)))
+	assert.Equal(t, 0, count(NewQuery().Tagged(tagNamed("Dragons").ID).Filtered("title", "B", true)))
+	assert.Equal(t, 1, count(NewQuery().Tagged(fantasy.ID).Tagged(tagNamed("Science Fiction").ID)))
+	assert.Equal(t, 2, count(NewQuery().Tagged(fantasy.ID).In("id", []int{books[0].ID, books[2].ID})))
+	require.NoError(t, s.Statuses.SetFavourite(1, books[1].ID, true))
+	assert.Equal(t, 1, count(NewQuery().Tagged(fantasy.ID).Favourited(1)))
+	bl, err = s.Books.Query(NewQuery().Tagged(fantasy.ID).SortedBy("title", false).Skip(1).Take(1))
+	require.NoError(t, err)
+	require.Len(t, bl, 1)
+	assert.Equal(t, "B", bl[0].Title)
+
+	// saving a book replaces its tags, and deleting the last book with a tag deletes the tag
+	books[0].Tags = nil
+	books[0].AddTag("fantasy")
+	require.NoError(t, s.Books.Save(books[0]))
+	assert.Equal(t, 0, count(NewQuery().Tagged(tagNamed("Dragons").ID)))
+	require.NoError(t, s.Books.Delete(books[2].ID))
+	assert.Equal(t, 2, count(NewQuery().Tagged(fantasy.ID)))
+	total, err := s.Tags.Count(NewQuery().Filtered("name", "science fiction", true))
+	require.NoError(t, err)
+	assert.Equal(t, 0, total)
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+)
+
+// sessionTable holds the signed-in sessions of users.
+const sessionTable = "sessions"
+
+// UserStorage provides database functionality for User objects and their sessions.
+type UserStorage struct {
+	storage *Storage
+
+	preparedInsert *sql.Stmt
+	preparedUpdate *sql.Stmt
+	preparedDelete *sql.Stmt
+
+	preparedSessionInsert        *sql.Stmt
+	preparedSessionSelect        *sql.Stmt
+	preparedSessionDelete        *sql.Stmt
+	preparedSessionDeleteUser    *sql.Stmt
+	preparedSessionDeleteExpired *sql.Stmt
+
+	baseSelectQuery string
+	baseCountQuery  string
+}
+
+// userFields puts all of the code that maps database columns to struct fields in one place for ease of management when
+// adding or removing fields.
+//
+// Each of these declarations each must remain in precisely the same order as the others (with the exception of the ID
+// field which has special requirements noted below), and all declarations must be updated when fields are added or removed.
+var userFields = struct {
+	table   string
+	columns []string
+
+	insert func(stmt *sql.Stmt, user *booklist.User) (sql.Result, error)
+	update func(stmt *sql.Stmt, user *booklist.User) (sql.Result, error)
+	scan   func(rows *sql.Rows, user *booklist.User) error
+}{
+	table: "users",
+
+	// id FIRST in columns
+	columns: []string{"id", "username", "admin", "passwordhash", "tokenhash", "synckeyhash"},
+	scan: func(rows *sql.Rows, user *booklist.User) error {
+		// id FIRST in scan
+		return rows.Scan(&user.ID, &user.Username, &user.Admin, &user.PasswordHash, &user.TokenHash, &user.SyncKeyHash)
+	},
+	insert: func(stmt *sql.Stmt, user *booklist.User) (sql.Result, error) {
+		// id OMITTED in insert
+		return stmt.Exec(user.Username, user.Admin, user.PasswordHash, user.TokenHash, user.SyncKeyHash)
+	},
+	update: func(stmt *sql.Stmt, user *booklist.User) (sql.Result, error) {
+		// id LAST in update
+		return stmt.Exec(user.Username, user.Admin, user.PasswordHash, user.TokenHash, user.SyncKeyHash, user.ID)
+	},
+}
+
+// Creates a new user storage object.
+func NewUserStorage(s *Storage) (*UserStorage, error) {
+	a := &UserStorage{
+		storage: s,
+	}
+
+	var err error
+	if a.preparedInsert, err = s.db.Prepare(buildInsertQuery(userFields.table, userFields.columns, false)); err != nil {
+		return nil, err
+	}
+	if a.preparedUpdate, err = s.db.Prepare(buildUpdateQuery(userFields.table, userFields.columns)); err != nil {
+		return nil, err
+	}
+	if a.preparedDelete, err = s.db.Prepare(buildDeleteQuery(userFields.table)); err != nil {
+		return nil, err
+	}
+
+	if a.preparedSessionInsert, err = s.db.Prepare("INSERT INTO " + sessionTable + " (tokenhash, userid, expires) VALUES (?,?,?)"); err != nil {
+		return nil, err
+	}
+	if a.preparedSessionSelect, err = s.db.Prepare("SELECT userid FROM " + sessionTable + " WHERE tokenhash = ? AND expires > ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedSessionDelete, err = s.db.Prepare("DELETE FROM " + sessionTable + " WHERE tokenhash = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedSessionDeleteUser, err = s.db.Prepare("DELETE FROM " + sessionTable + " WHERE userid = ?"); err != nil {
+		return nil, err
+	}
+	if a.preparedSessionDeleteExpired, err = s.db.Prepare("DELETE FROM " + sessionTable + " WHERE expires <= ?"); err != nil {
+		return nil, err
+	}
+
+	a.baseSelectQuery, a.baseCountQuery = buildSelectQuery(userFields.table, userFields.columns)
+
+	return a, nil
+}
+
+// Saves one or more Users using the specified transaction.
+func (a *UserStorage) SaveTx(tx *sql.Tx, users ...*booklist.User) error {
+	insertStmt := tx.Stmt(a.preparedInsert)
+	updateStmt := tx.Stmt(a.preparedUpdate)
+
+	var (
+		res      sql.Result
+		insertID int64
+		err      error
+	)
+	for _, user := range users {
+		if user.ID > 0 {
+			if _, err = userFields.update(updateStmt, user); err != nil {
+				return fmt.Errorf("users, update: %v", err)
+			}
+
+		} else {
+			res, err = userFields.insert(insertStmt, user)
+			if err == nil {
+				insertID, err = res.LastInsertId()
+				if err == nil {
+					user.ID = int(insertID)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("users, insert: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Saves one or more Users.
+func (a *UserStorage) Save(users ...*booklist.User) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = a.SaveTx(tx, users...)
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+// Deletes one or more users by ID, along with their sessions, read statuses, shelves, reading positions, KOReader
+// progress and Kobo sync state.
+func (a *UserStorage) Delete(ids ...int) error {
+	tx, err := a.storage.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	deleteStmt := tx.Stmt(a.preparedDelete)
+	deleteSessionsStmt := tx.Stmt(a.preparedSessionDeleteUser)
+	for _, id := range ids {
+		if _, err = deleteStmt.Exec(id); err != nil {
+			err = fmt.Errorf("users, delete: %v", err)
+			break
+		}
+		if _, err = deleteSessionsStmt.Exec(id); err != nil {
+			err = fmt.Errorf("users, sessions delete: %v", err)
+			break
+		}
+		if err = a.storage.Statuses.deleteUserTx(tx, id); err != nil {
+			break
+		}
+		if err = a.storage.Shelves.deleteUserTx(tx, id); err != nil {
+			break
+		}
+		if err = a.storage.Positions.deleteUserTx(tx, id); err != nil {
+			break
+		}
+		if err = a.storage.KOSync.deleteUserTx(tx, id); err != nil {
+			break
+		}
+		if err = a.storage.Kobo.deleteUserTx(tx, id); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	return err
+}
+
+func (a *UserStorage) Count(q *Query) (int, error) {
+	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
+	query, bindValues, err := q.buildSelect(a.baseCountQuery, userFields.columns)
+	if err != nil {
+		return -1, err
+	}
+
+	total := 0
+	row := a.storage.db.QueryRow(query, bindValues...)
+	if err := row.Scan(&total); err != nil {
+		return -1, err
+	}
+	return total, nil
+}
+
+func (a *UserStorage) Query(q *Query) ([]*booklist.User, error) {
+	// specify columns explicitly (instead of *) to make sure Scan() encounters them in precisely the expected order
+	query, bindValues, err := q.buildSelect(a.baseSelectQuery, userFields.columns)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := a.storage.db.Query(query, bindValues...)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*booklist.User, 0, 16)
+
+	defer rows.Close()
+	for rows.Next() {
+		user := &booklist.User{}
+		if err := userFields.scan(rows, user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// queryOne returns the first user matching q, or nil if there is none.
+func (a *UserStorage) queryOne(q *Query) (*booklist.User, error) {
+	users, err := a.Query(q.Take(1))
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+// Retrieves a user by ID, or nil if there is no such user.
+func (a *UserStorage) ByID(id int) (*booklist.User, error) {
+	return a.queryOne(NewQuery().In("id", []int{id}))
+}
+
+// Retrieves a user by username (which is case-insensitive), or nil if there is no such user.
+func (a *UserStorage) ByUsername(username string) (*booklist.User, error) {
+	return a.queryOne(NewQuery().Filtered("username", username, true))
+}
+
+// Retrieves the user with the given API token, or nil if no user has that token.
+func (a *UserStorage) ByToken(token string) (*booklist.User, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return a.queryOne(NewQuery().Filtered("tokenhash", hashToken(token), true))
+}
+
+// Generates and saves a new API token for the user, replacing any existing token. Only a hash of the token is
+// stored, so the returned token can't be retrieved again later.
+func (a *UserStorage) NewToken(user *booklist.User) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	user.TokenHash = hashToken(token)
+	if err = a.Save(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Starts a new session for the user which lasts for the specified duration, and returns the session's token. Expired
+// sessions are deleted at the same time.
+func (a *UserStorage) NewSession(user *booklist.User, lifetime time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if _, err = a.preparedSessionDeleteExpired.Exec(now.Unix()); err != nil {
+		return "", fmt.Errorf("sessions, delete expired: %v", err)
+	}
+	if _, err = a.preparedSessionInsert.Exec(hashToken(token), user.ID, now.Add(lifetime).Unix()); err != nil {
+		return "", fmt.Errorf("sessions, insert: %v", err)
+	}
+	return token, nil
+}
+
+// Retrieves the user signed in to the session with the given token, or nil if the session doesn't exist or has
+// expired.
+func (a *UserStorage) BySession(token string) (*booklist.User, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	var userID int
+	err := a.preparedSessionSelect.QueryRow(hashToken(token), time.Now().Unix()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("sessions, select: %v", err)
+	}
+	return a.ByID(userID)
+}
+
+// Ends the session with the given token.
+func (a *UserStorage) DeleteSession(token string) error {
+	if _, err := a.preparedSessionDelete.Exec(hashToken(token)); err != nil {
+		return fmt.Errorf("sessions, delete: %v", err)
+	}
+	return nil
+}
+
+// Ends all of the user's sessions.
+func (a *UserStorage) DeleteSessions(user *booklist.User) error {
+	if _, err := a.preparedSessionDeleteUser.Exec(user.ID); err != nil {
+		return fmt.Errorf("sessions, delete: %v", err)
+	}
+	return nil
+}
+
+// newToken generates a random token for a session or API client.
+func newToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashToken hashes a token for storage; tokens are random, so a fast unsalted hash is sufficient to ensure that the
+// database can't be used to sign in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
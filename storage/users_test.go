@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sblinch/BookBrowser/booklist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserStorage(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	user := &booklist.User{Username: "Reader"}
+	require.NoError(t, user.SetPassword("correct horse"))
+	require.NoError(t, s.Users.Save(user))
+	assert.NotZero(t, user.ID)
+
+	found, err := s.Users.ByUsername("reader")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, user.ID, found.ID)
+	assert.True(t, found.CheckPassword("correct horse"))
+	assert.False(t, found.CheckPassword("wrong"))
+
+	token, err := s.Users.NewToken(user)
+	require.NoError(t, err)
+	found, err = s.Users.ByToken(token)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, user.ID, found.ID)
+	found, err = s.Users.ByToken(user.TokenHash)
+	require.NoError(t, err)
+	assert.Nil(t, found, "the stored hash must not work as a token")
+
+	session, err := s.Users.NewSession(user, time.Hour)
+	require.NoError(t, err)
+	found, err = s.Users.BySession(session)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, user.ID, found.ID)
+
+	expired, err := s.Users.NewSession(user, -time.Hour)
+	require.NoError(t, err)
+	found, err = s.Users.BySession(expired)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	require.NoError(t, s.Users.DeleteSession(session))
+	found, err = s.Users.BySession(session)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	session, err = s.Users.NewSession(user, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, s.Users.Delete(user.ID))
+	found, err = s.Users.BySession(session)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+}